@@ -0,0 +1,291 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+var adminKeysFile = flag.String("admin_keys", "", "Path to admin PubKey list ( authorized_keys format ) for /api/v1/admin/, empty - admin API disabled")
+
+const adminPrefix = "/api/v1/admin/"
+
+var ErrSuspended = errors.New("tenant is suspended")
+
+// AdminTenant is tenant with its instance counters
+type AdminTenant struct {
+	Tenant
+	Instances int `json:"instances"`
+	K8s       int `json:"k8s"`
+}
+
+// AdminNode is the node with instances ( <cid>/<id> ) placed on it
+type AdminNode struct {
+	Node      string   `json:"node"`
+	Instances []string `json:"instances"`
+}
+
+func isAdminPath(r *http.Request) bool {
+	return strings.HasPrefix(r.URL.Path, adminPrefix)
+}
+
+// isSuspended tenant may not create nor access instances
+func isSuspended(Cid string) bool {
+	tenant, err := store.GetTenant(Cid)
+	return err == nil && tenant.Suspended
+}
+
+// adminRoutes registers /api/v1/admin/ endpoints, requests must be signed
+// by a key of admins list
+func adminRoutes(router *mux.Router, admins *MyFeeds) {
+	sub := router.PathPrefix("/api/v1/admin").Subrouter()
+	sub.Use(admins.adminMiddleware)
+
+	sub.HandleFunc("/tenants", HandleAdminTenants).Methods("GET")
+	sub.HandleFunc("/instances", HandleAdminInstances).Methods("GET")
+	sub.HandleFunc("/clusters", HandleAdminInstances).Methods("GET")
+	sub.HandleFunc("/nodes", HandleAdminNodes).Methods("GET")
+	sub.HandleFunc("/jobs", HandleAdminJobs).Methods("GET")
+	sub.HandleFunc("/destroy/{Cid}/{InstanceId}", HandleAdminDestroy).Methods("POST")
+	sub.HandleFunc("/stop/{Cid}/{InstanceId}", HandleAdminStop).Methods("POST")
+	sub.HandleFunc("/suspend/{Cid}", HandleAdminSuspend).Methods("POST")
+	sub.HandleFunc("/unsuspend/{Cid}", HandleAdminSuspend).Methods("POST")
+}
+
+// adminMiddleware verifies request signature by admin key, -auth mode is
+// not applied: admin API is always signed. keyid is the key fingerprint or md5.
+func (admins *MyFeeds) adminMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth, err := parseAuthorization(r.Header.Get("Authorization"))
+		if err != nil {
+			JSONError(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+
+		f := admins.feed()
+		p, ok := f.byFingerprint[auth.KeyId]
+		if !ok {
+			p, ok = f.byCid[auth.KeyId]
+		}
+		if !ok {
+			fmt.Printf("admin: unknown key: %s\n", auth.KeyId)
+			JSONError(w, ErrUnknownKey.Error(), http.StatusUnauthorized)
+			return
+		}
+
+		body, err := readBody(r)
+		if err != nil {
+			JSONError(w, "unable to read body", http.StatusBadRequest)
+			return
+		}
+		if err := verifyRequest(r, body, p.key); err != nil {
+			fmt.Printf("admin: %s: %s\n", p.fingerprint, err.Error())
+			JSONError(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+
+		fmt.Printf("admin: %s %s %s\n", p.fingerprint, r.Method, r.URL.Path)
+		next.ServeHTTP(w, r)
+	})
+}
+
+func HandleAdminTenants(w http.ResponseWriter, r *http.Request) {
+	tenants, err := store.ListTenants()
+	if err != nil {
+		JSONError(w, "", http.StatusInternalServerError)
+		return
+	}
+	instances, err := store.ListInstances("")
+	if err != nil {
+		JSONError(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	list := []*AdminTenant{}
+	byCid := make(map[string]*AdminTenant)
+	for _, tenant := range tenants {
+		t := &AdminTenant{Tenant: *tenant}
+		list = append(list, t)
+		byCid[tenant.Cid] = t
+	}
+	for _, inst := range instances {
+		t, ok := byCid[inst.Cid]
+		if !ok {
+			continue
+		}
+		if inst.Kind == KindK8s {
+			t.K8s++
+		} else {
+			t.Instances++
+		}
+	}
+
+	writeJSON(w, list)
+}
+
+// HandleAdminInstances lists VM/jail instances ( /instances ) or K8S
+// clusters ( /clusters ) of all tenants or of ?cid=
+func HandleAdminInstances(w http.ResponseWriter, r *http.Request) {
+	Cid := r.URL.Query().Get("cid")
+	if len(Cid) > 0 && !validateCid(Cid) {
+		JSONError(w, "The cid should be valid form: ^[a-f0-9]{32}$", http.StatusBadRequest)
+		return
+	}
+
+	kind := KindVm
+	if strings.HasSuffix(r.URL.Path, "/clusters") {
+		kind = KindK8s
+	}
+
+	instances, err := store.ListInstances(Cid)
+	if err != nil {
+		JSONError(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	list := []*Instance{}
+	for _, inst := range instances {
+		if inst.Kind != kind {
+			continue
+		}
+		if node, err := instanceNode(inst); err == nil {
+			inst.Node = node
+		}
+		list = append(list, inst)
+	}
+
+	writeJSON(w, list)
+}
+
+// HandleAdminNodes lists nodes known by instances placement
+func HandleAdminNodes(w http.ResponseWriter, r *http.Request) {
+	instances, err := store.ListInstances("")
+	if err != nil {
+		JSONError(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	byNode := make(map[string]*AdminNode)
+	for _, inst := range instances {
+		node, err := instanceNode(inst)
+		if err != nil || len(node) == 0 {
+			node = "unknown"
+		}
+		n, ok := byNode[node]
+		if !ok {
+			n = &AdminNode{Node: node, Instances: []string{}}
+			byNode[node] = n
+		}
+		n.Instances = append(n.Instances, inst.Cid+"/"+inst.Id)
+	}
+
+	list := []*AdminNode{}
+	for _, n := range byNode {
+		list = append(list, n)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Node < list[j].Node })
+
+	writeJSON(w, list)
+}
+
+// HandleAdminJobs lists not finished jobs of all tenants, ?all=1 for all jobs
+func HandleAdminJobs(w http.ResponseWriter, r *http.Request) {
+	jobs, err := store.ListJobs("", "")
+	if err != nil {
+		JSONError(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	all := r.URL.Query().Get("all") == "1"
+	list := []*Job{}
+	for _, job := range jobs {
+		if all || !jobFinished(job) {
+			list = append(list, job)
+		}
+	}
+
+	writeJSON(w, list)
+}
+
+// adminInstance returns instance of {Cid}/{InstanceId}, replies error when none
+func adminInstance(w http.ResponseWriter, r *http.Request) *Instance {
+	params := mux.Vars(r)
+	if !validateCid(params["Cid"]) || !validateInstanceId(params["InstanceId"]) {
+		JSONError(w, "bad cid or InstanceId", http.StatusBadRequest)
+		return nil
+	}
+
+	inst, err := store.GetInstance(params["Cid"], params["InstanceId"])
+	if err != nil {
+		JSONError(w, "not found", http.StatusNotFound)
+		return nil
+	}
+	return inst
+}
+
+// HandleAdminDestroy destroys instance of any tenant, regardless of ACL, role
+// and suspension. Instance without node is removed from store only.
+func HandleAdminDestroy(w http.ResponseWriter, r *http.Request) {
+	inst := adminInstance(w, r)
+	if inst == nil {
+		return
+	}
+
+	if _, err := instanceNode(inst); err != nil {
+		fmt.Printf("admin destroy: %s/%s has no node, remove from store\n", inst.Cid, inst.Id)
+		if err := destroyStored(store, inst.Cid, inst.Id); err != nil {
+			JSONError(w, "", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, JobResponse{"removed", 0})
+		return
+	}
+
+	destroyInstance(w, r, inst)
+}
+
+func HandleAdminStop(w http.ResponseWriter, r *http.Request) {
+	inst := adminInstance(w, r)
+	if inst == nil {
+		return
+	}
+	if inst.Kind != KindVm {
+		JSONError(w, "not found", http.StatusNotFound)
+		return
+	}
+
+	stopInstance(w, r, inst)
+}
+
+// HandleAdminSuspend sets ( /suspend ) or clears ( /unsuspend ) Suspended
+// of tenant, unknown tenant is recorded to be suspended on first create
+func HandleAdminSuspend(w http.ResponseWriter, r *http.Request) {
+	Cid := mux.Vars(r)["Cid"]
+	if !validateCid(Cid) {
+		JSONError(w, "The cid should be valid form: ^[a-f0-9]{32}$", http.StatusBadRequest)
+		return
+	}
+
+	tenant, err := store.GetTenant(Cid)
+	if err == ErrNotFound {
+		tenant = &Tenant{Cid: Cid, Created: time.Now()}
+	} else if err != nil {
+		JSONError(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	tenant.Suspended = !strings.Contains(r.URL.Path, "/unsuspend/")
+	if err := store.PutTenant(tenant); err != nil {
+		JSONError(w, "", http.StatusInternalServerError)
+		return
+	}
+	fmt.Printf("admin: tenant %s suspended: %t\n", Cid, tenant.Suspended)
+
+	writeJSON(w, tenant)
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestAdminAPI(t *testing.T) {
+	setupInstances(t, 2)
+	broker = newMemoryBroker(MemoryConfig{})
+
+	admin, line := testKey("admin@example.org")
+	p, err := newAllow(line)
+	if err != nil {
+		t.Fatal(err)
+	}
+	admins := &MyFeeds{f: &Feed{}}
+	admins.f.Append(p)
+
+	router := newRouter(&MyFeeds{f: &Feed{}})
+	adminRoutes(router, admins)
+
+	nonce := 0
+	do := func(method string, path string, signer ssh.Signer) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		if signer != nil {
+			nonce++
+			signRequest(req, nil, signer, ssh.FingerprintSHA256(signer.PublicKey()), fmt.Sprintf("admin-nonce-%d", nonce))
+		}
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec
+	}
+	decode := func(rec *httptest.ResponseRecorder, v interface{}) {
+		t.Helper()
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%d %s", rec.Code, rec.Body.String())
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tenantStatus := func() int {
+		req := httptest.NewRequest("GET", "/api/v1/status/vm0", nil)
+		req.Header.Set("cid", testCid)
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	other, _ := testKey("other@example.org")
+	if rec := do("GET", "/api/v1/admin/tenants", nil); rec.Code != http.StatusUnauthorized {
+		t.Errorf("unsigned: %d", rec.Code)
+	}
+	if rec := do("GET", "/api/v1/admin/tenants", other); rec.Code != http.StatusUnauthorized {
+		t.Errorf("not admin: %d", rec.Code)
+	}
+
+	var tenants []AdminTenant
+	decode(do("GET", "/api/v1/admin/tenants", admin), &tenants)
+	if len(tenants) != 1 || tenants[0].Cid != testCid || tenants[0].Instances != 2 {
+		t.Errorf("tenants: %+v", tenants)
+	}
+
+	var nodes []AdminNode
+	decode(do("GET", "/api/v1/admin/nodes", admin), &nodes)
+	if len(nodes) != 2 || nodes[0].Node != "node0.example.org" || nodes[0].Instances[0] != testCid+"/vm0" {
+		t.Errorf("nodes: %+v", nodes)
+	}
+
+	var instances []Instance
+	decode(do("GET", "/api/v1/admin/instances?cid="+testCid, admin), &instances)
+	if len(instances) != 2 {
+		t.Errorf("instances: %+v", instances)
+	}
+	decode(do("GET", "/api/v1/admin/clusters", admin), &instances)
+	if len(instances) != 0 {
+		t.Errorf("clusters: %+v", instances)
+	}
+
+	if rec := do("POST", "/api/v1/admin/stop/"+testCid+"/vm0", admin); rec.Code != http.StatusOK {
+		t.Errorf("stop: %d %s", rec.Code, rec.Body.String())
+	}
+	var jobs []Job
+	// the stop job may be already finished
+	decode(do("GET", "/api/v1/admin/jobs?all=1", admin), &jobs)
+	if len(jobs) != 1 || jobs[0].Command != "stop" || jobs[0].Cid != testCid {
+		t.Errorf("jobs: %+v", jobs)
+	}
+
+	// suspended tenant is locked out, admin still can act
+	if code := tenantStatus(); code != http.StatusOK {
+		t.Fatalf("status: %d", code)
+	}
+	if rec := do("POST", "/api/v1/admin/suspend/"+testCid, admin); rec.Code != http.StatusOK {
+		t.Fatalf("suspend: %d %s", rec.Code, rec.Body.String())
+	}
+	if code := tenantStatus(); code != http.StatusForbidden {
+		t.Errorf("status of suspended: %d", code)
+	}
+	if rec := do("POST", "/api/v1/admin/destroy/"+testCid+"/vm1", admin); rec.Code != http.StatusOK {
+		t.Errorf("destroy: %d %s", rec.Code, rec.Body.String())
+	}
+	if _, err := store.GetInstance(testCid, "vm1"); err != ErrNotFound {
+		t.Errorf("destroyed instance: %v", err)
+	}
+	if rec := do("POST", "/api/v1/admin/unsuspend/"+testCid, admin); rec.Code != http.StatusOK {
+		t.Fatalf("unsuspend: %d %s", rec.Code, rec.Body.String())
+	}
+	if code := tenantStatus(); code != http.StatusOK {
+		t.Errorf("status of unsuspended: %d", code)
+	}
+
+	// instance without node is removed from store
+	if err := store.PutInstance(&Instance{Cid: testCid, Id: "lost", Jname: "lost1", Kind: KindVm}); err != nil {
+		t.Fatal(err)
+	}
+	var reply JobResponse
+	decode(do("POST", "/api/v1/admin/destroy/"+testCid+"/lost", admin), &reply)
+	if reply.Message != "removed" {
+		t.Errorf("destroy without node: %+v", reply)
+	}
+	if rec := do("POST", "/api/v1/admin/destroy/"+testCid+"/lost", admin); rec.Code != http.StatusNotFound {
+		t.Errorf("destroy of removed: %d", rec.Code)
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+)
+
+var allowListPoll = flag.Int("allowlist_poll", 5, "Check -allowlist file for changes every N seconds, 0 - reload on SIGHUP only")
+
+// loadAllowList parses allowlist file into new Feed, the format is
+// authorized_keys: blank and # lines are skipped, options are allowed
+func loadAllowList(path string) (*Feed, error) {
+	fd, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+
+	f := &Feed{}
+
+	scanner := bufio.NewScanner(fd)
+	scanner.Split(bufio.ScanLines)
+
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if len(text) == 0 || text[0] == '#' {
+			continue
+		}
+		p, err := newAllow(text)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+		f.Append(p)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return f, nil
+}
+
+// cids of the Feed records
+func (f *Feed) cids() map[string]bool {
+	cids := make(map[string]bool)
+	for cid := range f.byCid {
+		cids[cid] = true
+	}
+	return cids
+}
+
+// feed returns current allowlist, it is never modified after load
+func (feeds *MyFeeds) feed() *Feed {
+	feeds.mu.RLock()
+	defer feeds.mu.RUnlock()
+	return feeds.f
+}
+
+// Reload replaces allowlist by content of path, current list is kept when
+// the file fails to parse
+func (feeds *MyFeeds) Reload(path string) error {
+	f, err := loadAllowList(path)
+	if err != nil {
+		fmt.Printf("* ACL reload failed, keep current list: %s\n", err.Error())
+		return err
+	}
+
+	feeds.mu.Lock()
+	old := feeds.f
+	feeds.f = f
+	feeds.mu.Unlock()
+
+	oldCids := old.cids()
+	newCids := f.cids()
+	for cid := range newCids {
+		if !oldCids[cid] {
+			fmt.Printf("* ACL added: %s\n", cid)
+		}
+	}
+	for cid := range oldCids {
+		if !newCids[cid] {
+			fmt.Printf("* ACL removed: %s\n", cid)
+		}
+	}
+	fmt.Printf("* ACL reloaded: %s, AllowList Length: %d\n", path, f.length)
+	return nil
+}
+
+// watchAllowList starts reload of allowlist on SIGHUP and when the file
+// mtime or size changes
+func (feeds *MyFeeds) watchAllowList(path string, poll time.Duration) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	var tick <-chan time.Time
+	if poll > 0 {
+		tick = time.NewTicker(poll).C
+	}
+
+	var modTime time.Time
+	var size int64
+	if st, err := os.Stat(path); err == nil {
+		modTime, size = st.ModTime(), st.Size()
+	}
+
+	go func() {
+		for {
+			select {
+			case <-hup:
+				fmt.Printf("* SIGHUP: reload ACL %s\n", path)
+				feeds.Reload(path)
+			case <-tick:
+				st, err := os.Stat(path)
+				if err != nil || (st.ModTime().Equal(modTime) && st.Size() == size) {
+					continue
+				}
+				modTime, size = st.ModTime(), st.Size()
+				feeds.Reload(path)
+			}
+		}
+	}()
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/md5"
+	"crypto/rand"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+var (
+	testKeyA = testKeyLine("alice@example.org")
+	testKeyB = testKeyLine("bob@example.org")
+)
+
+// testKey returns signer of new ed25519 key and its authorized_keys line
+func testKey(comment string) (ssh.Signer, string) {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		panic(err)
+	}
+	return signer, strings.TrimSpace(strings.TrimSpace(string(ssh.MarshalAuthorizedKey(signer.PublicKey()))) + " " + comment)
+}
+
+// testKeyLine returns authorized_keys line of new ed25519 key
+func testKeyLine(comment string) string {
+	_, line := testKey(comment)
+	return line
+}
+
+func allowCid(t *testing.T, line string) string {
+	t.Helper()
+	p, err := newAllow(line)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p.cid
+}
+
+func writeAllowList(t *testing.T, path string, content string, mtime time.Time) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAllowListReload(t *testing.T) {
+	setupInstances(t, 0)
+	acl_enable = true
+	t.Cleanup(func() { acl_enable = false })
+
+	path := filepath.Join(t.TempDir(), "cbsd-mq-api.allow")
+	writeAllowList(t, path, testKeyA+"\n", time.Now())
+
+	f, err := loadAllowList(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	feeds := &MyFeeds{f: f}
+	cidA := allowCid(t, testKeyA)
+	cidB := allowCid(t, testKeyB)
+
+	// readers during reloads
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+					isCidAllowed(feeds, cidA)
+					isPubKeyAllowed(feeds, testKeyA)
+				}
+			}
+		}()
+	}
+
+	writeAllowList(t, path, testKeyA+"\n"+testKeyB+"\n", time.Now())
+	if err := feeds.Reload(path); err != nil {
+		t.Fatal(err)
+	}
+	if !isCidAllowed(feeds, cidB) || !isPubKeyAllowed(feeds, testKeyB) {
+		t.Errorf("added key is not allowed after reload")
+	}
+
+	writeAllowList(t, path, testKeyB+"\nbroken\n", time.Now())
+	if err := feeds.Reload(path); err == nil {
+		t.Errorf("broken allowlist is loaded")
+	}
+	if !isCidAllowed(feeds, cidA) || !isCidAllowed(feeds, cidB) {
+		t.Errorf("current list is not kept on parse failure")
+	}
+
+	writeAllowList(t, path, testKeyB+"\n", time.Now())
+	if err := feeds.Reload(path); err != nil {
+		t.Fatal(err)
+	}
+	if isCidAllowed(feeds, cidA) {
+		t.Errorf("removed key is still allowed")
+	}
+
+	close(stop)
+	wg.Wait()
+}
+
+func TestAllowListWatch(t *testing.T) {
+	setupInstances(t, 0)
+	acl_enable = true
+	t.Cleanup(func() { acl_enable = false })
+
+	path := filepath.Join(t.TempDir(), "cbsd-mq-api.allow")
+	mtime := time.Now().Add(-time.Hour)
+	writeAllowList(t, path, testKeyA+"\n", mtime)
+
+	f, err := loadAllowList(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	feeds := &MyFeeds{f: f}
+	feeds.watchAllowList(path, 10*time.Millisecond)
+
+	cidB := allowCid(t, testKeyB)
+	writeAllowList(t, path, testKeyA+"\n"+testKeyB+"\n", mtime.Add(time.Minute))
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !isCidAllowed(feeds, cidB) {
+		if time.Now().After(deadline) {
+			t.Fatal("allowlist is not reloaded on file change")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestAllowListSighup(t *testing.T) {
+	setupInstances(t, 0)
+	acl_enable = true
+	t.Cleanup(func() { acl_enable = false })
+
+	path := filepath.Join(t.TempDir(), "cbsd-mq-api.allow")
+	writeAllowList(t, path, testKeyA+"\n", time.Now())
+
+	f, err := loadAllowList(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	feeds := &MyFeeds{f: f}
+	feeds.watchAllowList(path, 0)
+
+	cidB := allowCid(t, testKeyB)
+	writeAllowList(t, path, testKeyA+"\n"+testKeyB+"\n", time.Now())
+	if err := syscall.Kill(os.Getpid(), syscall.SIGHUP); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !isCidAllowed(feeds, cidB) {
+		if time.Now().After(deadline) {
+			t.Fatal("allowlist is not reloaded on SIGHUP")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestAllowListParse(t *testing.T) {
+	setupInstances(t, 0)
+	acl_enable = true
+	t.Cleanup(func() { acl_enable = false })
+
+	noComment := testKeyLine("")
+	multiWord := testKeyLine("deploy key of team two")
+	withOptions := testKeyLine("carol@example.org")
+
+	path := filepath.Join(t.TempDir(), "cbsd-mq-api.allow")
+	writeAllowList(t, path, strings.Join([]string{
+		"# team one",
+		"",
+		noComment,
+		"   " + multiWord,
+		`from="10.0.0.0/8",no-pty ` + withOptions,
+		"",
+	}, "\n"), time.Now())
+
+	f, err := loadAllowList(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.length != 3 {
+		t.Fatalf("length: %d", f.length)
+	}
+	feeds := &MyFeeds{f: f}
+
+	for _, line := range []string{noComment, multiWord, withOptions} {
+		cid := fmt.Sprintf("%x", md5.Sum([]byte(line)))
+		if !isCidAllowed(feeds, cid) {
+			t.Errorf("cid of [%s] is not allowed", line)
+		}
+		if !isPubKeyAllowed(feeds, line) {
+			t.Errorf("pubkey [%s] is not allowed", line)
+		}
+	}
+
+	if p := f.byCid[allowCid(t, withOptions)]; p == nil || len(p.options) != 2 || p.comment != "carol@example.org" {
+		t.Errorf("options or comment are lost: %+v", p)
+	}
+
+	// key material matters, not the comment
+	if !isPubKeyAllowed(feeds, strings.Replace(multiWord, "deploy key of team two", "other comment", 1)) {
+		t.Errorf("same key with other comment is not allowed")
+	}
+	if isPubKeyAllowed(feeds, testKeyLine("deploy key of team two")) {
+		t.Errorf("other key with the same comment is allowed")
+	}
+	if isPubKeyAllowed(feeds, "ssh-ed25519 garbage") {
+		t.Errorf("malformed key is allowed")
+	}
+
+	writeAllowList(t, path, noComment+"\nssh-ed25519 garbage\n", time.Now())
+	if _, err := loadAllowList(path); err == nil || !strings.Contains(err.Error(), ":2:") {
+		t.Errorf("malformed line is not reported: %v", err)
+	}
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// auth modes
+const (
+	authSignature = "signature" // requests signed by the tenant SSH key
+	authCid       = "cid"       // legacy: bare cid header
+	authAny       = "any"       // signature when Authorization is set, cid header otherwise
+)
+
+// Authorization scheme: CBSD-SSH keyid="<cid>",nonce="<nonce>",signature="<base64>"
+const authScheme = "CBSD-SSH"
+
+// curlHint returns JSON string with example request of path for create
+// replies: bare cid header unless -auth signature, where it does not pass
+func curlHint(cid string, path string) string {
+	hint := fmt.Sprintf("curl -H cid:%s %s%s", cid, server_url, path)
+	if *authMode == authSignature {
+		hint = fmt.Sprintf("curl -H 'Date: DATE' -H 'Authorization: %s keyid=\"%s\",nonce=\"NONCE\",signature=\"SIGNATURE\"' %s%s", authScheme, cid, server_url, path)
+	}
+	js, _ := json.Marshal(hint)
+	return string(js)
+}
+
+var (
+	authMode = flag.String("auth", authSignature, "Request authentication: signature, cid (legacy bare cid header) or any")
+	authSkew = flag.Int("auth_skew", 300, "Max difference between request Date and server time, seconds")
+)
+
+var regexpAuthParam = regexp.MustCompile(`([a-z]+)="([^"]*)"`)
+var regexpNonce = regexp.MustCompile(`^[a-zA-Z0-9_\-]{8,64}$`)
+
+var (
+	ErrNoSignature  = errors.New("auth: request is not signed")
+	ErrBadSignature = errors.New("auth: bad signature")
+	ErrReplay       = errors.New("auth: nonce already used")
+	ErrSkew         = errors.New("auth: Date is missing or out of allowed window")
+	ErrUnknownKey   = errors.New("auth: unknown keyid")
+)
+
+// requestAuth is parsed Authorization header
+type requestAuth struct {
+	KeyId     string
+	Nonce     string
+	Signature *ssh.Signature
+}
+
+// nonceCache remembers nonces until their Date leaves the allowed window
+type nonceCache struct {
+	mu   sync.Mutex
+	seen map[string]time.Time
+}
+
+var nonces = &nonceCache{seen: make(map[string]time.Time)}
+
+// Add returns false when nonce of keyId was already used
+func (c *nonceCache) Add(keyId string, nonce string, expire time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	for k, t := range c.seen {
+		if now.After(t) {
+			delete(c.seen, k)
+		}
+	}
+
+	key := keyId + "/" + nonce
+	if _, ok := c.seen[key]; ok {
+		return false
+	}
+	c.seen[key] = expire
+	return true
+}
+
+// signedString is what client signs: method, path with query, Date header,
+// nonce and hex sha256 of the body
+func signedString(method string, uri string, date string, nonce string, body []byte) []byte {
+	digest := sha256.Sum256(body)
+	return []byte(fmt.Sprintf("cbsd-mq-api\n%s\n%s\n%s\n%s\n%s", method, uri, date, nonce, hex.EncodeToString(digest[:])))
+}
+
+func parseAuthorization(header string) (*requestAuth, error) {
+	if !strings.HasPrefix(header, authScheme+" ") {
+		return nil, ErrNoSignature
+	}
+
+	params := make(map[string]string)
+	for _, m := range regexpAuthParam.FindAllStringSubmatch(header[len(authScheme)+1:], -1) {
+		params[m[1]] = m[2]
+	}
+
+	if !regexpNonce.MatchString(params["nonce"]) {
+		return nil, errors.New("auth: nonce should be valid form: ^[a-zA-Z0-9_-]{8,64}$")
+	}
+
+	blob, err := base64.StdEncoding.DecodeString(params["signature"])
+	if err != nil {
+		return nil, ErrBadSignature
+	}
+	sig := &ssh.Signature{}
+	if err := ssh.Unmarshal(blob, sig); err != nil {
+		return nil, ErrBadSignature
+	}
+
+	return &requestAuth{KeyId: params["keyid"], Nonce: params["nonce"], Signature: sig}, nil
+}
+
+// verifyRequest checks the request signature made by key, body is the
+// already read request body
+func verifyRequest(r *http.Request, body []byte, key ssh.PublicKey) error {
+	auth, err := parseAuthorization(r.Header.Get("Authorization"))
+	if err != nil {
+		return err
+	}
+
+	date, err := http.ParseTime(r.Header.Get("Date"))
+	skew := time.Duration(*authSkew) * time.Second
+	if err != nil || time.Since(date) > skew || time.Until(date) > skew {
+		return ErrSkew
+	}
+
+	data := signedString(r.Method, r.URL.RequestURI(), r.Header.Get("Date"), auth.Nonce, body)
+	if err := key.Verify(data, auth.Signature); err != nil {
+		return ErrBadSignature
+	}
+
+	// nonce is remembered only for verified requests
+	if !nonces.Add(ssh.FingerprintSHA256(key), auth.Nonce, date.Add(skew)) {
+		return ErrReplay
+	}
+	return nil
+}
+
+// signRequest sets Date and Authorization headers of req, the client side
+// of verifyRequest. keyId is the cid, may be empty for create.
+func signRequest(req *http.Request, body []byte, signer ssh.Signer, keyId string, nonce string) error {
+	date := time.Now().UTC().Format(http.TimeFormat)
+	sig, err := signer.Sign(nil, signedString(req.Method, req.URL.RequestURI(), date, nonce, body))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Date", date)
+	req.Header.Set("Authorization", fmt.Sprintf("%s keyid=\"%s\",nonce=\"%s\",signature=\"%s\"",
+		authScheme, keyId, nonce, base64.StdEncoding.EncodeToString(ssh.Marshal(sig))))
+	return nil
+}
+
+// tenantKey returns public key of cid: from allowlist or recorded on
+// the first instance
+func tenantKey(feeds *MyFeeds, cid string) (ssh.PublicKey, error) {
+	if p, ok := feeds.feed().byCid[cid]; ok {
+		return p.key, nil
+	}
+
+	tenant, err := store.GetTenant(cid)
+	if err != nil || len(tenant.Pubkey) == 0 {
+		return nil, ErrUnknownKey
+	}
+
+	key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(tenant.Pubkey))
+	if err != nil {
+		return nil, ErrUnknownKey
+	}
+	return key, nil
+}
+
+// verifyCreate authenticates create request of cid: signed by the payload key
+// or by the cid key ( verified by authMiddleware )
+func verifyCreate(r *http.Request, body []byte, key ssh.PublicKey, cid string) error {
+	if *authMode == authCid {
+		return nil
+	}
+
+	if len(r.Header.Get("Authorization")) == 0 {
+		if *authMode == authSignature {
+			return ErrNoSignature
+		}
+		return nil
+	}
+
+	if verified := r.Header.Get("cid"); len(verified) > 0 {
+		if verified != cid {
+			return errors.New("auth: request is signed by another tenant")
+		}
+		return nil
+	}
+
+	return verifyRequest(r, body, key)
+}
+
+// readBody returns request body and puts it back for the handler
+func readBody(r *http.Request) ([]byte, error) {
+	if r.Body == nil {
+		return []byte{}, nil
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, MAX_UPLOAD_SIZE))
+	if err != nil {
+		return nil, err
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	return body, nil
+}
+
+// authMiddleware verifies signed requests and passes keyid to handlers as cid
+// header. Create is signed by the payload key, it is verified by the handler.
+func (feeds *MyFeeds) authMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// admin API is verified by adminMiddleware
+		if *authMode == authCid || isAdminPath(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		signed := len(r.Header.Get("Authorization")) > 0
+		if !signed {
+			if *authMode == authSignature && len(r.Header.Get("cid")) > 0 {
+				JSONError(w, ErrNoSignature.Error(), http.StatusUnauthorized)
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// cid header of signed request is the verified keyid only
+		r.Header.Del("cid")
+
+		auth, err := parseAuthorization(r.Header.Get("Authorization"))
+		if err != nil {
+			JSONError(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		if len(auth.KeyId) == 0 {
+			// create: key is in the payload
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if !validateCid(auth.KeyId) && !isFingerprint(auth.KeyId) {
+			JSONError(w, "The keyid should be valid form: ^[a-f0-9]{32}$ or SHA256 fingerprint", http.StatusUnauthorized)
+			return
+		}
+		cid, ok := feeds.resolveCid(auth.KeyId)
+		if !ok {
+			JSONError(w, ErrUnknownKey.Error(), http.StatusUnauthorized)
+			return
+		}
+
+		key, err := tenantKey(feeds, cid)
+		if err != nil {
+			fmt.Printf("auth: %s: %s\n", auth.KeyId, err.Error())
+			JSONError(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+
+		body, err := readBody(r)
+		if err != nil {
+			JSONError(w, "unable to read body", http.StatusBadRequest)
+			return
+		}
+
+		if err := verifyRequest(r, body, key); err != nil {
+			fmt.Printf("auth: %s: %s\n", auth.KeyId, err.Error())
+			JSONError(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+
+		r.Header.Set("cid", cid)
+		next.ServeHTTP(w, r)
+	})
+}
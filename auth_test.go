@@ -0,0 +1,166 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// newTestTenant returns signer of new key and its cid, tenant has instance vm1
+func newTestTenant(t *testing.T) (ssh.Signer, string, string) {
+	t.Helper()
+
+	signer, pubkey := testKey("test@localhost")
+	cid := fmt.Sprintf("%x", md5.Sum([]byte(pubkey)))
+
+	if err := store.PutTenant(&Tenant{Cid: cid, Pubkey: pubkey, Fingerprint: ssh.FingerprintSHA256(signer.PublicKey()), Created: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.PutInstance(&Instance{Cid: cid, Id: "vm1", Jname: "env1", Kind: KindVm, Node: "node1.example.org"}); err != nil {
+		t.Fatal(err)
+	}
+	return signer, cid, pubkey
+}
+
+func TestSignatureAuth(t *testing.T) {
+	setupInstances(t, 0)
+	*authMode = authSignature
+	t.Cleanup(func() { *authMode = authCid })
+	broker = newMemoryBroker(MemoryConfig{})
+
+	signer, cid, _ := newTestTenant(t)
+	other, _, _ := newTestTenant(t)
+	router := newRouter(&MyFeeds{f: &Feed{}})
+
+	do := func(req *http.Request) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec
+	}
+
+	// bare cid header is not enough
+	req := httptest.NewRequest("GET", "/api/v1/stop/vm1", nil)
+	req.Header.Set("cid", cid)
+	if rec := do(req); rec.Code != http.StatusUnauthorized {
+		t.Errorf("cid header: %d %s", rec.Code, rec.Body.String())
+	}
+
+	req = httptest.NewRequest("GET", "/api/v1/stop/vm1", nil)
+	if err := signRequest(req, nil, signer, cid, "nonce0001"); err != nil {
+		t.Fatal(err)
+	}
+	if rec := do(req); rec.Code != http.StatusOK {
+		t.Errorf("signed: %d %s", rec.Code, rec.Body.String())
+	}
+
+	// keyid may be the SHA256 tenant id
+	req = httptest.NewRequest("GET", "/api/v1/stop/vm1", nil)
+	signRequest(req, nil, signer, ssh.FingerprintSHA256(signer.PublicKey()), "nonce0005")
+	if rec := do(req); rec.Code != http.StatusOK {
+		t.Errorf("fingerprint keyid: %d %s", rec.Code, rec.Body.String())
+	}
+
+	// same nonce again
+	replay := httptest.NewRequest("GET", "/api/v1/stop/vm1", nil)
+	replay.Header = req.Header.Clone()
+	if rec := do(replay); rec.Code != http.StatusUnauthorized {
+		t.Errorf("replay: %d %s", rec.Code, rec.Body.String())
+	}
+
+	// signed by another key
+	req = httptest.NewRequest("GET", "/api/v1/stop/vm1", nil)
+	signRequest(req, nil, other, cid, "nonce0002")
+	if rec := do(req); rec.Code != http.StatusUnauthorized {
+		t.Errorf("other key: %d %s", rec.Code, rec.Body.String())
+	}
+
+	// path is signed
+	req = httptest.NewRequest("GET", "/api/v1/stop/vm1", nil)
+	signRequest(req, nil, signer, cid, "nonce0003")
+	req.URL.Path = "/api/v1/destroy/vm1"
+	req.RequestURI = ""
+	if rec := do(req); rec.Code != http.StatusUnauthorized {
+		t.Errorf("altered path: %d %s", rec.Code, rec.Body.String())
+	}
+
+	// stale Date
+	req = httptest.NewRequest("GET", "/api/v1/stop/vm1", nil)
+	signRequest(req, nil, signer, cid, "nonce0004")
+	req.Header.Set("Date", time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat))
+	if rec := do(req); rec.Code != http.StatusUnauthorized {
+		t.Errorf("stale date: %d %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestSignedCreate(t *testing.T) {
+	setupInstances(t, 0)
+	*authMode = authSignature
+	t.Cleanup(func() { *authMode = authCid })
+	broker = newMemoryBroker(MemoryConfig{})
+
+	signer, _, pubkey := newTestTenant(t)
+	other, _, _ := newTestTenant(t)
+	router := newRouter(&MyFeeds{f: &Feed{}})
+
+	body := fmt.Sprintf(`{"image":"debian12","imgsize":"10g","cpus":1,"pubkey":"%s"}`, pubkey)
+
+	for _, tt := range []struct {
+		name   string
+		signer ssh.Signer
+		body   string
+		code   int
+	}{
+		{"unsigned", nil, body, http.StatusUnauthorized},
+		{"other key", other, body, http.StatusUnauthorized},
+		{"altered body", signer, strings.Replace(body, `"cpus":1`, `"cpus":2`, 1), http.StatusUnauthorized},
+	} {
+		req := httptest.NewRequest("POST", "/api/v1/create/vm2", strings.NewReader(tt.body))
+		if tt.signer != nil {
+			signRequest(req, []byte(body), tt.signer, "", "nonce-"+strings.ReplaceAll(tt.name, " ", "-"))
+		}
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		if rec.Code != tt.code {
+			t.Errorf("%s: %d %s", tt.name, rec.Code, rec.Body.String())
+		}
+	}
+
+	list, _ := store.ListInstances("")
+	for _, inst := range list {
+		if inst.Id == "vm2" {
+			t.Errorf("vm2 created by unauthenticated request")
+		}
+	}
+}
+
+// examples of create reply must pass the auth mode of the server
+func TestCurlHint(t *testing.T) {
+	saved := server_url
+	server_url = "http://127.0.0.1:65531"
+	t.Cleanup(func() { server_url = saved; *authMode = authCid })
+
+	for _, tt := range []struct {
+		mode string
+		want string
+	}{
+		{authCid, `curl -H cid:` + testCid + ` http://127.0.0.1:65531/api/v1/status/vm1`},
+		{authAny, `curl -H cid:` + testCid + ` http://127.0.0.1:65531/api/v1/status/vm1`},
+		{authSignature, `curl -H 'Date: DATE' -H 'Authorization: CBSD-SSH keyid="` + testCid + `",nonce="NONCE",signature="SIGNATURE"' http://127.0.0.1:65531/api/v1/status/vm1`},
+	} {
+		*authMode = tt.mode
+		var got string
+		if err := json.Unmarshal([]byte(curlHint(testCid, "/api/v1/status/vm1")), &got); err != nil {
+			t.Fatalf("%s: %v", tt.mode, err)
+		}
+		if got != tt.want {
+			t.Errorf("%s: %s", tt.mode, got)
+		}
+	}
+}
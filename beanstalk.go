@@ -1,15 +1,25 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
+	"errors"
 	"fmt"
 	"log"
-	"strings"
 	"time"
 
 	"github.com/beanstalkd/go-beanstalk"
 )
 
+// connection pool defaults
+const (
+	defaultPoolSize       = 4
+	defaultPublishRetries = 3
+	beanstalkDialTimeout  = 5 * time.Second
+	beanstalkHealthIdle   = 10 * time.Second // idle connection is checked before use
+	beanstalkBackoffMin   = 100 * time.Millisecond
+	beanstalkBackoffMax   = 2 * time.Second
+)
+
 // beanstalk config struct
 type BeanstalkConfig struct {
 	Uri              string `json:"uri"`
@@ -18,82 +28,203 @@ type BeanstalkConfig struct {
 	ReconnectTimeout int    `json:"reconnect_timeout"`
 	ReserveTimeout   int    `json:"reserve_timeout"`
 	PublishTimeout   int    `json:"publish_timeout"`
+	PoolSize         int    `json:"pool_size"`
+	PublishRetries   int    `json:"publish_retries"`
 }
 
-func beanstalkSend(config BeanstalkConfig, body string) (string, error) {
+// beanstalk replies, the connection is still usable after them
+var beanstalkServerErrors = []error{
+	beanstalk.ErrBadFormat, beanstalk.ErrBuried, beanstalk.ErrDeadline,
+	beanstalk.ErrDraining, beanstalk.ErrInternal, beanstalk.ErrJobTooBig,
+	beanstalk.ErrNoCRLF, beanstalk.ErrNotFound, beanstalk.ErrNotIgnored,
+	beanstalk.ErrOOM, beanstalk.ErrTimeout, beanstalk.ErrUnknown,
+}
 
-	amqpURI := config.Uri
-	tube := config.Tube
+// pooledConn is an idle connection, used is the time it was returned to the pool
+type pooledConn struct {
+	*beanstalk.Conn
+	used time.Time
+}
 
-	fmt.Printf("Calling beanstalkd: %s\n", amqpURI)
-	fmt.Printf("Tube selected: %s\n", tube)
-	fmt.Printf("Reply Tube prefix: %s\n", config.ReplyTubePrefix)
+// beanstalkd Broker implementation: connections are kept in the pool of
+// pool_size idle ones and reused by Publish and Await. go-beanstalk Conn
+// issues use/watch for each command, so any connection serves any tube.
+type beanstalkBroker struct {
+	config BeanstalkConfig
+	idle   chan *pooledConn
+}
 
-	c, err := beanstalk.Dial("tcp", amqpURI)
+func newBeanstalkBroker(config BeanstalkConfig) *beanstalkBroker {
+	size := config.PoolSize
+	if size <= 0 {
+		size = defaultPoolSize
+	}
+	if config.PublishRetries <= 0 {
+		config.PublishRetries = defaultPublishRetries
+	}
+	return &beanstalkBroker{config: config, idle: make(chan *pooledConn, size)}
+}
 
-	if err != nil {
-		log.Printf("Unable connect to beanstalkd broker:%s", err)
-		return "", err
+// serverError is true when err is the beanstalkd reply, not a network failure
+func serverError(err error) bool {
+	var connErr beanstalk.ConnError
+	if !errors.As(err, &connErr) {
+		return false
+	}
+	for _, e := range beanstalkServerErrors {
+		if errors.Is(connErr.Err, e) {
+			return true
+		}
 	}
+	return false
+}
 
-	mytube := &beanstalk.Tube{Conn: c, Name: tube}
-	id, err := mytube.Put([]byte(body), 1, 0, time.Duration(config.PublishTimeout)*time.Second)
+// dial connects to beanstalkd, retrying with exponential backoff
+// for up to reconnect_timeout seconds or until ctx is done
+func (b *beanstalkBroker) dial(ctx context.Context) (*beanstalk.Conn, error) {
+	deadline := time.Now().Add(time.Duration(b.config.ReconnectTimeout) * time.Second)
+	backoff := beanstalkBackoffMin
 
-	if err != nil {
-		fmt.Printf("\nerr: %d\n", err)
-		return "", err
+	for {
+		c, err := beanstalk.DialTimeout("tcp", b.config.Uri, beanstalkDialTimeout)
+		if err == nil {
+			return c, nil
+		}
+		if time.Now().Add(backoff).After(deadline) {
+			log.Printf("Unable connect to beanstalkd broker:%s", err)
+			return nil, err
+		}
+
+		fmt.Printf("beanstalkd %s: %s, reconnect in %s\n", b.config.Uri, err.Error(), backoff)
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > beanstalkBackoffMax {
+			backoff = beanstalkBackoffMax
+		}
+	}
+}
+
+// get returns idle connection from the pool or the new one. Connection
+// idle for longer than beanstalkHealthIdle is checked by stats command.
+func (b *beanstalkBroker) get(ctx context.Context) (*pooledConn, error) {
+	for {
+		select {
+		case pc := <-b.idle:
+			if time.Since(pc.used) < beanstalkHealthIdle {
+				return pc, nil
+			}
+			if _, err := pc.Stats(); err == nil {
+				return pc, nil
+			}
+			pc.Close()
+		default:
+			c, err := b.dial(ctx)
+			if err != nil {
+				return nil, err
+			}
+			return &pooledConn{Conn: c}, nil
+		}
 	}
+}
 
-	callbackQueueName := fmt.Sprintf("%s%d", config.ReplyTubePrefix, id)
-	fmt.Printf("got id: %d,callback queue name: %s\n", id, callbackQueueName)
+// put returns healthy connection to the pool, extra ones are closed
+func (b *beanstalkBroker) put(pc *pooledConn) {
+	pc.used = time.Now()
+	select {
+	case b.idle <- pc:
+	default:
+		pc.Close()
+	}
+}
 
-	c1 := make(chan string)
+// release returns pc to the pool or closes it when err is a network failure
+func (b *beanstalkBroker) release(pc *pooledConn, err error) {
+	if err == nil || serverError(err) {
+		b.put(pc)
+		return
+	}
+	pc.Close()
+	// the rest of idle connections most likely lost the broker too
+	b.flush()
+}
 
-	go func() {
+// flush closes all idle connections
+func (b *beanstalkBroker) flush() {
+	for {
+		select {
+		case pc := <-b.idle:
+			pc.Close()
+		default:
+			return
+		}
+	}
+}
 
-		// todo: global timeout
-		for {
-			c.TubeSet = *beanstalk.NewTubeSet(c, callbackQueueName)
-			id, body, err := c.Reserve(time.Duration(config.ReserveTimeout) * time.Second)
+// Publish puts body into tube, network failures are retried up to
+// publish_retries times on a new connection
+func (b *beanstalkBroker) Publish(ctx context.Context, tube string, body []byte) (uint64, error) {
+	var err error
 
-			if err != nil {
-				fmt.Printf("\nid: %d, res: %s\n", id, err.Error())
-			}
+	for attempt := 0; attempt <= b.config.PublishRetries && ctx.Err() == nil; attempt++ {
+		if attempt > 0 {
+			fmt.Printf("beanstalkd: publish into %s failed: %s, retry %d/%d\n", tube, err.Error(), attempt, b.config.PublishRetries)
+		}
 
-			if id == 0 {
-				return // timeout
-				//				continue
-			}
+		var pc *pooledConn
+		pc, err = b.get(ctx)
+		if err != nil {
+			continue
+		}
 
-			cbsdTask := CbsdTask{}
-			err = json.Unmarshal(body, &cbsdTask)
-			if err != nil {
-				log.Printf("json decode error %s", err.Error())
-				c.Delete(id)
-				return
-			}
+		mytube := &beanstalk.Tube{Conn: pc.Conn, Name: tube}
+		var id uint64
+		id, err = mytube.Put(body, 1, 0, time.Duration(b.config.PublishTimeout)*time.Second)
+		b.release(pc, err)
 
-			if cbsdTask.Progress == 100 {
-				c1 <- cbsdTask.Message
-			}
-			c.Delete(id)
+		if err == nil {
+			return id, nil
+		}
+		if serverError(err) {
+			// broker refused the job, retry won't help
+			break
 		}
-	}()
+	}
 
-	select {
-	case msg1 := <-c1:
-		if strings.Compare(msg1, "EOF") == 0 {
-			fmt.Printf("EXIT\n")
-			c.Close()
-			return "", err
-		} else {
-			fmt.Println("received:", msg1)
-			fmt.Printf("EXIT\n")
-			c.Close()
-			return msg1, err
+	if err == nil {
+		err = ctx.Err()
+	}
+	fmt.Printf("\nerr: %s\n", err)
+	return 0, err
+}
+
+// Await reserves with timeout, ctx is checked before reserve only: the
+// caller bounds timeout by the ctx deadline
+func (b *beanstalkBroker) Await(ctx context.Context, tube string, timeout time.Duration) ([]byte, error) {
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	pc, err := b.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	ts := beanstalk.NewTubeSet(pc.Conn, tube)
+	id, body, err := ts.Reserve(timeout)
+	if err != nil {
+		b.release(pc, err)
+		if errors.Is(err, beanstalk.ErrTimeout) {
+			return nil, ErrBrokerTimeout
 		}
+		return nil, err
 	}
 
-	c.Close()
-	return "", err
+	err = pc.Delete(id)
+	b.release(pc, err)
+	return body, nil
 }
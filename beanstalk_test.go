@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeBeanstalkd speaks the part of beanstalkd protocol used by
+// beanstalkBroker, tubes survive restart
+type fakeBeanstalkd struct {
+	t    *testing.T
+	addr string
+
+	mu       sync.Mutex
+	ln       net.Listener
+	conns    []net.Conn
+	accepted int
+	lastId   uint64
+	tubes    map[string][][]byte
+}
+
+func newFakeBeanstalkd(t *testing.T) *fakeBeanstalkd {
+	t.Helper()
+
+	f := &fakeBeanstalkd{t: t, addr: "127.0.0.1:0", tubes: make(map[string][][]byte)}
+	f.start()
+	t.Cleanup(f.stop)
+	return f
+}
+
+func (f *fakeBeanstalkd) start() {
+	ln, err := net.Listen("tcp", f.addr)
+	if err != nil {
+		// also called by restart goroutine
+		f.t.Error(err)
+		return
+	}
+
+	f.mu.Lock()
+	f.ln = ln
+	f.addr = ln.Addr().String()
+	f.mu.Unlock()
+
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			f.mu.Lock()
+			f.conns = append(f.conns, c)
+			f.accepted++
+			f.mu.Unlock()
+			go f.serve(c)
+		}
+	}()
+}
+
+// stop closes listener and all client connections
+func (f *fakeBeanstalkd) stop() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.ln != nil {
+		f.ln.Close()
+		f.ln = nil
+	}
+	for _, c := range f.conns {
+		c.Close()
+	}
+	f.conns = nil
+}
+
+func (f *fakeBeanstalkd) pop(watched map[string]bool) (uint64, []byte, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for tube := range watched {
+		if jobs := f.tubes[tube]; len(jobs) > 0 {
+			f.lastId++
+			f.tubes[tube] = jobs[1:]
+			return f.lastId, jobs[0], true
+		}
+	}
+	return 0, nil, false
+}
+
+func (f *fakeBeanstalkd) serve(c net.Conn) {
+	defer c.Close()
+
+	r := bufio.NewReader(c)
+	used := "default"
+	watched := map[string]bool{"default": true}
+
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		args := strings.Fields(line)
+		if len(args) == 0 {
+			continue
+		}
+
+		var reply string
+		switch args[0] {
+		case "use":
+			used = args[1]
+			reply = "USING " + used
+		case "watch":
+			watched[args[1]] = true
+			reply = fmt.Sprintf("WATCHING %d", len(watched))
+		case "ignore":
+			delete(watched, args[1])
+			reply = fmt.Sprintf("WATCHING %d", len(watched))
+		case "put":
+			size, _ := strconv.Atoi(args[4])
+			body := make([]byte, size+2)
+			if _, err := io.ReadFull(r, body); err != nil {
+				return
+			}
+			f.mu.Lock()
+			f.lastId++
+			f.tubes[used] = append(f.tubes[used], body[:size])
+			reply = fmt.Sprintf("INSERTED %d", f.lastId)
+			f.mu.Unlock()
+		case "reserve-with-timeout":
+			timeout, _ := strconv.Atoi(args[1])
+			deadline := time.Now().Add(time.Duration(timeout) * time.Second)
+			reply = "TIMED_OUT"
+			for {
+				if id, body, ok := f.pop(watched); ok {
+					reply = fmt.Sprintf("RESERVED %d %d\r\n%s", id, len(body), body)
+					break
+				}
+				if time.Now().After(deadline) {
+					break
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+		case "delete":
+			reply = "DELETED"
+		case "stats":
+			stats := "---\ncurrent-connections: 1\n"
+			reply = fmt.Sprintf("OK %d\r\n%s", len(stats), stats)
+		default:
+			reply = "UNKNOWN_COMMAND"
+		}
+
+		if _, err := c.Write([]byte(reply + "\r\n")); err != nil {
+			return
+		}
+	}
+}
+
+func (f *fakeBeanstalkd) connections() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.accepted
+}
+
+func TestBeanstalkPool(t *testing.T) {
+	server := newFakeBeanstalkd(t)
+	b := newBeanstalkBroker(BeanstalkConfig{Uri: server.addr, PublishTimeout: 5})
+
+	for i := 0; i < 10; i++ {
+		if _, err := b.Publish(context.Background(), "cbsd_node1", []byte(fmt.Sprintf("cmd%d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 10; i++ {
+		body, err := b.Await(context.Background(), "cbsd_node1", time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(body) != fmt.Sprintf("cmd%d", i) {
+			t.Errorf("got %s", body)
+		}
+	}
+	if _, err := b.Await(context.Background(), "cbsd_node1", 0); err != ErrBrokerTimeout {
+		t.Errorf("empty tube: %v", err)
+	}
+
+	// sequential commands share single connection, timeout keeps it
+	if n := server.connections(); n != 1 {
+		t.Errorf("connections: %d", n)
+	}
+}
+
+// commands published while the broker restarts are retried, not lost
+func TestBeanstalkReconnect(t *testing.T) {
+	server := newFakeBeanstalkd(t)
+	b := newBeanstalkBroker(BeanstalkConfig{Uri: server.addr, PublishTimeout: 5, ReconnectTimeout: 5})
+
+	if _, err := b.Publish(context.Background(), "cbsd_node1", []byte("before")); err != nil {
+		t.Fatal(err)
+	}
+
+	server.stop()
+	go func() {
+		time.Sleep(300 * time.Millisecond)
+		server.start()
+	}()
+
+	if _, err := b.Publish(context.Background(), "cbsd_node1", []byte("after")); err != nil {
+		t.Fatalf("publish during restart: %v", err)
+	}
+
+	for _, want := range []string{"before", "after"} {
+		body, err := b.Await(context.Background(), "cbsd_node1", time.Second)
+		if err != nil || string(body) != want {
+			t.Errorf("want %s, got %s %v", want, body, err)
+		}
+	}
+}
+
+func TestBeanstalkUnavailable(t *testing.T) {
+	server := newFakeBeanstalkd(t)
+	server.stop()
+
+	b := newBeanstalkBroker(BeanstalkConfig{Uri: server.addr, ReconnectTimeout: 0, PublishRetries: 1})
+
+	start := time.Now()
+	if _, err := b.Publish(context.Background(), "cbsd_node1", []byte("cmd")); err == nil {
+		t.Fatal("published without broker")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("gave up after %s", elapsed)
+	}
+}
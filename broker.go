@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// ErrBrokerTimeout returned by Broker.Await when no message arrived in time
+var ErrBrokerTimeout = errors.New("broker: timeout")
+
+// Broker is the message queue between API and cbsd-mq-router nodes:
+// commands are published into the node tube, CbsdTask replies are
+// read back from the per-job reply tube <reply_tube_prefix><id>.
+type Broker interface {
+	// Publish puts body into tube and returns the job id assigned by broker,
+	// reconnect and retries stop when ctx is done
+	Publish(ctx context.Context, tube string, body []byte) (uint64, error)
+	// Await waits up to timeout for the next message in tube and removes it,
+	// returns ctx.Err() when ctx is done first
+	Await(ctx context.Context, tube string, timeout time.Duration) ([]byte, error)
+}
+
+// Dispatch is a single command for the hoster node. Target tube and reply
+// tube prefix travel with the command instead of the global config, so
+// concurrent requests to different nodes never share routing state.
+type Dispatch struct {
+	Tube            string
+	ReplyTubePrefix string
+	Body            string
+}
+
+// nodeTubes returns tube and reply tube prefix of cbsd-mq-router on node, e.g:
+// srv-03.olevole.ru -> cbsd_srv_03_olevole_ru, cbsd_srv_03_olevole_ru_result_id
+func nodeTubes(node string) (string, string) {
+	result := strings.TrimSpace(node)
+	result = strings.Replace(result, ".", "_", -1)
+	result = strings.Replace(result, "-", "_", -1)
+
+	return fmt.Sprintf("cbsd_%s", result), fmt.Sprintf("cbsd_%s_result_id", result)
+}
+
+// newBroker returns Broker selected by "broker" config key
+func newBroker(config Config) (Broker, error) {
+	switch config.Broker {
+	case "", "beanstalkd":
+		return newBeanstalkBroker(config.BeanstalkConfig), nil
+	case "memory":
+		return newMemoryBroker(config.MemoryConfig), nil
+	default:
+		return nil, fmt.Errorf("unknown broker: %s", config.Broker)
+	}
+}
+
+// brokerAwait reads CbsdTask messages from replyTube until the final one
+// ( Progress == 100 ), each message is passed to update. Reply is awaited
+// reserveTimeout seconds at once until ctx is done.
+func brokerAwait(ctx context.Context, b Broker, replyTube string, reserveTimeout int, update func(CbsdTask)) (CbsdTask, error) {
+
+	for {
+		if err := ctx.Err(); err != nil {
+			fmt.Printf("%s: res: %s\n", replyTube, err.Error())
+			return CbsdTask{}, err
+		}
+
+		timeout := time.Duration(reserveTimeout) * time.Second
+		if timeout <= 0 {
+			timeout = time.Second
+		}
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < timeout {
+			timeout = time.Until(deadline)
+		}
+
+		reply, err := b.Await(ctx, replyTube, timeout)
+		if errors.Is(err, ErrBrokerTimeout) {
+			continue
+		}
+		if err != nil {
+			fmt.Printf("%s: res: %s\n", replyTube, err.Error())
+			return CbsdTask{}, err
+		}
+
+		cbsdTask := CbsdTask{}
+		err = json.Unmarshal(reply, &cbsdTask)
+		if err != nil {
+			log.Printf("json decode error %s", err.Error())
+			return CbsdTask{}, err
+		}
+
+		update(cbsdTask)
+
+		if cbsdTask.Progress == 100 {
+			fmt.Printf("%s received: %s\n", replyTube, cbsdTask.Message)
+			return cbsdTask, nil
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// max messages per tube in memory broker
+const memoryTubeSize = 1024
+
+// in-process broker config ( "broker": "memory" )
+type MemoryConfig struct {
+	FakeNode  bool `json:"fake_node"`  // reply to every published command as cbsd-mq-router would
+	StepDelay int  `json:"step_delay"` // delay between fake node CbsdTask replies, in milliseconds
+}
+
+type memoryJob struct {
+	id   uint64
+	body []byte
+}
+
+// memoryBroker is an in-process stand-in for beanstalkd: no persistence,
+// tubes are created on first use
+type memoryBroker struct {
+	mu     sync.Mutex
+	lastId uint64
+	tubes  map[string]chan memoryJob
+	config MemoryConfig
+}
+
+func newMemoryBroker(config MemoryConfig) *memoryBroker {
+	fmt.Printf("* In-memory broker, fake node: %t\n", config.FakeNode)
+	return &memoryBroker{tubes: make(map[string]chan memoryJob), config: config}
+}
+
+func (m *memoryBroker) tube(name string) chan memoryJob {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	ch, ok := m.tubes[name]
+	if !ok {
+		ch = make(chan memoryJob, memoryTubeSize)
+		m.tubes[name] = ch
+	}
+	return ch
+}
+
+func (m *memoryBroker) Publish(ctx context.Context, tube string, body []byte) (uint64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	m.mu.Lock()
+	m.lastId++
+	id := m.lastId
+	m.mu.Unlock()
+
+	select {
+	case m.tube(tube) <- memoryJob{id: id, body: body}:
+	default:
+		return 0, fmt.Errorf("memory broker: tube %s is full", tube)
+	}
+
+	if m.config.FakeNode {
+		go m.fakeNode(tube)
+	}
+
+	return id, nil
+}
+
+func (m *memoryBroker) Await(ctx context.Context, tube string, timeout time.Duration) ([]byte, error) {
+	ch := m.tube(tube)
+
+	// already queued message wins over zero timeout
+	select {
+	case job := <-ch:
+		return job.body, nil
+	default:
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case job := <-ch:
+		return job.body, nil
+	case <-timer.C:
+		return nil, ErrBrokerTimeout
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// fakeNode takes one command from tube and answers like cbsd-mq-router does:
+// intermediate CbsdTask progress followed by the final one ( Progress == 100 ).
+// Reply tube follows the cbsd_<node>/cbsd_<node>_result_id<id> naming.
+func (m *memoryBroker) fakeNode(tube string) {
+	job := <-m.tube(tube)
+
+	comment, err := protocol.Decode(job.body)
+	if err != nil {
+		fmt.Printf("fake node %s: decode error %s\n", tube, err.Error())
+		return
+	}
+
+	replyTube := fmt.Sprintf("%s_result_id%d", tube, job.id)
+	mode := comment.CommandArgs["mode"]
+
+	for _, progress := range []int{0, 50, 100} {
+		time.Sleep(time.Duration(m.config.StepDelay) * time.Millisecond)
+
+		task := CbsdTask{Progress: progress, Message: fmt.Sprintf("%s %s: %d%%", comment.Command, mode, progress)}
+		body, _ := json.Marshal(task)
+		m.tube(replyTube) <- memoryJob{id: job.id, body: body}
+	}
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const testCid = "0123456789abcdef0123456789abcdef"
+
+// setupInstances creates legacy map, vm-<id> and .node files of n instances
+// vm<i>/env<i>, each one placed on its own node<i>.example.org, and imports
+// them into the store
+func setupInstances(t *testing.T, n int) {
+	t.Helper()
+
+	root := t.TempDir()
+	workdir = root
+	*dbDir = filepath.Join(root, "db")
+
+	script := filepath.Join(root, "recomendation.sh")
+	dirs := []string{
+		filepath.Join(workdir, "var/db/api/map"),
+		filepath.Join(*dbDir, testCid, "vms"),
+	}
+	for _, dir := range dirs {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(script, []byte("#!/bin/sh\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	config.Recomendation = script
+	// requests below use the legacy cid header
+	*authMode = authCid
+
+	for i := 0; i < n; i++ {
+		files := map[string]string{
+			filepath.Join(workdir, "var/db/api/map", fmt.Sprintf("%s-vm%d", testCid, i)): fmt.Sprintf("env%d", i),
+			filepath.Join(*dbDir, testCid, fmt.Sprintf("vm-vm%d", i)):                    fmt.Sprintf("env%d", i),
+			filepath.Join(*dbDir, testCid, fmt.Sprintf("env%d.node", i)):                 fmt.Sprintf("node%d.example.org\n", i),
+		}
+		for path, data := range files {
+			if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	// legacy files are imported on the first open
+	var err error
+	store, err = openStore(filepath.Join(root, "cbsd-mq-api.db"), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// job watchers started by the test are stopped before the next one
+	// replaces broker and store
+	jobContext, cancelJobs = context.WithCancel(context.Background())
+	t.Cleanup(func() {
+		cancelJobs()
+		done := make(chan struct{})
+		time.AfterFunc(5*time.Second, func() { close(done) })
+		if !waitJobs(done) {
+			t.Errorf("job watchers still running: %d", atomic.LoadInt64(&jobsCount))
+		}
+		store.Close()
+	})
+}
+
+func TestNodeTubes(t *testing.T) {
+	tube, reply := nodeTubes("srv-03.olevole.ru\n")
+
+	if tube != "cbsd_srv_03_olevole_ru" {
+		t.Errorf("tube: %s", tube)
+	}
+	if reply != "cbsd_srv_03_olevole_ru_result_id" {
+		t.Errorf("reply tube prefix: %s", reply)
+	}
+}
+
+// concurrent start/stop requests to instances on different nodes must be
+// published into the tube of their own node
+func TestConcurrentDispatchRouting(t *testing.T) {
+	const n = 16
+
+	setupInstances(t, n)
+	mb := newMemoryBroker(MemoryConfig{})
+	broker = mb
+
+	router := newRouter(&MyFeeds{f: &Feed{}})
+
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		for _, mode := range []string{"start", "stop"} {
+			wg.Add(1)
+			go func(i int, mode string) {
+				defer wg.Done()
+
+				req := httptest.NewRequest("GET", fmt.Sprintf("/api/v1/%s/vm%d", mode, i), nil)
+				req.Header.Set("cid", testCid)
+				rec := httptest.NewRecorder()
+				router.ServeHTTP(rec, req)
+
+				if rec.Code != http.StatusOK {
+					t.Errorf("%s vm%d: %d %s", mode, i, rec.Code, rec.Body.String())
+				}
+			}(i, mode)
+		}
+	}
+	wg.Wait()
+
+	for i := 0; i < n; i++ {
+		tube, _ := nodeTubes(fmt.Sprintf("node%d.example.org", i))
+
+		modes := map[string]bool{}
+		for len(modes) < 2 {
+			body, err := mb.Await(context.Background(), tube, time.Second)
+			if err != nil {
+				t.Fatalf("%s: %v", tube, err)
+			}
+
+			comment, err := protocol.Decode(body)
+			if err != nil {
+				t.Fatalf("%s: %v: %s", tube, err, body)
+			}
+			if jname := comment.CommandArgs["jname"]; jname != fmt.Sprintf("env%d", i) {
+				t.Errorf("%s: got command for %s", tube, jname)
+			}
+			modes[comment.CommandArgs["mode"]] = true
+		}
+
+		if !modes["start"] || !modes["stop"] {
+			t.Errorf("%s: modes %v", tube, modes)
+		}
+		if body, err := mb.Await(context.Background(), tube, 0); err != ErrBrokerTimeout {
+			t.Errorf("%s: unexpected command %s", tube, body)
+		}
+	}
+}
+
+// setupFreejname makes freejname script print jname
+func setupFreejname(t *testing.T, jname string) {
+	t.Helper()
+
+	script := filepath.Join(t.TempDir(), "freejname.sh")
+	if err := os.WriteFile(script, []byte("#!/bin/sh\necho "+jname+"\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	saved := config.Freejname
+	config.Freejname = script
+	t.Cleanup(func() { config.Freejname = saved })
+}
+
+// awaitJob collects updates of one job from ch up to the final one
+func awaitJob(t *testing.T, ch chan Job) []Job {
+	t.Helper()
+
+	var updates []Job
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case job := <-ch:
+			updates = append(updates, job)
+			if jobFinished(&job) {
+				return updates
+			}
+		case <-timeout:
+			t.Fatalf("no final update: %+v", updates)
+		}
+	}
+}
+
+// create/stop/start/destroy through the handlers, answered by the fake node
+// of memory broker
+func TestFakeNodeFlow(t *testing.T) {
+	setupInstances(t, 0)
+	setupNodes(t, placementSpread, Node{Name: "node9.example.org", Cpus: 8, Ram: "16g"})
+	broker = newMemoryBroker(MemoryConfig{FakeNode: true, StepDelay: 10})
+
+	setupFreejname(t, "env9")
+
+	pubkey := testKeyLine("flow@localhost")
+	key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(pubkey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cid := tenantCid(key, pubkey)
+
+	ch := jobEvents.Subscribe(instanceKey(cid, "vm9"))
+	defer jobEvents.Unsubscribe(instanceKey(cid, "vm9"), ch)
+
+	router := newRouter(&MyFeeds{f: &Feed{}})
+	do := func(method string, path string, body string) {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("cid", cid)
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s %s: %d %s", method, path, rec.Code, rec.Body.String())
+		}
+	}
+	status := func() map[string]interface{} {
+		inst, err := store.GetInstance(cid, "vm9")
+		if err != nil {
+			t.Fatal(err)
+		}
+		m := map[string]interface{}{}
+		json.Unmarshal(inst.Status, &m)
+		return m
+	}
+
+	do("POST", "/api/v1/create/vm9", fmt.Sprintf(`{"image":"debian12","imgsize":"10g","ram":"1g","cpus":1,"pubkey":"%s"}`, pubkey))
+
+	var progress []int
+	var states []string
+	for _, job := range awaitJob(t, ch) {
+		progress = append(progress, job.Progress)
+		states = append(states, job.State)
+	}
+	if fmt.Sprint(progress) != "[0 0 50 100 100]" || fmt.Sprint(states) != "[pending running running running success]" {
+		t.Errorf("create updates: %v %v", progress, states)
+	}
+	if got := status(); got["status"] != StatusRunning || got["progress"] != float64(100) {
+		t.Errorf("created: %v", got)
+	}
+
+	for _, tt := range []struct {
+		mode   string
+		status string
+	}{
+		{"stop", StatusStopped},
+		{"start", StatusRunning},
+	} {
+		do("GET", "/api/v1/"+tt.mode+"/vm9", "")
+		updates := awaitJob(t, ch)
+		last := updates[len(updates)-1]
+		if last.Command != tt.mode || last.State != JobSuccess || last.Progress != 100 {
+			t.Errorf("%s: %+v", tt.mode, last)
+		}
+		if got := status(); got["status"] != tt.status {
+			t.Errorf("%s: %v", tt.mode, got)
+		}
+	}
+
+	do("GET", "/api/v1/destroy/vm9", "")
+	updates := awaitJob(t, ch)
+	if last := updates[len(updates)-1]; last.Command != "destroy" || last.State != JobSuccess {
+		t.Errorf("destroy: %+v", last)
+	}
+	if _, err := store.GetInstance(cid, "vm9"); err == nil {
+		t.Error("destroyed instance is kept")
+	}
+
+	jobs, err := store.ListJobs(cid, "vm9")
+	if err != nil || len(jobs) != 4 {
+		t.Fatalf("jobs: %v %v", jobs, err)
+	}
+	for _, job := range jobs {
+		if job.State != JobSuccess || job.Progress != 100 {
+			t.Errorf("job %d %s: %s %d", job.Id, job.Command, job.State, job.Progress)
+		}
+	}
+}
@@ -17,7 +17,13 @@ type Config struct {
 	Cloud_images_list	string	`json:"cloud_images_list"`
 	Iso_images_list		string	`json:"iso_images_list"`
 	Flavors_list		string	`json:"flavors_list"`
+	Nodes			[]Node	`json:"nodes"`
+	Placement		string	`json:"placement"`
+	PlacementFallback	bool	`json:"placement_fallback"`
+	HeartbeatTube		string	`json:"heartbeat_tube"`
+	HeartbeatTtl		int	`json:"heartbeat_ttl"`
 	BeanstalkConfig			`json:"beanstalkd"`
+	MemoryConfig			`json:"memory"`
 }
 
 func LoadConfiguration(file string) (Config, error) {
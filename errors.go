@@ -0,0 +1,189 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// API versions: 1 is the pre-envelope behaviour ( {"Message": ..} with 405/200
+// for most errors ), kept for old clients during transition
+const (
+	apiVersionLegacy = "1"
+	apiVersionLatest = "2"
+)
+
+var apiVersion = flag.String("api_version", apiVersionLatest, "API version of requests without X-Api-Version header: 1 (legacy errors) or 2")
+
+var regexpRequestId = regexp.MustCompile(`^[a-zA-Z0-9._\-]{1,64}$`)
+
+// ErrorEnvelope is the body of every error reply ( API version 2 )
+type ErrorEnvelope struct {
+	Code      string      `json:"code"`
+	Message   string      `json:"message"`
+	Details   interface{} `json:"details,omitempty"`
+	RequestId string      `json:"request_id"`
+}
+
+// machine-readable code of HTTP status
+var errorCodes = map[int]string{
+	http.StatusBadRequest:          "bad_request",
+	http.StatusUnauthorized:        "unauthorized",
+	http.StatusForbidden:           "forbidden",
+	http.StatusNotFound:            "not_found",
+	http.StatusMethodNotAllowed:    "method_not_allowed",
+	http.StatusConflict:            "already_exists",
+	http.StatusUnprocessableEntity: "invalid_payload",
+	http.StatusTooManyRequests:     "limit_exceeded",
+	http.StatusInternalServerError: "internal_error",
+	http.StatusBadGateway:          "broker_unavailable",
+	http.StatusServiceUnavailable:  "no_capacity",
+	http.StatusGatewayTimeout:      "broker_timeout",
+}
+
+// legacyStatus returns API version 1 status of the error: client errors
+// was 405, missing instance was 200 "not found"
+func legacyStatus(code int) int {
+	switch {
+	case code == http.StatusNotFound:
+		return http.StatusOK
+	case code >= 400 && code < 500:
+		return http.StatusMethodNotAllowed
+	}
+	return code
+}
+
+func isLegacy(w http.ResponseWriter) bool {
+	return w.Header().Get("X-Api-Version") == apiVersionLegacy
+}
+
+func newRequestId() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// apiMiddleware assigns X-Request-Id ( client one when valid ) and negotiates
+// API version by X-Api-Version header, both are set on the response
+func apiMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestId := r.Header.Get("X-Request-Id")
+		if !regexpRequestId.MatchString(requestId) {
+			requestId = newRequestId()
+		}
+		w.Header().Set("X-Request-Id", requestId)
+
+		version := strings.TrimSpace(r.Header.Get("X-Api-Version"))
+		if len(version) == 0 {
+			version = *apiVersion
+		}
+		switch version {
+		case apiVersionLegacy, apiVersionLatest:
+			w.Header().Set("X-Api-Version", version)
+		default:
+			w.Header().Set("X-Api-Version", apiVersionLatest)
+			APIError(w, http.StatusBadRequest, "unsupported X-Api-Version, valid: 1, 2", nil)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// we need overwrite Content-Type here
+// https://stackoverflow.com/questions/59763852/can-you-return-json-in-golang-http-error
+func JSONError(w http.ResponseWriter, message string, code int) {
+	JSONErrorLegacy(w, message, code, legacyStatus(code))
+}
+
+// JSONErrorLegacy is JSONError with explicit API version 1 status
+func JSONErrorLegacy(w http.ResponseWriter, message string, code int, legacyCode int) {
+	// empty reply, not an error
+	if code == http.StatusOK {
+		writeBody(w, code, []byte("{}"))
+		return
+	}
+
+	if !isLegacy(w) {
+		APIError(w, code, message, nil)
+		return
+	}
+
+	if len(message) == 0 {
+		writeBody(w, legacyCode, []byte("{}"))
+		return
+	}
+	js, err := json.Marshal(Response{message})
+	if err != nil {
+		writeBody(w, http.StatusInternalServerError, []byte("{\"Message\":\"Marshal error\"}"))
+		return
+	}
+	writeBody(w, legacyCode, js)
+}
+
+// JSONErrorCode is JSONError with errCode instead of the one of status,
+// for errors sharing status with others. API version 1 has no code.
+func JSONErrorCode(w http.ResponseWriter, message string, code int, errCode string) {
+	if isLegacy(w) {
+		JSONError(w, message, code)
+		return
+	}
+	writeError(w, code, errCode, message, nil)
+}
+
+// APIError sends ErrorEnvelope
+func APIError(w http.ResponseWriter, code int, message string, details interface{}) {
+	errCode, ok := errorCodes[code]
+	if !ok {
+		errCode = strings.ToLower(strings.ReplaceAll(http.StatusText(code), " ", "_"))
+	}
+	writeError(w, code, errCode, message, details)
+}
+
+func writeError(w http.ResponseWriter, code int, errCode string, message string, details interface{}) {
+	if len(message) == 0 {
+		message = http.StatusText(code)
+	}
+
+	js, err := json.Marshal(ErrorEnvelope{Code: errCode, Message: message, Details: details, RequestId: w.Header().Get("X-Request-Id")})
+	if err != nil {
+		writeBody(w, http.StatusInternalServerError, []byte("{\"code\":\"internal_error\",\"message\":\"Marshal error\"}"))
+		return
+	}
+	writeBody(w, code, js)
+}
+
+func writeBody(w http.ResponseWriter, code int, body []byte) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(code)
+	w.Write(body)
+}
+
+// brokerStatus of failed dispatch: 504 on timeout, 502 otherwise
+func brokerStatus(err error) int {
+	var netErr net.Error
+	if errors.Is(err, ErrBrokerTimeout) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusBadGateway
+}
+
+// replies of unknown route and method, as the rest of errors
+func notFoundHandler() http.Handler {
+	return apiMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		JSONErrorLegacy(w, "no such endpoint", http.StatusNotFound, http.StatusNotFound)
+	}))
+}
+
+func methodNotAllowedHandler() http.Handler {
+	return apiMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		JSONError(w, "method not allowed", http.StatusMethodNotAllowed)
+	}))
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestErrorEnvelope(t *testing.T) {
+	setupInstances(t, 1)
+	router := newRouter(&MyFeeds{f: &Feed{}})
+
+	tests := []struct {
+		name    string
+		path    string
+		cid     string
+		version string
+		code    int
+		errCode string
+		message string
+	}{
+		{"missing instance", "/api/v1/status/nope", testCid, "", http.StatusNotFound, "not_found", "not found"},
+		{"bad cid", "/api/v1/status/vm0", "x", "", http.StatusUnauthorized, "unauthorized", ""},
+		{"bad id", "/api/v1/status/BAD", testCid, "2", http.StatusBadRequest, "bad_request", ""},
+		{"unknown route", "/api/v1/nope", testCid, "", http.StatusNotFound, "not_found", "no such endpoint"},
+		{"wrong method", "/api/v1/create/vm1", testCid, "", http.StatusMethodNotAllowed, "method_not_allowed", ""},
+		{"unsupported version", "/api/v1/status/vm0", testCid, "3", http.StatusBadRequest, "bad_request", ""},
+		{"legacy missing instance", "/api/v1/status/nope", testCid, "1", http.StatusOK, "", "not found"},
+		{"legacy bad cid", "/api/v1/status/vm0", "x", "1", http.StatusMethodNotAllowed, "", ""},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", tt.path, nil)
+		req.Header.Set("cid", tt.cid)
+		req.Header.Set("X-Request-Id", "req-"+tt.version)
+		if len(tt.version) > 0 {
+			req.Header.Set("X-Api-Version", tt.version)
+		}
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+
+		if rec.Code != tt.code {
+			t.Errorf("%s: code %d, want %d: %s", tt.name, rec.Code, tt.code, rec.Body.String())
+			continue
+		}
+
+		if len(tt.errCode) == 0 {
+			// legacy {"Message": ..}
+			var reply Response
+			if err := json.Unmarshal(rec.Body.Bytes(), &reply); err != nil || len(reply.Message) == 0 {
+				t.Errorf("%s: legacy body: %s", tt.name, rec.Body.String())
+			}
+			if len(tt.message) > 0 && reply.Message != tt.message {
+				t.Errorf("%s: message %q, want %q", tt.name, reply.Message, tt.message)
+			}
+			continue
+		}
+
+		var reply ErrorEnvelope
+		if err := json.Unmarshal(rec.Body.Bytes(), &reply); err != nil {
+			t.Errorf("%s: %s: %s", tt.name, err, rec.Body.String())
+			continue
+		}
+		if reply.Code != tt.errCode {
+			t.Errorf("%s: code %q, want %q", tt.name, reply.Code, tt.errCode)
+		}
+		if len(tt.message) > 0 && reply.Message != tt.message {
+			t.Errorf("%s: message %q, want %q", tt.name, reply.Message, tt.message)
+		}
+		if reply.RequestId != "req-"+tt.version || rec.Header().Get("X-Request-Id") != reply.RequestId {
+			t.Errorf("%s: request_id %q", tt.name, reply.RequestId)
+		}
+	}
+}
+
+// quota and queue limit are both 429, told apart by code
+func TestErrorCode(t *testing.T) {
+	rec := httptest.NewRecorder()
+	JSONErrorCode(rec, "quota exceeded: cpus", http.StatusTooManyRequests, errCodeQuota)
+	var reply ErrorEnvelope
+	if err := json.Unmarshal(rec.Body.Bytes(), &reply); err != nil || rec.Code != http.StatusTooManyRequests || reply.Code != "quota_exceeded" {
+		t.Errorf("quota: %d %s", rec.Code, rec.Body.String())
+	}
+
+	rec = httptest.NewRecorder()
+	rec.Header().Set("X-Api-Version", apiVersionLegacy)
+	JSONErrorCode(rec, "quota exceeded: cpus", http.StatusTooManyRequests, errCodeQuota)
+	var legacy Response
+	if err := json.Unmarshal(rec.Body.Bytes(), &legacy); err != nil || rec.Code != http.StatusMethodNotAllowed || legacy.Message != "quota exceeded: cpus" {
+		t.Errorf("legacy quota: %d %s", rec.Code, rec.Body.String())
+	}
+}
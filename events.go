@@ -0,0 +1,224 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// SSE keepalive comment interval
+const eventsKeepAlive = 15 * time.Second
+
+// jobHub fan-out job updates to SSE subscribers, by job id or by instance
+type jobHub struct {
+	mu   sync.Mutex
+	subs map[string]map[chan Job]bool
+}
+
+var jobEvents = &jobHub{subs: make(map[string]map[chan Job]bool)}
+
+func jobKey(id uint64) string {
+	return fmt.Sprintf("job/%d", id)
+}
+
+func instanceKey(cid string, instance string) string {
+	return fmt.Sprintf("instance/%s/%s", cid, instance)
+}
+
+func (h *jobHub) Subscribe(key string) chan Job {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	ch := make(chan Job, 16)
+	if h.subs[key] == nil {
+		h.subs[key] = make(map[chan Job]bool)
+	}
+	h.subs[key][ch] = true
+	return ch
+}
+
+func (h *jobHub) Unsubscribe(key string, ch chan Job) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	delete(h.subs[key], ch)
+	if len(h.subs[key]) == 0 {
+		delete(h.subs, key)
+	}
+}
+
+// Publish never blocks: slow subscriber loses intermediate updates
+func (h *jobHub) Publish(job Job) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for _, key := range []string{jobKey(job.Id), instanceKey(job.Cid, job.Instance)} {
+		for ch := range h.subs[key] {
+			select {
+			case ch <- job:
+			default:
+			}
+		}
+	}
+}
+
+func jobFinished(job *Job) bool {
+	return job.State == JobSuccess || job.State == JobFailed || job.State == JobTimedOut
+}
+
+// writeEvent sends job as SSE event: "progress" or "done" for finished job
+func writeEvent(w http.ResponseWriter, job *Job) error {
+	event := "progress"
+	if jobFinished(job) {
+		event = "done"
+	}
+
+	js, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, js)
+	w.(http.Flusher).Flush()
+	return err
+}
+
+// streamEvents writes updates from ch until client gone or, when once is set,
+// until the job is finished
+func streamEvents(w http.ResponseWriter, r *http.Request, ch chan Job, last *Job, once bool) {
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(200)
+
+	if last != nil {
+		if writeEvent(w, last) != nil {
+			return
+		}
+		if once && jobFinished(last) {
+			return
+		}
+	} else {
+		w.(http.Flusher).Flush()
+	}
+
+	ticker := time.NewTicker(eventsKeepAlive)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case job := <-ch:
+			if writeEvent(w, &job) != nil {
+				return
+			}
+			if once && jobFinished(&job) {
+				return
+			}
+		case <-ticker.C:
+			fmt.Fprintf(w, ": keepalive\n\n")
+			w.(http.Flusher).Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// GET /api/v1/jobs/{JobId}/events
+func (feeds *MyFeeds) HandleJobEvents(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+
+	id, err := strconv.ParseUint(params["JobId"], 10, 64)
+	if err != nil {
+		JSONError(w, "The JobId should be valid form: ^[0-9]+$", http.StatusBadRequest)
+		return
+	}
+
+	Cid := r.Header.Get("cid")
+	if !validateCid(Cid) {
+		JSONError(w, "The cid should be valid form: ^[a-f0-9]{32}$", http.StatusUnauthorized)
+		return
+	}
+
+	if !isCidAllowed(feeds, Cid) {
+		fmt.Printf("CID not in ACL: %s\n", Cid)
+		JSONError(w, "not allowed", http.StatusForbidden)
+		return
+	}
+
+	if !isPermitted(feeds, Cid, permRead) {
+		JSONError(w, ErrPermission.Error(), http.StatusForbidden)
+		return
+	}
+
+	if _, ok := w.(http.Flusher); !ok {
+		JSONError(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	// subscribe before read: final update can not slip in between
+	ch := jobEvents.Subscribe(jobKey(id))
+	defer jobEvents.Unsubscribe(jobKey(id), ch)
+
+	job, err := store.GetJob(id)
+	if err != nil || job.Cid != Cid {
+		JSONErrorLegacy(w, "not found", http.StatusNotFound, http.StatusNotFound)
+		return
+	}
+
+	streamEvents(w, r, ch, job, true)
+}
+
+// GET /api/v1/status/{InstanceId}/events: updates of every job of the instance
+func (feeds *MyFeeds) HandleStatusEvents(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+
+	InstanceId := params["InstanceId"]
+	if !validateInstanceId(InstanceId) {
+		JSONError(w, "The InstanceId should be valid form: ^[a-z_]([a-z0-9_])*$ (maxlen: 40)", http.StatusBadRequest)
+		return
+	}
+
+	Cid := r.Header.Get("cid")
+	if !validateCid(Cid) {
+		JSONError(w, "The cid should be valid form: ^[a-f0-9]{32}$", http.StatusUnauthorized)
+		return
+	}
+
+	if !isCidAllowed(feeds, Cid) {
+		fmt.Printf("CID not in ACL: %s\n", Cid)
+		JSONError(w, "not allowed", http.StatusForbidden)
+		return
+	}
+
+	if !isPermitted(feeds, Cid, permRead) {
+		JSONError(w, ErrPermission.Error(), http.StatusForbidden)
+		return
+	}
+
+	if _, ok := w.(http.Flusher); !ok {
+		JSONError(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	ch := jobEvents.Subscribe(instanceKey(Cid, InstanceId))
+	defer jobEvents.Unsubscribe(instanceKey(Cid, InstanceId), ch)
+
+	list, err := store.ListJobs(Cid, InstanceId)
+	if err != nil {
+		JSONError(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	var last *Job
+	if len(list) > 0 {
+		last = list[0]
+	}
+
+	streamEvents(w, r, ch, last, false)
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// readEvent reads one SSE event, keepalive comments are skipped
+func readEvent(t *testing.T, r *bufio.Reader) (string, Job) {
+	t.Helper()
+
+	var event string
+	var job Job
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("read event: %v", err)
+		}
+		line = strings.TrimRight(line, "\n")
+		switch {
+		case strings.HasPrefix(line, "event: "):
+			event = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &job); err != nil {
+				t.Fatalf("data: %v: %s", err, line)
+			}
+		case len(line) == 0 && len(event) > 0:
+			return event, job
+		}
+	}
+}
+
+func openEvents(t *testing.T, ctx context.Context, url string, cid string) *http.Response {
+	t.Helper()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("cid", cid)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+func TestJobEvents(t *testing.T) {
+	setupInstances(t, 1)
+	srv := httptest.NewServer(newRouter(&MyFeeds{f: &Feed{}}))
+	defer srv.Close()
+
+	job := Job{Id: 5, Command: "start", Instance: "vm0", Cid: testCid, State: JobPending}
+	if err := store.PutJob(&job); err != nil {
+		t.Fatal(err)
+	}
+
+	if resp := openEvents(t, context.Background(), srv.URL+"/api/v1/jobs/5/events", "fedcba9876543210fedcba9876543210"); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("job of other tenant: %d", resp.StatusCode)
+	}
+
+	resp := openEvents(t, context.Background(), srv.URL+"/api/v1/jobs/5/events", testCid)
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("%d %s", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	r := bufio.NewReader(resp.Body)
+
+	// current state first, then updates up to the final one
+	if event, got := readEvent(t, r); event != "progress" || got.State != JobPending {
+		t.Errorf("initial: %s %+v", event, got)
+	}
+	job.State, job.Progress = JobRunning, 50
+	jobEvents.Publish(job)
+	if event, got := readEvent(t, r); event != "progress" || got.Progress != 50 {
+		t.Errorf("progress: %s %+v", event, got)
+	}
+	job.State, job.Progress = JobSuccess, 100
+	jobEvents.Publish(job)
+	if event, got := readEvent(t, r); event != "done" || got.State != JobSuccess {
+		t.Errorf("final: %s %+v", event, got)
+	}
+
+	if rest, err := io.ReadAll(r); err != nil || len(rest) > 0 {
+		t.Errorf("stream not ended after done: %q %v", rest, err)
+	}
+
+	// finished job: the only event is done
+	store.PutJob(&job)
+	r = bufio.NewReader(openEvents(t, context.Background(), srv.URL+"/api/v1/jobs/5/events", testCid).Body)
+	if event, _ := readEvent(t, r); event != "done" {
+		t.Errorf("finished job: %s", event)
+	}
+	if rest, _ := io.ReadAll(r); len(rest) > 0 {
+		t.Errorf("finished job: %q", rest)
+	}
+}
+
+// instance stream follows every job of the instance until the client is gone
+func TestStatusEvents(t *testing.T) {
+	setupInstances(t, 1)
+	srv := httptest.NewServer(newRouter(&MyFeeds{f: &Feed{}}))
+	defer srv.Close()
+
+	stop := Job{Id: 6, Command: "stop", Instance: "vm0", Cid: testCid, State: JobSuccess, Progress: 100}
+	if err := store.PutJob(&stop); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	resp := openEvents(t, ctx, srv.URL+"/api/v1/status/vm0/events", testCid)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("%d", resp.StatusCode)
+	}
+	r := bufio.NewReader(resp.Body)
+
+	if event, got := readEvent(t, r); event != "done" || got.Id != 6 {
+		t.Errorf("last job: %s %+v", event, got)
+	}
+
+	// same instance name of other tenant is not streamed
+	jobEvents.Publish(Job{Id: 7, Command: "start", Instance: "vm0", Cid: "fedcba9876543210fedcba9876543210", State: JobRunning})
+
+	start := Job{Id: 8, Command: "start", Instance: "vm0", Cid: testCid, State: JobRunning, Progress: 50}
+	jobEvents.Publish(start)
+	if event, got := readEvent(t, r); event != "progress" || got.Id != 8 || got.Progress != 50 {
+		t.Errorf("progress: %s %+v", event, got)
+	}
+	start.State, start.Progress = JobSuccess, 100
+	jobEvents.Publish(start)
+	if event, got := readEvent(t, r); event != "done" || got.Id != 8 {
+		t.Errorf("final: %s %+v", event, got)
+	}
+
+	// next job of the instance on the same stream
+	destroy := Job{Id: 9, Command: "destroy", Instance: "vm0", Cid: testCid, State: JobPending}
+	jobEvents.Publish(destroy)
+	if event, got := readEvent(t, r); event != "progress" || got.Id != 9 {
+		t.Errorf("next job: %s %+v", event, got)
+	}
+}
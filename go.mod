@@ -5,6 +5,7 @@ go 1.23.5
 require (
 	github.com/beanstalkd/go-beanstalk v0.2.0
 	github.com/gorilla/mux v1.8.1
+	go.etcd.io/bbolt v1.3.11
 	golang.org/x/crypto v0.32.0
 )
 
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// job states
+const (
+	JobPending  = "pending"   // published, no reply yet
+	JobRunning  = "running"   // intermediate CbsdTask received
+	JobSuccess  = "success"   // final CbsdTask with errcode 0
+	JobFailed   = "failed"    // final CbsdTask with errcode != 0 or broker error
+	JobTimedOut = "timed_out" // no final CbsdTask within the command timeout
+)
+
+var (
+	createTimeout  = flag.Int("create_timeout", 3600, "Max time from publish to the final reply of create, seconds")
+	destroyTimeout = flag.Int("destroy_timeout", 900, "Max time from publish to the final reply of destroy, seconds")
+	commandTimeout = flag.Int("command_timeout", 600, "Max time from publish to the final reply of start, stop and the rest, seconds")
+)
+
+// jobContext is the parent of every job context, cancelled on shutdown
+var jobContext, cancelJobs = context.WithCancel(context.Background())
+
+// jobTimeout returns overall deadline of command replies
+func jobTimeout(command string) time.Duration {
+	switch command {
+	case "create":
+		return time.Duration(*createTimeout) * time.Second
+	case "destroy":
+		return time.Duration(*destroyTimeout) * time.Second
+	}
+	return time.Duration(*commandTimeout) * time.Second
+}
+
+// Job is a command dispatched to the node, Id is assigned by the store
+type Job struct {
+	Id        uint64    `json:"id"`
+	BrokerId  uint64    `json:"broker_id,omitempty"` // names the reply tube
+	Command   string    `json:"command"`
+	Instance  string    `json:"instance"`
+	Cid       string    `json:"cid"`
+	State     string    `json:"state"`
+	Progress  int       `json:"progress"`
+	ErrCode   int       `json:"errcode"`
+	Message   string    `json:"message"`
+	Created   time.Time `json:"created"`
+	Updated   time.Time `json:"updated"`
+	ReplyTube string    `json:"reply_tube,omitempty"` // to resume watching after restart
+}
+
+// realInstanceCreate persists command in the outbox and publishes it to the
+// node, replies are consumed in background. Returns job id, 0 when the broker
+// is unavailable and the command stays queued in the outbox. ctx bounds
+// the publish attempt, usually it is the HTTP request one.
+func realInstanceCreate(ctx context.Context, d Dispatch, job Job) (uint64, error) {
+
+	if outbox == nil {
+		return publishJob(ctx, d, job)
+	}
+
+	entry, err := outbox.Add(d, job)
+	if err != nil {
+		fmt.Printf("unable to queue %s of %s/%s: %s\n", job.Command, job.Cid, job.Instance, err.Error())
+		return publishJob(ctx, d, job)
+	}
+
+	id, err := outbox.Dispatch(ctx, entry)
+	if err != nil {
+		fmt.Printf("unable to publish into %s: %s, queued as %s\n", d.Tube, err.Error(), entry.Id)
+		return 0, nil
+	}
+	return id, nil
+}
+
+// publishJob publish command without the outbox
+func publishJob(ctx context.Context, d Dispatch, job Job) (uint64, error) {
+	id, err := broker.Publish(ctx, d.Tube, []byte(d.Body))
+	if err != nil {
+		fmt.Printf("unable to publish into %s: %s\n", d.Tube, err.Error())
+		return 0, err
+	}
+
+	return startJob(d, job, id), nil
+}
+
+// startJob records job published as broker job id and follows its
+// replies, returns the job id
+func startJob(d Dispatch, job Job, id uint64) uint64 {
+	job.BrokerId = id
+	job.State = JobPending
+	job.ReplyTube = fmt.Sprintf("%s%d", d.ReplyTubePrefix, id)
+	job.Created = time.Now()
+	job.Updated = job.Created
+
+	if err := store.CreateJob(&job); err != nil {
+		fmt.Printf("unable to save job of broker id %d: %s\n", id, err.Error())
+	}
+	jobEvents.Publish(job)
+
+	// destroyed instance is gone once the node got the command
+	if job.Command == "destroy" {
+		if err := destroyStored(store, job.Cid, job.Instance); err != nil {
+			fmt.Printf("unable to remove %s/%s from store: %s\n", job.Cid, job.Instance, err.Error())
+		}
+	}
+
+	runJob(broker, store, config.BeanstalkConfig.ReserveTimeout, job)
+	return job.Id
+}
+
+// watchJob follows CbsdTask replies of job from b until final one or the
+// command timeout since job creation, job and instance status are saved
+// into s. Resumed job reads at least replies already queued in its tube.
+func watchJob(ctx context.Context, b Broker, s Store, reserveTimeout int, job Job) {
+
+	fmt.Printf("job %d: callback queue name: %s\n", job.Id, job.ReplyTube)
+
+	timeout := jobTimeout(job.Command)
+	deadline := job.Created.Add(timeout)
+	if earliest := time.Now().Add(time.Duration(reserveTimeout+1) * time.Second); deadline.Before(earliest) {
+		deadline = earliest
+	}
+	ctx, cancel := context.WithDeadline(ctx, deadline)
+	defer cancel()
+
+	task, err := brokerAwait(ctx, b, job.ReplyTube, reserveTimeout, func(task CbsdTask) {
+		job.State = JobRunning
+		job.Progress = task.Progress
+		job.ErrCode = task.ErrCode
+		job.Message = task.Message
+		job.Updated = time.Now()
+		s.PutJob(&job)
+		updateInstanceStatus(s, &job)
+		jobEvents.Publish(job)
+	})
+
+	switch {
+	case errors.Is(err, context.Canceled):
+		// shutdown: job keeps its last state and is resumed on start
+		fmt.Printf("job %d: interrupted in %s state\n", job.Id, job.State)
+		return
+	case errors.Is(err, context.DeadlineExceeded):
+		job.State = JobTimedOut
+		job.Message = fmt.Sprintf("no final reply in %s", timeout)
+	case err != nil:
+		job.State = JobFailed
+		job.Message = err.Error()
+	case task.ErrCode != 0:
+		job.State = JobFailed
+	default:
+		job.State = JobSuccess
+	}
+	job.Updated = time.Now()
+
+	fmt.Printf("job %d: %s: %s\n", job.Id, job.State, job.Message)
+
+	if err := s.PutJob(&job); err != nil {
+		fmt.Printf("unable to save job %d: %s\n", job.Id, err.Error())
+	}
+	updateInstanceStatus(s, &job)
+	jobEvents.Publish(job)
+}
+
+// resumeJobs follows replies of jobs left unfinished by the previous run,
+// returns number of resumed jobs
+func resumeJobs() int {
+	jobs, err := store.ListJobs("", "")
+	if err != nil {
+		fmt.Printf("unable to list jobs: %s\n", err.Error())
+		return 0
+	}
+
+	n := 0
+	for _, job := range jobs {
+		if jobFinished(job) {
+			continue
+		}
+
+		// recorded before reply tubes were kept: by the instance node
+		if len(job.ReplyTube) == 0 {
+			if inst, err := store.GetInstance(job.Cid, job.Instance); err == nil && len(inst.Node) > 0 {
+				_, reply := nodeTubes(inst.Node)
+				job.ReplyTube = fmt.Sprintf("%s%d", reply, job.Id)
+			}
+		}
+		if len(job.ReplyTube) == 0 {
+			job.State = JobFailed
+			job.Message = "reply tube is unknown after restart"
+			job.Updated = time.Now()
+			store.PutJob(job)
+			fmt.Printf("job %d: %s\n", job.Id, job.Message)
+			continue
+		}
+
+		fmt.Printf("job %d: resume %s of %s/%s in %s state\n", job.Id, job.Command, job.Cid, job.Instance, job.State)
+		runJob(broker, store, config.BeanstalkConfig.ReserveTimeout, *job)
+		n++
+	}
+	return n
+}
+
+func (feeds *MyFeeds) HandleJobStatus(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+
+	id, err := strconv.ParseUint(params["JobId"], 10, 64)
+	if err != nil {
+		JSONError(w, "The JobId should be valid form: ^[0-9]+$", http.StatusBadRequest)
+		return
+	}
+
+	Cid := r.Header.Get("cid")
+	if !validateCid(Cid) {
+		JSONError(w, "The cid should be valid form: ^[a-f0-9]{32}$", http.StatusUnauthorized)
+		return
+	}
+
+	if !isCidAllowed(feeds, Cid) {
+		fmt.Printf("CID not in ACL: %s\n", Cid)
+		JSONError(w, "not allowed", http.StatusForbidden)
+		return
+	}
+
+	if !isPermitted(feeds, Cid, permRead) {
+		JSONError(w, ErrPermission.Error(), http.StatusForbidden)
+		return
+	}
+
+	job, err := store.GetJob(id)
+	if err != nil || job.Cid != Cid {
+		JSONErrorLegacy(w, "not found", http.StatusNotFound, http.StatusNotFound)
+		return
+	}
+
+	writeJSON(w, job)
+}
+
+func (feeds *MyFeeds) HandleJobList(w http.ResponseWriter, r *http.Request) {
+	Cid := r.Header.Get("cid")
+	if !validateCid(Cid) {
+		JSONError(w, "The cid should be valid form: ^[a-f0-9]{32}$", http.StatusUnauthorized)
+		return
+	}
+
+	if !isCidAllowed(feeds, Cid) {
+		fmt.Printf("CID not in ACL: %s\n", Cid)
+		JSONError(w, "not allowed", http.StatusForbidden)
+		return
+	}
+
+	if !isPermitted(feeds, Cid, permRead) {
+		JSONError(w, ErrPermission.Error(), http.StatusForbidden)
+		return
+	}
+
+	InstanceId := r.URL.Query().Get("instance")
+	if len(InstanceId) > 0 && !validateInstanceId(InstanceId) {
+		JSONError(w, "The InstanceId should be valid form: ^[a-z_]([a-z0-9_])*$ (maxlen: 40)", http.StatusBadRequest)
+		return
+	}
+
+	list, err := store.ListJobs(Cid, InstanceId)
+	if err != nil {
+		fmt.Printf("unable to list jobs: %s\n", err.Error())
+		JSONError(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, list)
+}
+
+// writeJSON sends v with 200 OK
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	js, err := json.Marshal(v)
+	if err != nil {
+		JSONError(w, "Marshal error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(200)
+	w.Write(js)
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// job without the final reply is timed_out after the command timeout
+func TestJobTimeout(t *testing.T) {
+	setupInstances(t, 0)
+	broker = newMemoryBroker(MemoryConfig{})
+
+	saved := *commandTimeout
+	*commandTimeout = 1
+	t.Cleanup(func() { *commandTimeout = saved })
+
+	job := Job{Id: 1, Command: "stop", Instance: "vm0", Cid: testCid, State: JobPending, ReplyTube: "cbsd_node0_result_id1"}
+	start := time.Now()
+	watchJob(jobContext, broker, store, 0, job)
+
+	if elapsed := time.Since(start); elapsed < time.Second || elapsed > 3*time.Second {
+		t.Errorf("timed out after %s", elapsed)
+	}
+	got, err := store.GetJob(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.State != JobTimedOut {
+		t.Errorf("state: %s %s", got.State, got.Message)
+	}
+}
+
+// reserve timeout is the poll interval, the job waits for slow node
+func TestJobSlowReply(t *testing.T) {
+	setupInstances(t, 0)
+	mb := newMemoryBroker(MemoryConfig{})
+
+	go func() {
+		time.Sleep(1500 * time.Millisecond)
+		body, _ := json.Marshal(CbsdTask{Progress: 100, Message: "done"})
+		mb.Publish(context.Background(), "cbsd_node0_result_id2", body)
+	}()
+
+	watchJob(jobContext, mb, store, 1, Job{Id: 2, Command: "start", Instance: "vm0", Cid: testCid, State: JobPending, ReplyTube: "cbsd_node0_result_id2"})
+
+	got, err := store.GetJob(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.State != JobSuccess {
+		t.Errorf("state: %s %s", got.State, got.Message)
+	}
+}
+
+func TestMemoryAwaitCancel(t *testing.T) {
+	mb := newMemoryBroker(MemoryConfig{})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		cancel()
+	}()
+
+	if _, err := mb.Await(ctx, "cbsd_node0_result_id3", time.Minute); err != context.Canceled {
+		t.Errorf("await: %v", err)
+	}
+}
+
+// jobs left pending by the previous run consume replies queued meanwhile
+func TestResumeJobs(t *testing.T) {
+	setupInstances(t, 1)
+	mb := newMemoryBroker(MemoryConfig{})
+	broker = mb
+
+	_, reply := nodeTubes("node0.example.org")
+	now := time.Now()
+	jobs := []Job{
+		{Id: 10, Command: "create", Instance: "vm0", Cid: testCid, State: JobPending, Created: now, ReplyTube: reply + "10"},
+		// recorded before reply tubes were kept
+		{Id: 11, Command: "start", Instance: "vm0", Cid: testCid, State: JobRunning, Created: now},
+		{Id: 12, Command: "stop", Instance: "vm0", Cid: testCid, State: JobSuccess, Created: now},
+		{Id: 13, Command: "start", Instance: "gone", Cid: testCid, State: JobPending, Created: now},
+	}
+	for i := range jobs {
+		store.PutJob(&jobs[i])
+	}
+	for _, id := range []string{"10", "11"} {
+		for _, progress := range []int{50, 100} {
+			body, _ := json.Marshal(CbsdTask{Progress: progress, Message: "ok"})
+			mb.Publish(context.Background(), reply+id, body)
+		}
+	}
+
+	if n := resumeJobs(); n != 2 {
+		t.Errorf("resumed: %d", n)
+	}
+
+	want := map[uint64]string{10: JobSuccess, 11: JobSuccess, 12: JobSuccess, 13: JobFailed}
+	deadline := time.Now().Add(3 * time.Second)
+	for id, state := range want {
+		for {
+			got, err := store.GetJob(id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.State == state {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Errorf("job %d: %s, want %s", id, got.State, state)
+				break
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+	}
+}
+
+// broker restarted from id 1 does not overwrite jobs recorded before
+func TestJobIdCollision(t *testing.T) {
+	setupInstances(t, 1)
+
+	// imported from the flat files, keyed by broker id
+	legacy := Job{Id: 1, Command: "create", Instance: "vm0", Cid: testCid, State: JobSuccess, Created: time.Now().Add(-time.Hour)}
+	store.PutJob(&legacy)
+
+	router := newRouter(&MyFeeds{f: &Feed{}})
+	ids := map[uint64]bool{legacy.Id: true}
+	for i := 0; i < 2; i++ {
+		broker = newMemoryBroker(MemoryConfig{})
+
+		req := httptest.NewRequest("GET", "/api/v1/stop/vm0", nil)
+		req.Header.Set("cid", testCid)
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+
+		var reply JobResponse
+		if err := json.Unmarshal(rec.Body.Bytes(), &reply); err != nil || rec.Code != http.StatusOK {
+			t.Fatalf("%d %s", rec.Code, rec.Body.String())
+		}
+		if ids[reply.Job] {
+			t.Errorf("job id %d reused", reply.Job)
+		}
+		ids[reply.Job] = true
+
+		job, err := store.GetJob(reply.Job)
+		if err != nil || job.BrokerId != 1 || job.ReplyTube != "cbsd_node0_example_org_result_id1" {
+			t.Errorf("job %d: %+v %v", reply.Job, job, err)
+		}
+	}
+
+	if got, err := store.GetJob(legacy.Id); err != nil || got.Command != "create" {
+		t.Errorf("legacy job overwritten: %+v %v", got, err)
+	}
+}
+
+func TestJobsEndpoint(t *testing.T) {
+	setupInstances(t, 1)
+
+	const other = "fedcba9876543210fedcba9876543210"
+	now := time.Now()
+	jobs := []Job{
+		{Command: "create", Instance: "vm0", Cid: testCid, State: JobSuccess, Created: now.Add(-time.Minute)},
+		{Command: "stop", Instance: "vm0", Cid: testCid, State: JobPending, Created: now},
+		{Command: "create", Instance: "vm5", Cid: testCid, State: JobFailed, Created: now},
+		{Command: "create", Instance: "vm0", Cid: other, State: JobSuccess, Created: now},
+	}
+	for i := range jobs {
+		if err := store.CreateJob(&jobs[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	router := newRouter(&MyFeeds{f: &Feed{}})
+	do := func(path string, cid string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		req.Header.Set("cid", cid)
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec
+	}
+	list := func(path string) []Job {
+		t.Helper()
+		rec := do(path, testCid)
+		var list []Job
+		if err := json.Unmarshal(rec.Body.Bytes(), &list); err != nil || rec.Code != http.StatusOK {
+			t.Fatalf("%s: %d %s", path, rec.Code, rec.Body.String())
+		}
+		return list
+	}
+
+	if got := list("/api/v1/jobs"); len(got) != 3 {
+		t.Errorf("jobs: %+v", got)
+	}
+	if got := list("/api/v1/jobs?instance=vm0"); len(got) != 2 || got[0].Id != jobs[1].Id || got[1].Id != jobs[0].Id {
+		t.Errorf("jobs of vm0, newest first: %+v", got)
+	}
+	if rec := do("/api/v1/jobs?instance=VM0", testCid); rec.Code != http.StatusBadRequest {
+		t.Errorf("bad instance: %d", rec.Code)
+	}
+
+	for _, tt := range []struct {
+		name string
+		path string
+		cid  string
+		code int
+	}{
+		{"own", fmt.Sprintf("/api/v1/jobs/%d", jobs[1].Id), testCid, http.StatusOK},
+		{"other tenant", fmt.Sprintf("/api/v1/jobs/%d", jobs[3].Id), testCid, http.StatusNotFound},
+		{"missing", "/api/v1/jobs/999", testCid, http.StatusNotFound},
+		{"bad id", "/api/v1/jobs/x1", testCid, http.StatusBadRequest},
+		{"no cid", fmt.Sprintf("/api/v1/jobs/%d", jobs[1].Id), "", http.StatusUnauthorized},
+	} {
+		rec := do(tt.path, tt.cid)
+		if rec.Code != tt.code {
+			t.Errorf("%s: %d %s", tt.name, rec.Code, rec.Body.String())
+			continue
+		}
+		if tt.code == http.StatusOK {
+			var job Job
+			json.Unmarshal(rec.Body.Bytes(), &job)
+			if job.Id != jobs[1].Id || job.Command != "stop" || job.State != JobPending {
+				t.Errorf("%s: %+v", tt.name, job)
+			}
+		}
+	}
+}
@@ -4,9 +4,8 @@
 package main
 
 import (
-	"bufio"
 	"crypto/md5"
-	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
@@ -15,12 +14,13 @@ import (
 	"net/http"
 	"os"
 	"os/exec"
+	"os/signal"
 //	"path/filepath"
 	"reflect"
 	"regexp"
-	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 //	"gopkg.in/yaml.v3"
@@ -30,13 +30,13 @@ import (
 
 var lock = sync.RWMutex{}
 var config Config
-var runscript string
 var workdir string
 var server_url string
 var acl_enable bool
 var spool_Dir string
 var onetime_Dir string
 var vm_Engine string
+var broker Broker
 
 var clusterLimitMax int
 
@@ -46,44 +46,51 @@ type Response struct {
 	Message string
 }
 
-// The cluster Type. Name of elements must match with jconf params
+// reply of start/stop/destroy: Job is the id for /api/v1/jobs/{JobId}
+type JobResponse struct {
+	Message string
+	Job     uint64
+}
+
+// The cluster Type. Name of elements must match with jconf params.
+// Payload is validated by createSchemas first: see schema.go
 type Vm struct {
-	Image         string `json:image,omitempty"`
-	Type          string `json:type,omitempty"`
-	Vm_os_type    string `json:vm_os_type,omitempty"`
-	Vm_os_profile string `json:vm_os_profile,omitempty"`
-	Jname         string `json:jname,omitempty"`
-	Ram           string `json:ram,omitempty"`
-	Cpus          int    `"cpus,omitempty"`
-	Imgsize       string `"imgsize,omitempty"`
-	Pubkey        string `"pubkey,omitempty"`
-	PkgList       string `"pkglist,omitempty"`
-	Extras        string `"extras,omitempty"`
-	Recomendation string `"recomendation,omitempty"`
-	Host_hostname string `"host_hostname,omitempty"`
-	Email         string `"email,omitempty"`
-	Callback      string `"callback,omitempty"`
+	Image         string `json:"image,omitempty"`
+	Type          string `json:"type,omitempty"`
+	Vm_os_type    string `json:"vm_os_type,omitempty"`
+	Vm_os_profile string `json:"vm_os_profile,omitempty"`
+	Jname         string `json:"-"` // InstanceId from URL
+	Ram           string `json:"ram,omitempty"`
+	Cpus          int    `json:"cpus,omitempty"`
+	Imgsize       string `json:"imgsize,omitempty"`
+	Pubkey        string `json:"pubkey,omitempty"`
+	PkgList       string `json:"pkglist,omitempty"`
+	Extras        string `json:"extras,omitempty"`
+	Recomendation string `json:"recomendation,omitempty"`
+	Host_hostname string `json:"host_hostname,omitempty"`
+	Email         string `json:"email,omitempty"`
+	Callback      string `json:"callback,omitempty"`
 }
 
 // The cluster Type. Name of elements must match with jconf params
 type Cluster struct {
-	Image             string `json:image,omitempty"`
-	K8s_name          string `json:jname,omitempty"`
-	Init_masters      string `json:init_masters,omitempty"`
-	Init_workers      string `json:init_workers,omitempty"`
-	Master_vm_ram     string `json:master_vm_ram,omitempty"`
-	Master_vm_cpus    string `"master_vm_cpus,omitempty"`
-	Master_vm_imgsize string `"master_vm_imgsize,omitempty"`
-	Worker_vm_ram     string `"worker_vm_ram,omitempty"`
-	Worker_vm_cpus    string `"worker_vm_cpus,omitempty"`
-	Worker_vm_imgsize string `"worker_vm_imgsize,omitempty"`
-	Pv_enable         string `"pv_enable,omitempty"`
-	Pv_size           string `"pv_size,omitempty"`
-	Kubelet_master    string `"kubelet_master,omitempty"`
-	Email             string `"email,omitempty"`
-	Callback          string `"callback,omitempty"`
-	Pubkey            string `"pubkey,omitempty"`
-	Recomendation     string `"recomendation,omitempty"`
+	Image             string `json:"image,omitempty"`
+	K8s_name          string `json:"-"` // InstanceId from URL
+	Init_masters      int    `json:"init_masters,omitempty"`
+	Init_workers      int    `json:"init_workers,omitempty"`
+	Master_vm_ram     string `json:"master_vm_ram,omitempty"`
+	Master_vm_cpus    *int   `json:"master_vm_cpus,omitempty"`
+	Master_vm_imgsize string `json:"master_vm_imgsize,omitempty"`
+	Worker_vm_ram     string `json:"worker_vm_ram,omitempty"`
+	Worker_vm_cpus    *int   `json:"worker_vm_cpus,omitempty"`
+	Worker_vm_imgsize string `json:"worker_vm_imgsize,omitempty"`
+	Pv_enable         int    `json:"pv_enable"`
+	Pv_size           string `json:"pv_size,omitempty"`
+	Kubelet_master    int    `json:"kubelet_master"`
+	Email             string `json:"email,omitempty"`
+	Callback          string `json:"callback,omitempty"`
+	Pubkey            string `json:"pubkey,omitempty"`
+	Recomendation     string `json:"recomendation,omitempty"`
 }
 
 // Todo: validate mod?
@@ -109,24 +116,32 @@ var (
 	spoolDir               = flag.String("spooldir", "/var/spool/cbsd-mq-api", "spool root dir")
 	oneTimeConfDir         = flag.String("onetimeconfdir", "", "one-time config dir")
 	vmEngine               = flag.String("vmengine", "bhyve", "VM engine: bhyve, qemu, virtualbox, xen")
+	storeFile              = flag.String("store", "", "Path to state database, default: <dbdir>/cbsd-mq-api.db")
+	legacyCompat           = flag.Bool("legacy_compat", true, "Keep writing legacy map/vm-<id>/cluster-<id>/.node/-vm.ssh files for CBSD scripts")
 )
 
+// AllowList is a key of the allowlist file
 type AllowList struct {
-	keyType string
-	key     string
-	comment string
-	cid     string
-	next    *AllowList // link to the next records
+	key          ssh.PublicKey
+	comment      string
+	options      []string
+	fingerprint  string
+	cid          string   // md5 of "<type> <key> [comment]", as of create payload pubkey
+	role         string   // readonly, operator, admin
+	images       []string // permitted image patterns, empty: all
+	quota        Quota    // max_* options, 0: -quota_* default
 }
 
-// linked struct
+// Feed is the parsed allowlist, indexed by key fingerprint and CID
 type Feed struct {
-	length int
-	start  *AllowList
+	length        int
+	byFingerprint map[string]*AllowList
+	byCid         map[string]*AllowList
 }
 
 type MyFeeds struct {
-	f *Feed
+	mu sync.RWMutex // guards f, swapped on allowlist reload
+	f  *Feed
 }
 
 // Progress is used to track the progress of a file upload.
@@ -158,52 +173,32 @@ func (pr *Progress) Print() {
 }
 
 func (f *Feed) Append(newAllow *AllowList) {
-	if f.length == 0 {
-		f.start = newAllow
-	} else {
-		currentPost := f.start
-		for currentPost.next != nil {
-			currentPost = currentPost.next
-		}
-		currentPost.next = newAllow
+	if f.byFingerprint == nil {
+		f.byFingerprint = make(map[string]*AllowList)
+		f.byCid = make(map[string]*AllowList)
 	}
+	if _, ok := f.byFingerprint[newAllow.fingerprint]; !ok {
+		f.byFingerprint[newAllow.fingerprint] = newAllow
+	}
+	f.byCid[newAllow.cid] = newAllow
 	f.length++
 }
 
-func newAllow(keyType string, key string, comment string) *AllowList {
-
-	KeyInList := fmt.Sprintf("%s %s %s", keyType, key, comment)
-	uid := []byte(KeyInList)
-	cid := md5.Sum(uid)
-
-	cidString := fmt.Sprintf("%x", cid)
-
-	np := AllowList{keyType: keyType, key: key, comment: comment, cid: cidString}
-	//	np.Response = ""
-	//	np.Time = 0
-	return &np
-}
+// newAllow parses authorized_keys line: [options] keytype key [comment]
+func newAllow(line string) (*AllowList, error) {
+	key, comment, options, _, err := ssh.ParseAuthorizedKey([]byte(line))
+	if err != nil {
+		return nil, err
+	}
 
-// we need overwrite Content-Type here
-// https://stackoverflow.com/questions/59763852/can-you-return-json-in-golang-http-error
-func JSONError(w http.ResponseWriter, message string, code int) {
-	w.Header().Set("Content-Type", "application/json; charset=utf-8")
-	w.Header().Set("X-Content-Type-Options", "nosniff")
-	// write header is mandatory to overwrite header
-	w.WriteHeader(code)
+	KeyInList := strings.TrimSpace(fmt.Sprintf("%s %s", strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key))), comment))
+	cidString := fmt.Sprintf("%x", md5.Sum([]byte(KeyInList)))
 
-	if len(message) > 0 {
-		response := Response{message}
-		js, err := json.Marshal(response)
-		if err != nil {
-			fmt.Fprintln(w, "{\"Message\":\"Marshal error\"}", http.StatusMethodNotAllowed)
-			return
-		}
-		http.Error(w, string(js), code)
-	} else {
-		http.Error(w, "{}", http.StatusOK)
+	p := &AllowList{key: key, comment: comment, options: options, fingerprint: ssh.FingerprintSHA256(key), cid: cidString}
+	if err := parseAllowOptions(p); err != nil {
+		return nil, err
 	}
-	return
+	return p, nil
 }
 
 func fileExists(filename string) bool {
@@ -247,10 +242,30 @@ func main() {
 		os.Exit(1)
 	}
 
-	if !fileExists(config.Recomendation) {
-		fmt.Printf("no such Recomendation script, please check config/path: %s\n", config.Recomendation)
+	broker, err = newBroker(config)
+	if err != nil {
+		fmt.Printf("broker init error: %s\n", err.Error())
+		os.Exit(1)
+	}
+
+	switch placementStrategy() {
+	case placementSpread, placementBinpack, placementScript:
+	default:
+		fmt.Printf("unknown placement: %s, valid: spread, binpack, script\n", config.Placement)
 		os.Exit(1)
 	}
+	if placementStrategy() == placementScript || config.PlacementFallback {
+		if !fileExists(config.Recomendation) {
+			fmt.Printf("no such Recomendation script, please check config/path: %s\n", config.Recomendation)
+			os.Exit(1)
+		}
+	}
+	registry.Load(config.Nodes)
+	if heartbeatEnabled() {
+		go registry.consume(broker, config.HeartbeatTube, nil)
+	}
+	fmt.Printf("* Placement: %s, nodes: %d\n", placementStrategy(), len(config.Nodes))
+
 	if !fileExists(config.Freejname) {
 		fmt.Printf("no such Freejname script, please check config/path: %s\n", config.Freejname)
 		os.Exit(1)
@@ -266,6 +281,29 @@ func main() {
 		os.MkdirAll(*k8sDbDir, 0770)
 	}
 
+	storePath := *storeFile
+	if len(storePath) == 0 {
+		storePath = fmt.Sprintf("%s/cbsd-mq-api.db", *dbDir)
+	}
+
+	store, err = openStore(storePath, *legacyCompat)
+	if err != nil {
+		fmt.Printf("unable to open store %s: %s\n", storePath, err.Error())
+		os.Exit(1)
+	}
+	defer store.Close()
+	fmt.Printf("* Store: %s\n", storePath)
+
+	outbox, err = newOutbox(fmt.Sprintf("%s/outbox", spool_Dir))
+	if err != nil {
+		fmt.Printf("unable to open outbox: %s\n", err.Error())
+		os.Exit(1)
+	}
+	go outbox.Run(jobContext, time.Duration(*outboxRetry)*time.Second)
+	if n := resumeJobs(); n > 0 {
+		fmt.Printf("* Resumed jobs: %d\n", n)
+	}
+
 	f := &Feed{}
 
 	fmt.Printf("* Cluster limit: %d\n", clusterLimitMax)
@@ -279,79 +317,99 @@ func main() {
 	} else {
 		fmt.Printf("* ACL enabled: %s\n", *allowListFile)
 		acl_enable = true
-		// loadconfig
-		fd, err := os.Open(*allowListFile)
+		f, err = loadAllowList(*allowListFile)
 		if err != nil {
-			panic(err)
+			log.Fatal(err)
 		}
-		defer fd.Close()
+		for _, p := range f.byCid {
+			fmt.Printf("* ACL loaded: [%s %s] %s role=%s\n", p.fingerprint, p.comment, p.cid, p.role)
+		}
+		fmt.Printf("* AllowList Length: %v\n", f.length)
+	}
 
-		scanner := bufio.NewScanner(fd)
+	// service reload sends SIGHUP, it must not kill the server without
+	// -allowlist and -admin_keys to reload
+	signal.Ignore(syscall.SIGHUP)
 
-		var keyType string
-		var key string
-		var comment string
+	// setup: we need to pass Feed into handler function
+	feeds := &MyFeeds{f: f}
+	if acl_enable {
+		feeds.watchAllowList(*allowListFile, time.Duration(*allowListPoll)*time.Second)
+	}
 
-		scanner.Split(bufio.ScanLines)
-		var txtlines []string
+	router := newRouter(feeds)
 
-		for scanner.Scan() {
-			txtlines = append(txtlines, scanner.Text())
+	if len(onetime_Dir) > 1 {
+		if !fileExists(onetime_Dir) {
+			fmt.Printf("One-time directory not exist: %s\n", onetime_Dir)
+			os.Exit(1)
+		} else {
+			fmt.Printf("* One-time dir enabled: %s\n", onetime_Dir)
+			otcRoutes(router, feeds)
 		}
+	} else {
+		fmt.Println("* One-time dir disabled")
+	}
 
-		fd.Close()
 
-		for _, eachline := range txtlines {
-			fmt.Println(eachline)
-			// todo: input validation
-			// todo: auto-reload, signal
-			_, err := fmt.Sscanf(eachline, "%s %s %s", &keyType, &key, &comment)
-			if err != nil {
-				log.Fatal(err)
-				break
-			}
-			fmt.Printf("* ACL loaded: [%s %s %s]\n", keyType, key, comment)
-			p := newAllow(keyType, key, comment)
-			f.Append(p)
+
+	if len(*adminKeysFile) > 0 {
+		f, err := loadAllowList(*adminKeysFile)
+		if err != nil {
+			log.Fatal(err)
 		}
-		fmt.Printf("* AllowList Length: %v\n", f.length)
+		admins := &MyFeeds{f: f}
+		admins.watchAllowList(*adminKeysFile, time.Duration(*allowListPoll)*time.Second)
+		adminRoutes(router, admins)
+		fmt.Printf("* Admin API enabled: %s, keys: %d\n", *adminKeysFile, f.length)
+	} else {
+		fmt.Println("* Admin API disabled")
 	}
 
-	// setup: we need to pass Feed into handler function
-	feeds := &MyFeeds{f: f}
+	fmt.Printf("* Auth: %s\n", *authMode)
+	fmt.Println("* Listen", *listen)
+	fmt.Println("* Server URL", server_url)
+	if err := serve(&http.Server{Addr: *listen, Handler: router}); err != nil {
+		log.Fatal(err)
+	}
+}
 
+// newRouter registers API endpoints
+func newRouter(feeds *MyFeeds) *mux.Router {
 	router := mux.NewRouter()
+	router.Use(apiMiddleware)
+	router.Use(feeds.authMiddleware)
+	router.Use(feeds.tenantMiddleware)
+	router.NotFoundHandler = notFoundHandler()
+	router.MethodNotAllowedHandler = methodNotAllowedHandler()
 	router.HandleFunc("/api/v1/create/{InstanceId}", feeds.HandleClusterCreate).Methods("POST")
 	router.HandleFunc("/api/v1/status/{InstanceId}", feeds.HandleClusterStatus).Methods("GET")
+	router.HandleFunc("/api/v1/status/{InstanceId}/events", feeds.HandleStatusEvents).Methods("GET")
 	router.HandleFunc("/api/v1/kubeconfig/{InstanceId}", feeds.HandleClusterKubeConfig).Methods("GET")
 	router.HandleFunc("/api/v1/start/{InstanceId}", feeds.HandleClusterStart).Methods("GET")
 	router.HandleFunc("/api/v1/stop/{InstanceId}", feeds.HandleClusterStop).Methods("GET")
 	router.HandleFunc("/api/v1/destroy/{InstanceId}", feeds.HandleClusterDestroy).Methods("GET")
 	router.HandleFunc("/api/v1/cluster", feeds.HandleClusterCluster).Methods("GET")
 	router.HandleFunc("/api/v1/k8scluster", feeds.HandleK8sClusterCluster).Methods("GET")
+	router.HandleFunc("/api/v1/quota", feeds.HandleQuota).Methods("GET")
+	router.HandleFunc("/api/v1/nodes", feeds.HandleNodes).Methods("GET")
+	router.HandleFunc("/api/v1/schema/{Image}", HandleCreateSchema).Methods("GET")
+	router.HandleFunc("/api/v1/jobs", feeds.HandleJobList).Methods("GET")
+	router.HandleFunc("/api/v1/jobs/{JobId}", feeds.HandleJobStatus).Methods("GET")
+	router.HandleFunc("/api/v1/jobs/{JobId}/events", feeds.HandleJobEvents).Methods("GET")
+	router.HandleFunc("/api/v1/openapi.json", HandleOpenAPI).Methods("GET")
 //	for test only
 //	router.HandleFunc("/api/v1/iac/{InstanceId}", feeds.HandleIac).Methods("POST")
 //	router.HandleFunc("/api/v1/iac/{InstanceId}", feeds.HandleIacRequestStatus).Methods("GET")
 	router.HandleFunc("/images", HandleClusterImages).Methods("GET")
 	router.HandleFunc("/flavors", HandleClusterFlavors).Methods("GET")
 
-	if len(onetime_Dir) > 1 {
-		if !fileExists(onetime_Dir) {
-			fmt.Printf("One-time directory not exist: %s\n", onetime_Dir)
-			os.Exit(1)
-		} else {
-			fmt.Printf("* One-time dir enabled: %s\n", onetime_Dir)
-			router.HandleFunc("/api/v1/otc/{CfgFile}", feeds.HandleOneTimeConf).Methods("GET")
-		}
-	} else {
-		fmt.Println("* One-time dir disabled")
-	}
-
-
+	return router
+}
 
-	fmt.Println("* Listen", *listen)
-	fmt.Println("* Server URL", server_url)
-	log.Fatal(http.ListenAndServe(*listen, router))
+// otcRoutes registers one-time config endpoint, enabled by -onetimeconfdir
+func otcRoutes(router *mux.Router, feeds *MyFeeds) {
+	router.HandleFunc("/api/v1/otc/{CfgFile}", feeds.HandleOneTimeConf).Methods("GET")
 }
 
 func validateCid(Cid string) bool {
@@ -393,52 +451,39 @@ func validateCfgFile(CfgFile string) bool {
 }
 
 func isPubKeyAllowed(feeds *MyFeeds, PubKey string) bool {
-	//ALLOWED?
-	var p *AllowList
-	currentAllow := feeds.f.start
-
 	if !acl_enable {
 		return true
 	}
 
-	for i := 0; i < feeds.f.length; i++ {
-		p = currentAllow
-		currentAllow = currentAllow.next
-		ResultKeyType := (string(p.keyType))
-		ResultKey := (string(p.key))
-		ResultKeyComment := (string(p.comment))
-		//fmt.Println("ResultType: ", ResultKeyType)
-		KeyInList := fmt.Sprintf("%s %s %s", ResultKeyType, ResultKey, ResultKeyComment)
-		fmt.Printf("[%s][%s]\n", PubKey, KeyInList)
-
-		if len(PubKey) == len(KeyInList) {
-			if strings.Compare(PubKey, KeyInList) == 0 {
-				fmt.Printf("pubkey matched\n")
-				return true
-			}
-		}
+	key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(PubKey))
+	if err != nil {
+		fmt.Printf("pubkey parse error: %s\n", err.Error())
+		return false
+	}
+
+	// match by key material, comment and options are not significant
+	if _, ok := feeds.feed().byFingerprint[ssh.FingerprintSHA256(key)]; ok {
+		fmt.Printf("pubkey matched: %s\n", ssh.FingerprintSHA256(key))
+		return true
 	}
 
 	return false
 }
 
 func isCidAllowed(feeds *MyFeeds, Cid string) bool {
-	//ALLOWED?
-	var p *AllowList
-	currentAllow := feeds.f.start
+	if isSuspended(Cid) {
+		fmt.Printf("CID suspended: %s\n", Cid)
+		return false
+	}
 
 	if !acl_enable {
 		return true
 	}
 
-	for i := 0; i < feeds.f.length; i++ {
-		p = currentAllow
-		currentAllow = currentAllow.next
-		CidInList := (string(p.cid))
-		if strings.Compare(Cid, CidInList) == 0 {
-			fmt.Printf("Cid ACL matched: %s\n", Cid)
-			return true
-		}
+	// key of the tenant may be in the list with another comment
+	if p := feeds.allowEntry(Cid); p != nil {
+		fmt.Printf("Cid ACL matched: %s (%s)\n", Cid, p.role)
+		return true
 	}
 
 	return false
@@ -446,82 +491,52 @@ func isCidAllowed(feeds *MyFeeds, Cid string) bool {
 
 func (feeds *MyFeeds) HandleClusterStatus(w http.ResponseWriter, r *http.Request) {
 	var InstanceId string
-	// enum { 0 - vm, 1 - k8s }
-	var vmType int
 	params := mux.Vars(r)
 
 	InstanceId = params["InstanceId"]
 	if !validateInstanceId(InstanceId) {
-		JSONError(w, "The InstanceId should be valid form: ^[a-z_]([a-z0-9_])*$ (maxlen: 40)", http.StatusMethodNotAllowed)
+		JSONError(w, "The InstanceId should be valid form: ^[a-z_]([a-z0-9_])*$ (maxlen: 40)", http.StatusBadRequest)
 		return
 	}
 
 	Cid := r.Header.Get("cid")
 	if !validateCid(Cid) {
-		JSONError(w, "The cid should be valid form: ^[a-f0-9]{32}$", http.StatusMethodNotAllowed)
+		JSONError(w, "The cid should be valid form: ^[a-f0-9]{32}$", http.StatusUnauthorized)
 		return
 	}
 
 	if !isCidAllowed(feeds, Cid) {
 		fmt.Printf("CID not in ACL: %s\n", Cid)
-		JSONError(w, "not allowed", http.StatusMethodNotAllowed)
+		JSONError(w, "not allowed", http.StatusForbidden)
 		return
 	}
 
-	var mapfile string
-
-	checkMapfile := fmt.Sprintf("%s/var/db/api/map/%s-%s", workdir, Cid, InstanceId)
-	if _, err := os.Stat(checkMapfile); os.IsNotExist(err) {
-		fmt.Printf("status: no such %s/%s/vms - check K8S...\n", *dbDir, Cid)
-		// check K8S dir
-		checkMapfile = fmt.Sprintf("%s/var/db/k8s/map/%s-%s", workdir, Cid, InstanceId)
-		if _, err := os.Stat(checkMapfile); os.IsNotExist(err) {
-			JSONError(w, "not found", http.StatusOK)
-			return
-		} else {
-			fmt.Printf("%s found - its K8S\n", checkMapfile)
-			// K8S instance
-			vmType = 1
-			mapfile = checkMapfile
-		}
-	} else {
-		//VM/jail instance
-		fmt.Printf("%s/%s/vms found - its not K8S\n", *dbDir, Cid)
-		vmType = 0
-		mapfile = checkMapfile
+	if !isPermitted(feeds, Cid, permRead) {
+		JSONError(w, ErrPermission.Error(), http.StatusForbidden)
+		return
 	}
 
-	b, err := ioutil.ReadFile(mapfile) // just pass the file name
+	inst, err := store.GetInstance(Cid, InstanceId)
 	if err != nil {
-		fmt.Printf("unable to read jname from: [%s]/var/db/api/map/%s-%s\n", mapfile)
-		JSONError(w, "not found", http.StatusOK)
+		fmt.Printf("status: no such instance %s/%s\n", Cid, InstanceId)
+		JSONError(w, "not found", http.StatusNotFound)
 		return
 	}
 
-	var SqliteDBPath string
-
-	if ( vmType == 1 ) {
-		SqliteDBPath = fmt.Sprintf("%s/%s/%s-vm.ssh", *k8sDbDir, Cid, string(b))
-	} else {
-		SqliteDBPath = fmt.Sprintf("%s/%s/%s-vm.ssh", *dbDir, Cid, string(b))
+	// command is not yet accepted by the broker
+	if e := outbox.Pending(Cid, InstanceId); e != nil {
+		writeJSON(w, e.status())
+		return
 	}
 
-	if fileExists(SqliteDBPath) {
-		b, err := ioutil.ReadFile(SqliteDBPath) // just pass the file name
-		if err != nil {
-			JSONError(w, "", 400)
-			return
-		} else {
-			// already in json - send as-is
-			w.Header().Set("Content-Type", "application/json; charset=utf-8")
-			w.Header().Set("X-Content-Type-Options", "nosniff")
-			w.WriteHeader(200)
-			http.Error(w, string(b), 200)
-			return
-		}
-	} else {
+	// fields added by CBSD scripts into <jname>-vm.ssh with the status
+	// of the store over them, see mergedStatus
+	status := mergedStatus(inst)
+	if len(status) == 0 {
 		JSONError(w, "", http.StatusOK)
+		return
 	}
+	writeJSON(w, status)
 }
 
 func (feeds *MyFeeds) HandleK8sClusterStatus(w http.ResponseWriter, r *http.Request) {
@@ -530,60 +545,47 @@ func (feeds *MyFeeds) HandleK8sClusterStatus(w http.ResponseWriter, r *http.Requ
 
 	InstanceId = params["InstanceId"]
 	if !validateInstanceId(InstanceId) {
-		JSONError(w, "The InstanceId should be valid form: ^[a-z_]([a-z0-9_])*$ (maxlen: 40)", http.StatusMethodNotAllowed)
+		JSONError(w, "The InstanceId should be valid form: ^[a-z_]([a-z0-9_])*$ (maxlen: 40)", http.StatusBadRequest)
 		return
 	}
 
 	Cid := r.Header.Get("cid")
 	if !validateCid(Cid) {
-		JSONError(w, "The cid should be valid form: ^[a-f0-9]{32}$", http.StatusMethodNotAllowed)
+		JSONError(w, "The cid should be valid form: ^[a-f0-9]{32}$", http.StatusUnauthorized)
 		return
 	}
 
 	if !isCidAllowed(feeds, Cid) {
 		fmt.Printf("CID not in ACL: %s\n", Cid)
-		JSONError(w, "not allowed", http.StatusMethodNotAllowed)
+		JSONError(w, "not allowed", http.StatusForbidden)
 		return
 	}
 
-	HomePath := fmt.Sprintf("%s/%s/vms", *k8sDbDir, Cid)
-	if _, err := os.Stat(HomePath); os.IsNotExist(err) {
-		JSONError(w, "not found", http.StatusOK)
+	if !isPermitted(feeds, Cid, permRead) {
+		JSONError(w, ErrPermission.Error(), http.StatusForbidden)
 		return
 	}
 
-	mapfile := fmt.Sprintf("%s/var/db/k8s/map/%s-%s", workdir, Cid, InstanceId)
-
-	if !fileExists(config.Recomendation) {
-		fmt.Printf("no such map file %s/var/db/k8s/map/%s-%s\n", workdir, Cid, InstanceId)
-		JSONError(w, "not found", http.StatusOK)
+	inst, err := store.GetInstance(Cid, InstanceId)
+	if err != nil || inst.Kind != KindK8s {
+		fmt.Printf("no such cluster %s/%s\n", Cid, InstanceId)
+		JSONError(w, "not found", http.StatusNotFound)
 		return
 	}
 
-	b, err := ioutil.ReadFile(mapfile) // just pass the file name
-	if err != nil {
-		fmt.Printf("unable to read jname from %s/var/db/k8s/map/%s-%s\n", workdir, Cid, InstanceId)
-		JSONError(w, "not found", http.StatusOK)
+	if e := outbox.Pending(Cid, InstanceId); e != nil {
+		writeJSON(w, e.status())
 		return
 	}
 
-	SqliteDBPath := fmt.Sprintf("%s/%s/%s-vm.ssh", *k8sDbDir, Cid, string(b))
-	if fileExists(SqliteDBPath) {
-		b, err := ioutil.ReadFile(SqliteDBPath) // just pass the file name
-		if err != nil {
-			JSONError(w, "", 400)
-			return
-		} else {
-			// already in json - send as-is
-			w.Header().Set("Content-Type", "application/json; charset=utf-8")
-			w.Header().Set("X-Content-Type-Options", "nosniff")
-			w.WriteHeader(200)
-			http.Error(w, string(b), 200)
-			return
-		}
-	} else {
+	// fields added by CBSD scripts into <jname>-vm.ssh with the status
+	// of the store over them, see mergedStatus
+	status := mergedStatus(inst)
+	if len(status) == 0 {
 		JSONError(w, "", http.StatusOK)
+		return
 	}
+	writeJSON(w, status)
 }
 
 func (feeds *MyFeeds) HandleClusterKubeConfig(w http.ResponseWriter, r *http.Request) {
@@ -592,52 +594,49 @@ func (feeds *MyFeeds) HandleClusterKubeConfig(w http.ResponseWriter, r *http.Req
 
 	InstanceId = params["InstanceId"]
 	if !validateInstanceId(InstanceId) {
-		JSONError(w, "The InstanceId should be valid form: ^[a-z_]([a-z0-9_])*$ (maxlen: 40)", http.StatusMethodNotAllowed)
+		JSONError(w, "The InstanceId should be valid form: ^[a-z_]([a-z0-9_])*$ (maxlen: 40)", http.StatusBadRequest)
 		return
 	}
 
 	Cid := r.Header.Get("cid")
 	if !validateCid(Cid) {
-		JSONError(w, "The cid should be valid form: ^[a-f0-9]{32}$", http.StatusMethodNotAllowed)
+		JSONError(w, "The cid should be valid form: ^[a-f0-9]{32}$", http.StatusUnauthorized)
 		return
 	}
 
 	if !isCidAllowed(feeds, Cid) {
 		fmt.Printf("CID not in ACL: %s\n", Cid)
-		JSONError(w, "not allowed", http.StatusMethodNotAllowed)
+		JSONError(w, "not allowed", http.StatusForbidden)
 		return
 	}
 
-	VmPath := fmt.Sprintf("%s/%s/cluster-%s", *k8sDbDir, Cid, InstanceId)
-
-	if !fileExists(VmPath) {
-		fmt.Printf("ClusterKubeConfig: Error read vmpath file  [%s]\n", VmPath)
-		JSONError(w, "", 400)
+	if !isPermitted(feeds, Cid, permKubeconfig) {
+		JSONError(w, ErrPermission.Error(), http.StatusForbidden)
 		return
 	}
 
-	b, err := ioutil.ReadFile(VmPath) // just pass the file name
-	if err != nil {
-		fmt.Printf("Error read vmpath file  [%s]\n", VmPath)
-		JSONError(w, "", 400)
+	inst, err := store.GetInstance(Cid, InstanceId)
+	if err != nil || inst.Kind != KindK8s {
+		fmt.Printf("ClusterKubeConfig: no such cluster %s/%s\n", Cid, InstanceId)
+		JSONErrorLegacy(w, "not found", http.StatusNotFound, 400)
 		return
 	} else {
-		kubeFile := fmt.Sprintf("%s/var/db/k8s/%s.kubeconfig", workdir, string(b))
+		kubeFile := fmt.Sprintf("%s/var/db/k8s/%s.kubeconfig", workdir, inst.Jname)
 		if fileExists(kubeFile) {
 			b, err := ioutil.ReadFile(kubeFile) // just pass the file name
 			if err != nil {
 				fmt.Printf("unable to read content %s\n", kubeFile)
-				JSONError(w, "", http.StatusOK)
+				JSONErrorLegacy(w, "", http.StatusInternalServerError, http.StatusOK)
 				return
 			}
 			w.Header().Set("Content-Type", "text/plain")
 			w.Header().Set("X-Content-Type-Options", "nosniff")
 			w.WriteHeader(200)
-			http.Error(w, string(b), 200)
+			w.Write(b)
 			return
 		} else {
 			fmt.Printf("Error read kubeconfig  [%s]\n", kubeFile)
-			JSONError(w, "", 400)
+			JSONErrorLegacy(w, "kubeconfig not ready", http.StatusNotFound, 400)
 			return
 		}
 	}
@@ -646,83 +645,54 @@ func (feeds *MyFeeds) HandleClusterKubeConfig(w http.ResponseWriter, r *http.Req
 func (feeds *MyFeeds) HandleClusterCluster(w http.ResponseWriter, r *http.Request) {
 	Cid := r.Header.Get("cid")
 	if !validateCid(Cid) {
-		JSONError(w, "The cid should be valid form: ^[a-f0-9]{32}$", http.StatusMethodNotAllowed)
+		JSONError(w, "The cid should be valid form: ^[a-f0-9]{32}$", http.StatusUnauthorized)
 		return
 	}
 
 	if !isCidAllowed(feeds, Cid) {
 		fmt.Printf("CID not in ACL: %s\n", Cid)
-		JSONError(w, "not allowed", http.StatusMethodNotAllowed)
+		JSONError(w, "not allowed", http.StatusForbidden)
 		return
 	}
 
-	HomePath := fmt.Sprintf("%s/%s/vms", *dbDir, Cid)
-	//fmt.Println("CID IS: [ %s ]", cid)
-	
-	if _, err := os.Stat(HomePath); os.IsNotExist(err) {
-		JSONError(w, "", http.StatusOK)
+	if !isPermitted(feeds, Cid, permRead) {
+		JSONError(w, ErrPermission.Error(), http.StatusForbidden)
 		return
 	}
 
-	SqliteDBPath := fmt.Sprintf("%s/%s/vm.list", *dbDir, Cid)
-	if fileExists(SqliteDBPath) {
-		b, err := ioutil.ReadFile(SqliteDBPath) // just pass the file name
-		if err != nil {
-			JSONError(w, "", http.StatusOK)
-			return
-		} else {
-			// already in json - send as-is
-			w.Header().Set("Content-Type", "application/json; charset=utf-8")
-			w.Header().Set("X-Content-Type-Options", "nosniff")
-			w.WriteHeader(200)
-			http.Error(w, string(b), 200)
-			return
-		}
-	} else {
-		JSONError(w, "", http.StatusOK)
+	list, err := clusterList(store, Cid, KindVm)
+	if err != nil {
+		JSONError(w, "", http.StatusInternalServerError)
 		return
 	}
+	writeJSON(w, list)
 }
 
-// read /var/db/cbsd-k8s/<cid>/vms/vm.list
+// K8S clusters of cid, see clusterList
 func (feeds *MyFeeds) HandleK8sClusterCluster(w http.ResponseWriter, r *http.Request) {
 	Cid := r.Header.Get("cid")
 	if !validateCid(Cid) {
-		JSONError(w, "The cid should be valid form: ^[a-f0-9]{32}$", http.StatusMethodNotAllowed)
+		JSONError(w, "The cid should be valid form: ^[a-f0-9]{32}$", http.StatusUnauthorized)
 		return
 	}
 
 	if !isCidAllowed(feeds, Cid) {
 		fmt.Printf("CID not in ACL: %s\n", Cid)
-		JSONError(w, "not allowed", http.StatusMethodNotAllowed)
+		JSONError(w, "not allowed", http.StatusForbidden)
 		return
 	}
 
-	HomePath := fmt.Sprintf("%s/%s/vms", *k8sDbDir, Cid)
-	//fmt.Println("CID IS: [ %s ]", cid)
-	if _, err := os.Stat(HomePath); os.IsNotExist(err) {
-		JSONError(w, "", http.StatusOK)
+	if !isPermitted(feeds, Cid, permRead) {
+		JSONError(w, ErrPermission.Error(), http.StatusForbidden)
 		return
 	}
 
-	SqliteDBPath := fmt.Sprintf("%s/%s/vm.list", *k8sDbDir, Cid)
-	if fileExists(SqliteDBPath) {
-		b, err := ioutil.ReadFile(SqliteDBPath) // just pass the file name
-		if err != nil {
-			JSONError(w, "", http.StatusOK)
-			return
-		} else {
-			// already in json - send as-is
-			w.Header().Set("Content-Type", "application/json; charset=utf-8")
-			w.Header().Set("X-Content-Type-Options", "nosniff")
-			w.WriteHeader(200)
-			http.Error(w, string(b), 200)
-			return
-		}
-	} else {
-		JSONError(w, "", http.StatusOK)
+	list, err := clusterList(store, Cid, KindK8s)
+	if err != nil {
+		JSONError(w, "", http.StatusInternalServerError)
 		return
 	}
+	writeJSON(w, list)
 }
 
 func HandleClusterImages(w http.ResponseWriter, r *http.Request) {
@@ -737,7 +707,7 @@ func HandleClusterImages(w http.ResponseWriter, r *http.Request) {
 			w.Header().Set("Content-Type", "application/json; charset=utf-8")
 			w.Header().Set("X-Content-Type-Options", "nosniff")
 			w.WriteHeader(200)
-			http.Error(w, string(b), 200)
+			w.Write(b)
 			return
 		}
 	} else {
@@ -758,7 +728,7 @@ func HandleClusterFlavors(w http.ResponseWriter, r *http.Request) {
 			w.Header().Set("Content-Type", "application/json; charset=utf-8")
 			w.Header().Set("X-Content-Type-Options", "nosniff")
 			w.WriteHeader(200)
-			http.Error(w, string(b), 200)
+			w.Write(b)
 			return
 		}
 	} else {
@@ -767,56 +737,57 @@ func HandleClusterFlavors(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func realInstanceCreate(body string) {
-
-	a := &body
-
-	stdout, err := beanstalkSend(config.BeanstalkConfig, *a)
-	fmt.Printf("%s\n", stdout)
-
-	if err != nil {
-		return
-	}
-}
-
 func getStructTag(f reflect.StructField) string {
 	return string(f.Tag)
 }
 
-func getNodeRecomendation(body string, offer string) {
-	// offer - recomendation host from user, we can check them in external helper
-	// for valid/resource
+// getNodeRecomendation returns the node selected for reserved inst with its
+// tube and reply tube, inst is stored with the node. offer is the recomendation
+// field of payload: node or label rules, args are passed to the recomendation script.
+func getNodeRecomendation(args string, offer string, inst *Instance) (string, string, string, error) {
+	rule, err := parsePlacement(offer)
+	if err != nil {
+		return "", "", "", err
+	}
 
 	var result string
 
-	if len(offer) > 1 {
-		result = offer
+	strategy := placementStrategy()
+	switch {
+	case strategy == placementScript && len(rule.node) > 0 && len(rule.affinity) == 0 && len(rule.anti) == 0:
+		result = rule.node
 		fmt.Printf("FORCED Host Recomendation: [%s]\n", result)
-	} else {
-		cmdStr := fmt.Sprintf("%s %s", config.Recomendation, body)
-		cmdArgs := strings.Fields(cmdStr)
-		cmd := exec.Command(cmdArgs[0], cmdArgs[1:len(cmdArgs)]...)
-		out, err := cmd.CombinedOutput()
-		if err != nil {
-			fmt.Println("get recomendation script failed")
-			return
+		err = checkSchedulable(result)
+	case strategy == placementScript:
+		result, err = scriptNode(args)
+	default:
+		// held until inst is stored with the node: concurrent placements
+		// count it in nodeUsage
+		placementMu.Lock()
+		defer placementMu.Unlock()
+		result, err = placeNode(rule, inst.Resources, strategy)
+		if errors.Is(err, ErrNoNode) && config.PlacementFallback {
+			fmt.Printf("placement: %s, fallback to script\n", err.Error())
+			result, err = scriptNode(args)
 		}
-		result = (string(out))
+	}
+	if err != nil {
+		return "", "", "", err
 	}
 
 	fmt.Printf("Host Recomendation: [%s]\n", result)
 
-	result = strings.Replace(result, ".", "_", -1)
-	result = strings.Replace(result, "-", "_", -1)
+	inst.Node = result
+	if err := store.PutInstance(inst); err != nil {
+		return "", "", "", err
+	}
 
-	tube := fmt.Sprintf("cbsd_%s", result)
-	reply := fmt.Sprintf("cbsd_%s_result_id", result)
+	tube, reply := nodeTubes(result)
 
 	fmt.Printf("Tube selected: [%s]\n", tube)
 	fmt.Printf("ReplyTube selected: [%s]\n", reply)
 
-	config.BeanstalkConfig.Tube = tube
-	config.BeanstalkConfig.ReplyTubePrefix = reply
+	return result, tube, reply, nil
 }
 
 func applyIac(env string, yaml string) {
@@ -874,274 +845,94 @@ func getId(cid string) string {
 //func (feeds *MyFeeds) 
 
 //func HandleCreateVm(w http.ResponseWriter, r *http.Request ) {
-func HandleCreateVm(w http.ResponseWriter, vm Vm) {
-
-	var regexpPkgList = regexp.MustCompile(`^[aA-zZ_]([aA-zZ0-9_\-/ ])*$`)
-	var regexpExtras = regexp.MustCompile("^[a-zA-Z0-9:,]*$")
-	var regexpSize = regexp.MustCompile(`^[1-9](([0-9]+)?)([m|g|t])$`)
-	var regexpParamName = regexp.MustCompile(`^[a-z_]+$`)
-	var regexpParamVal = regexp.MustCompile(`^[aA-zZ0-9_\-. ]+$`)
-	var regexpHostName = regexp.MustCompile(`^[aA-zZ0-9_\-\.]+$`)
+func HandleCreateVm(w http.ResponseWriter, r *http.Request, vm Vm, runscript string, cid string, quota Quota) {
+
 	var suggest string
 	var InstanceId string
 
 	InstanceId = vm.Jname
 
-	uid := []byte(vm.Pubkey)
-
-	//existance?
-	// check for existance
-	cid := md5.Sum(uid)
-
-	VmPathDir := fmt.Sprintf("%s/%x", *dbDir, cid)
+	VmPathDir := fmt.Sprintf("%s/%s", *dbDir, cid)
 
 	if !fileExists(VmPathDir) {
 		os.Mkdir(VmPathDir, 0775)
 	}
 
-	VmPath := fmt.Sprintf("%s/%x/vm-%s", *dbDir, cid, InstanceId)
-
-	if fileExists(VmPath) {
-		fmt.Printf("Error: vm already exist: [%s]\n", VmPath)
-		JSONError(w, "vm already exist", http.StatusMethodNotAllowed)
-		return
-	}
-
-	fmt.Printf("vm file not exist, create empty: [%s]\n", VmPath)
-	// create empty file
-	f, err := os.Create(VmPath)
-
+	// released on any error below
+	res, err := reserveInstance(cid, InstanceId, KindVm)
 	if err != nil {
-		log.Fatal(err)
-	}
-
-	if len(vm.PkgList) > 1 {
-		if !regexpPkgList.MatchString(vm.PkgList) {
-			fmt.Printf("Error: wrong pkglist: [%s]\n", vm.PkgList)
-			JSONError(w, "pkglist should be valid form. valid form", http.StatusMethodNotAllowed)
-			return
-		}
-	}
-
-	if len(vm.Host_hostname) > 1 {
-		if !regexpHostName.MatchString(vm.Host_hostname) {
-			fmt.Printf("Error: wrong hostname: [%s]\n", vm.Host_hostname)
-			JSONError(w, "host_hostname should be valid form. valid form", http.StatusMethodNotAllowed)
-			return
-		} else {
-			fmt.Printf("Found host_hostname: [%s]\n", vm.Host_hostname)
-		}
+		fmt.Printf("Error: vm already exist: [%s/%s]: %s\n", cid, InstanceId, err.Error())
+		JSONError(w, "vm already exist", http.StatusConflict)
+		return
 	}
+	defer res.Release()
 
-	if len(vm.Extras) > 1 {
-		if !regexpExtras.MatchString(vm.Extras) {
-			fmt.Printf("Error: wrong extras: [%s]\n", vm.Extras)
-			JSONError(w, "extras should be valid form. valid form", http.StatusMethodNotAllowed)
-			return
+	if code, err := reserveQuota(res, vmResources(vm), quota); err != nil {
+		fmt.Printf("Error: vm %s/%s: %s\n", cid, InstanceId, err.Error())
+		if errors.Is(err, ErrQuota) {
+			JSONErrorCode(w, err.Error(), code, errCodeQuota)
 		} else {
-			fmt.Printf("Found extras: [%s]\n", vm.Extras)
+			JSONError(w, err.Error(), code)
 		}
+		return
 	}
 
+	// payload is validated by createSchemas
 	if len(vm.Recomendation) > 1 {
-		if !regexpHostName.MatchString(vm.Recomendation) {
-			fmt.Printf("Error: wrong hostname recomendation: [%s]\n", vm.Recomendation)
-			JSONError(w, "recomendation should be valid form. valid form", http.StatusMethodNotAllowed)
-			return
-		} else {
-			fmt.Printf("Found vm recomendation: [%s]\n", vm.Recomendation)
-			suggest = vm.Recomendation
-		}
-	} else {
-		suggest = ""
-	}
-
-	if vm.Cpus <= 0 || vm.Cpus > 16 {
-		JSONError(w, "cpus valid range: 1-16", http.StatusMethodNotAllowed)
-		return
+		fmt.Printf("Found vm recomendation: [%s]\n", vm.Recomendation)
+		suggest = vm.Recomendation
 	}
 
-	if len(vm.Ram) > 0 {
-		if !regexpSize.MatchString(vm.Ram) {
-			JSONError(w, "The ram should be valid form, 512m, 1g", http.StatusMethodNotAllowed)
-			return
-		}
-	} else {
+	if len(vm.Ram) == 0 {
 		// unlimited for jail
 		vm.Ram = "0"
 	}
 
-	switch vm.Image {
-		case "jail":
-			//Imgsize optional for jail type
-			if len(vm.Imgsize) > 0 {
-				if !regexpSize.MatchString(vm.Imgsize) {
-					fmt.Printf("wrong imgsize: [%s] [%d]\n", vm.Imgsize, vm.Imgsize)
-					JSONError(w, "The imgsize should be valid form: 2g, 30g", http.StatusMethodNotAllowed)
-					return
-				}
-			}
-		default:
-			if !regexpSize.MatchString(vm.Imgsize) {
-				fmt.Printf("wrong imgsize: [%s] [%d]\n", vm.Imgsize, vm.Imgsize)
-				JSONError(w, "The imgsize should be valid form: 2g, 30g", http.StatusMethodNotAllowed)
-				return
-			}
-	}
-
-	Jname := getJname()
+	Jname := strings.TrimSpace(getJname())
 	if len(Jname) < 1 {
-		log.Fatal("unable to get jname")
+		fmt.Println("unable to get jname")
+		JSONError(w, "unable to get jname", http.StatusInternalServerError)
 		return
 	}
 
 	fmt.Printf("GET NEXT FREE JNAME: [%s]\n", Jname)
 
-	_, err2 := f.WriteString(Jname)
-
-	if err2 != nil {
-		log.Fatal(err2)
-	}
-
-	f.Close()
-
 	vm.Jname = InstanceId
-	val := reflect.ValueOf(vm)
-
-	var jconf_param string
-	var str strings.Builder
-	var recomendation strings.Builder
-	// of course we can use marshal here instead of string concatenation,
-	// but now this is too simple case/data without any processing
-	str.WriteString("{\"Command\":\"")
-	str.WriteString(runscript)
-	str.WriteString("\",\"CommandArgs\":{\"mode\":\"create\",\"jname\":\"")
-	str.WriteString(Jname)
-	str.WriteString("\"")
-	str.WriteString(", \"emulator\":\"")
-	str.WriteString(vm_Engine)
-	str.WriteString("\"")
-
-	// todo: filter for insecured param=val
-	for i := 0; i < val.NumField(); i++ {
-		valueField := val.Field(i)
-
-		typeField := val.Type().Field(i)
-		tag := typeField.Tag
-
-		tmpval := fmt.Sprintf("%s", valueField.Interface())
-//		fmt.Printf("param %s valtype: %s\n",tmpval, val.Type)
-
-		if len(tmpval) == 0 {
-			continue
-		}
-		if len(tmpval) > 1000 {
-			fmt.Printf("Error: param val too long\n")
-			continue
-		}
-
-		fmt.Printf("[%s]\n", valueField)
-
-		if len(typeField.Name) > 30 {
-			fmt.Printf("Error: param name too long\n")
-			continue
-		}
-
-		jconf_param = strings.ToLower(typeField.Name)
-
-		if strings.Compare(jconf_param, "jname") == 0 {
-			continue
-		}
-
-		if !regexpParamName.MatchString(jconf_param) {
-			fmt.Printf("Error: wrong paramname: [%s]\n", jconf_param)
-			continue
-		} else {
-			fmt.Printf("paramname test passed: [%s]\n", jconf_param)
-		}
-
-		// validate unknown data values
-		switch jconf_param {
-			case "vm_os_type":
-			case "vm_os_profile":
-			case "type":
-			case "imgsize":
-			case "ram":
-			case "cpus":
-			case "pkglist":
-			case "pubkey":
-			case "host_hostname":
-			default:
-				if !regexpParamVal.MatchString(tmpval) {
-					fmt.Printf("Error: wrong paramval for %s: [%s]\n", jconf_param, tmpval)
-					continue
-				}
-		}
-
-		fmt.Printf("jconf: %s,\tField Name: %s,\t Field Value: %v,\t Tag Value: %s\n", jconf_param, typeField.Name, valueField.Interface(), tag.Get("tag_name"))
-
-		var buf string
-
-		if strings.Compare(jconf_param, "cpus") == 0 {
-			// https://stackoverflow.com/questions/18041334/convert-interface-to-int
-			cpus := valueField.Interface().(int)
-			buf = fmt.Sprintf(",\"%s\": \"%d\"", jconf_param, cpus)
-		} else {
-			buf = fmt.Sprintf(",\"%s\": \"%s\"", jconf_param, tmpval)
-		}
-
-		buf2 := fmt.Sprintf("%s ", tmpval)
-		str.WriteString(buf)
-		recomendation.WriteString(buf2)
-	}
-
-	str.WriteString(",\"host_hostname\": \"")
-
-	if len(vm.Host_hostname) > 1 {
-		str.WriteString(vm.Host_hostname)
-	} else {
-		str.WriteString(InstanceId)
+	comment, recomendation := vmCreateComment(vm, runscript, Jname)
+	body, err := commandBody(comment)
+	if err != nil {
+		fmt.Printf("unable to encode command: %s\n", err.Error())
+		JSONError(w, "", http.StatusInternalServerError)
+		return
 	}
 
-	str.WriteString("\"}}")
-	fmt.Printf("CMD: [%s]\n", str.String())
-	response := fmt.Sprintf("{ \"id\": \"%s\", \"cluster\": \"curl -H cid:%x %s/api/v1/cluster\", \"status\": \"curl -H cid:%x %s/api/v1/status/%s\", \"start\": \"curl -H cid:%x %s/api/v1/start/%s\", \"stop\": \"curl -H cid:%x %s/api/v1/stop/%s\", \"destroy\": \"curl -H cid:%x %s/api/v1/destroy/%s\" }", InstanceId, cid, server_url, cid, server_url, InstanceId, cid, server_url, InstanceId, cid, server_url, InstanceId, cid, server_url, InstanceId)
-
+	_, tube, reply, err := getNodeRecomendation(recomendation, suggest, res.inst)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusMethodNotAllowed)
+		fmt.Printf("Error: placement of %s/%s: %s\n", cid, InstanceId, err.Error())
+		JSONError(w, err.Error(), http.StatusServiceUnavailable)
 		return
 	}
 
-	SqliteDBPath := fmt.Sprintf("%s/%x/%s-vm.ssh", *dbDir, cid, Jname)
-	fmt.Printf("[debug] Create empty/mock status file: [%s]\n", SqliteDBPath)
+	// empty/mock status
+	inst := res.inst
+	inst.Jname = Jname
+	inst.Status = []byte(fmt.Sprintf("{\n  \"id\": \"%s\",\n  \"is_power_on\": \"false\",\n  \"status\": \"pending\",\n  \"progress\": 0\n}\n", InstanceId))
 
-	tfile, fileErr := os.Create(SqliteDBPath)
-	if fileErr != nil {
-		fmt.Println(fileErr)
+	if err := store.PutInstance(inst); err != nil {
+		fmt.Printf("Error: unable to store vm %s/%s: %s\n", inst.Cid, InstanceId, err.Error())
+		JSONError(w, "", http.StatusInternalServerError)
 		return
 	}
-	fmt.Fprintf(tfile, "{\n  \"id\": \"%s\",\n  \"is_power_on\": \"false\",\n  \"status\": \"pending\",\n  \"progress\": 0\n}\n", InstanceId)
-	tfile.Close()
-
-	getNodeRecomendation(recomendation.String(), suggest)
-
-	// error code
-	go realInstanceCreate(str.String())
-
-	mapfile := fmt.Sprintf("%s/var/db/api/map/%x-%s", workdir, cid, InstanceId)
-	m, err := os.Create(mapfile)
+	addTenant(inst.Cid, vm.Pubkey)
 
+	jobId, err := realInstanceCreate(r.Context(), Dispatch{Tube: tube, ReplyTubePrefix: reply, Body: body}, Job{Command: "create", Instance: InstanceId, Cid: inst.Cid})
 	if err != nil {
-		log.Fatal(err)
-	}
-
-	_, err3 := m.WriteString(Jname)
-
-	if err3 != nil {
-		log.Fatal(err3)
+		JSONError(w, "broker unavailable", brokerStatus(err))
+		return
 	}
+	res.Commit()
 
-	m.Close()
+	response := fmt.Sprintf("{ \"id\": \"%s\", \"cluster\": %s, \"status\": %s, \"start\": %s, \"stop\": %s, \"destroy\": %s, \"job\": %d }", InstanceId, curlHint(cid, "/api/v1/cluster"), curlHint(cid, "/api/v1/status/"+InstanceId), curlHint(cid, "/api/v1/start/"+InstanceId), curlHint(cid, "/api/v1/stop/"+InstanceId), curlHint(cid, "/api/v1/destroy/"+InstanceId), jobId)
 
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
 	w.Header().Set("X-Content-Type-Options", "nosniff")
@@ -1158,21 +949,16 @@ func (feeds *MyFeeds) HandleClusterCreate(w http.ResponseWriter, r *http.Request
 	var InstanceId string
 	params := mux.Vars(r)
 
-	var regexpVmOsType = regexp.MustCompile(`^[a-z_]+$`)
-//	var regexpVmOsProfile = regexp.MustCompile(`^[aA-zZ0-9_\-\.]+$`)
-
 	fmt.Println("create wakeup")
 
 	InstanceId = params["InstanceId"]
 	if !validateInstanceId(InstanceId) {
-		JSONError(w, "The InstanceId should be valid form: ^[a-z_]([a-z0-9_])*$ (maxlen: 40)", http.StatusMethodNotAllowed)
+		JSONError(w, "The InstanceId should be valid form: ^[a-z_]([a-z0-9_])*$ (maxlen: 40)", http.StatusBadRequest)
 		return
 	}
 
-	var regexpPubkey = regexp.MustCompile("^(ssh-rsa|ssh-dss|ssh-ed25519|ecdsa-[^ ]+) ([^ ]+) ?(.*)")
-
 	if r.Body == nil {
-		JSONError(w, "please send a request body", http.StatusMethodNotAllowed)
+		JSONError(w, "please send a request body", http.StatusBadRequest)
 		return
 	}
 
@@ -1188,40 +974,46 @@ func (feeds *MyFeeds) HandleClusterCreate(w http.ResponseWriter, r *http.Request
 		return
 	}
 
-	if err := json.Unmarshal(body, &vm); err != nil {
+	kind, errs, err := validateCreate(body)
+	if err != nil {
 		errMsg := fmt.Sprintf("unmarsahal  error: %v", err)
-		JSONError(w, errMsg, http.StatusMethodNotAllowed)
-		log.Printf("unmarsahal to &vm error %v", err)
+		JSONError(w, errMsg, http.StatusBadRequest)
+		log.Printf("unmarsahal payload error %v", err)
 		return
 	}
 
-	switch vm.Vm_os_type {
-		case "":
-		default:
-			if !regexpVmOsType.MatchString(vm.Vm_os_type) {
-//				JSONError(w, "The Vm_os_type should be valid form: ^[aA-zZ0-9_\-\.]*$ (maxlen: 40)", http.StatusMethodNotAllowed)
-				JSONError(w, "The Vm_os_type should be valid form: ^[aA-zZ0-9_-.]*$ (maxlen: 40)", http.StatusMethodNotAllowed)
-				fmt.Printf("Error: Vm_os_type paramname: [%s]\n", vm.Vm_os_type)
-				return
-			} else {
-				fmt.Printf("paramname test passed: [%s]\n", vm.Vm_os_type)
-			}
+	if len(errs) > 0 {
+		fmt.Printf("Error: invalid %s payload: %v\n", kind, errs)
+		ValidationError(w, errs)
+		return
+	}
+
+	var cluster Cluster
 
-			fmt.Printf("VM VM_OS_TYPE set: [%s]\n", vm.Vm_os_type)
-			vm.Image=*vmEngine
+	switch kind {
+	case "k8s":
+		// defaults when not set
+		cluster.Pv_enable = 1
+		cluster.Kubelet_master = 1
+		err = decodeStrict(body, &cluster)
+		vm.Image = cluster.Image
+		vm.Pubkey = cluster.Pubkey
+	default:
+		err = decodeStrict(body, &vm)
 	}
-	switch vm.Vm_os_profile {
-		case "":
-		default:
-			fmt.Printf("VM VM_OS_PROFILE set: [%s]\n", vm.Vm_os_profile)
-			vm.Image=*vmEngine
+	if err != nil {
+		errMsg := fmt.Sprintf("unmarsahal  error: %v", err)
+		JSONError(w, errMsg, http.StatusBadRequest)
+		log.Printf("unmarsahal to &%s error %v", kind, err)
+		return
+	}
+
+	if len(vm.Vm_os_type) > 0 || len(vm.Vm_os_profile) > 0 {
+		fmt.Printf("VM VM_OS_TYPE/VM_OS_PROFILE set: [%s/%s]\n", vm.Vm_os_type, vm.Vm_os_profile)
+		vm.Image = *vmEngine
 	}
 
 	switch vm.Image {
-	case "":
-		fmt.Println("Empty image field")
-		JSONError(w, "Empty image field", http.StatusMethodNotAllowed)
-		return
 	case "jail":
 		fmt.Printf("JAIL TYPE by img: [%s]\n", vm.Image)
 	case "k8s":
@@ -1230,42 +1022,46 @@ func (feeds *MyFeeds) HandleClusterCreate(w http.ResponseWriter, r *http.Request
 		fmt.Printf("VM TYPE by img: [%s]\n", vm.Image)
 	}
 
-	if len(vm.Pubkey) < 30 {
-		fmt.Printf("Error: Pubkey too small: [%s]\n",vm.Pubkey)
-		JSONError(w, "Pubkey too small", http.StatusMethodNotAllowed)
+	parsedKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(vm.Pubkey))
+	if err != nil {
+		fmt.Printf("Error: ParseAuthorizedKey: %s\n", err.Error())
+		ValidationError(w, []FieldError{{"pubkey", "ParseAuthorizedKey: " + err.Error()}})
 		return
 	}
 
-	if len(vm.Pubkey) > 1000 {
-		fmt.Printf("Error: Pubkey too long\n")
-		JSONError(w, "Pubkey too long", http.StatusMethodNotAllowed)
-		return
-	}
+	fmt.Printf("pubKey: [%x]\n", parsedKey)
+
+	// same key with another comment is the same tenant
+	sCid := tenantCid(parsedKey, vm.Pubkey)
 
-	if !regexpPubkey.MatchString(vm.Pubkey) {
-		fmt.Printf("Error: pubkey should be valid form. valid key: ssh-rsa,ssh-ed25519,ecdsa-*,ssh-dsa XXXXX comment\n")
-		JSONError(w, "pubkey should be valid form. valid key: ssh-rsa,ssh-ed25519,ecdsa-*,ssh-dsa XXXXX comment", http.StatusMethodNotAllowed)
+	if err := verifyCreate(r, body, parsedKey, sCid); err != nil {
+		fmt.Printf("create auth: %s\n", err.Error())
+		JSONError(w, err.Error(), http.StatusUnauthorized)
 		return
 	}
 
-	parsedKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(vm.Pubkey))
-	if err != nil {
-
-		fmt.Printf("Error: ParseAuthorizedKey\n")
-		JSONError(w, "ParseAuthorizedKey", http.StatusMethodNotAllowed)
+	if isSuspended(sCid) {
+		fmt.Printf("CID suspended: %s\n", sCid)
+		JSONError(w, ErrSuspended.Error(), http.StatusForbidden)
 		return
 	}
 
-	fmt.Printf("pubKey: [%x]\n", parsedKey)
-
 	if !isPubKeyAllowed(feeds, vm.Pubkey) {
 		fmt.Printf("Pubkey not in ACL: %s\n", vm.Pubkey)
-		JSONError(w, "not allowed", http.StatusMethodNotAllowed)
+		JSONError(w, "not allowed", http.StatusForbidden)
 		return
 	}
 
-	uid := []byte(vm.Pubkey)
-	Cid := md5.Sum(uid)
+	if code, err := checkCreate(feeds, ssh.FingerprintSHA256(parsedKey), vm.Image); err != nil {
+		fmt.Printf("create %s by %s: %s\n", vm.Image, sCid, err.Error())
+		JSONError(w, err.Error(), code)
+		return
+	}
+
+	quota := defaultQuota()
+	if acl_enable {
+		quota = keyQuota(feeds.feed().byFingerprint[ssh.FingerprintSHA256(parsedKey)])
+	}
 
 //	VmPathDir := fmt.Sprintf("%s/%x", *dbDir, cid)
 
@@ -1277,13 +1073,10 @@ func (feeds *MyFeeds) HandleClusterCreate(w http.ResponseWriter, r *http.Request
 
 	// auto-naming
 	if InstanceId[0] == '_' {
-		//sCid := string(Cid[:])
-		sCid := fmt.Sprintf("%x", Cid)
-
 		InstanceId = getId(sCid)
 		if len(InstanceId) < 1 {
-			fmt.Printf("Unable to get ID for CID: %s\n", sCid, vm.Pubkey)
-			JSONError(w, "Unable to get ID", http.StatusMethodNotAllowed)
+			fmt.Printf("Unable to get ID for CID: %s [%s]\n", sCid, vm.Pubkey)
+			JSONError(w, "Unable to get ID", http.StatusInternalServerError)
 			return
 		}
 
@@ -1293,24 +1086,16 @@ func (feeds *MyFeeds) HandleClusterCreate(w http.ResponseWriter, r *http.Request
 	// route to subfunctim
 	switch vm.Image {
 	case "jail":
-		runscript = *runScriptJail
 		fmt.Printf("JAIL TYPE by img: [%s]\n", vm.Image)
 		vm.Jname = InstanceId
-		HandleCreateVm(w,vm);
+		HandleCreateVm(w, r, vm, *runScriptJail, sCid, quota)
 	case "k8s":
-		runscript = *runScriptK8s
-		var cluster Cluster
-		if err := json.Unmarshal(body, &cluster); err != nil {
-			log.Printf("unmarsahal to &cluster error %v", err)
-			return
-		}
 		cluster.K8s_name = InstanceId
-		HandleCreateK8s(w,cluster);
+		HandleCreateK8s(w, r, cluster, sCid, quota)
 	default:
-		runscript = *runScriptVm
 		fmt.Printf("VM TYPE by img: [%s]\n", vm.Image)
 		vm.Jname = InstanceId
-		HandleCreateVm(w,vm);
+		HandleCreateVm(w, r, vm, *runScriptVm, sCid, quota)
 	}
 
 	return
@@ -1341,12 +1126,12 @@ func (feeds *MyFeeds) HandleIac(w http.ResponseWriter, r *http.Request) {
 
 	InstanceId = params["InstanceId"]
 	if !validateInstanceId(InstanceId) {
-		JSONError(w, "The InstanceId should be valid form: ^[a-z_]([a-z0-9_])*$ (maxlen: 40)", http.StatusMethodNotAllowed)
+		JSONError(w, "The InstanceId should be valid form: ^[a-z_]([a-z0-9_])*$ (maxlen: 40)", http.StatusBadRequest)
 		return
 	}
 
 	if r.Body == nil {
-		JSONError(w, "please send a request body", http.StatusMethodNotAllowed)
+		JSONError(w, "please send a request body", http.StatusBadRequest)
 		return
 	}
 	//If its not multipart, We will expect file data in body.
@@ -1372,7 +1157,7 @@ func (feeds *MyFeeds) HandleIac(w http.ResponseWriter, r *http.Request) {
 */
 
 	if r.Method != "POST" {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		JSONErrorLegacy(w, "Method not allowed", http.StatusMethodNotAllowed, http.StatusMethodNotAllowed)
 		return
 	}
 
@@ -1380,7 +1165,7 @@ func (feeds *MyFeeds) HandleIac(w http.ResponseWriter, r *http.Request) {
 
 	// 32 MB is the default used by FormFile
 	if err := r.ParseMultipartForm(32 << 20); err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		JSONErrorLegacy(w, err.Error(), http.StatusBadRequest, http.StatusBadRequest)
 		return
 	}
 
@@ -1389,13 +1174,13 @@ func (feeds *MyFeeds) HandleIac(w http.ResponseWriter, r *http.Request) {
 
 	for _, fileHeader := range files {
 		if fileHeader.Size > MAX_UPLOAD_SIZE {
-			http.Error(w, fmt.Sprintf("The uploaded image is too big: %s. Please use an image less than 1MB in size", fileHeader.Filename), http.StatusBadRequest)
+			JSONErrorLegacy(w, fmt.Sprintf("The uploaded image is too big: %s. Please use an image less than 1MB in size", fileHeader.Filename), http.StatusBadRequest, http.StatusBadRequest)
 			return
 		}
 
 		file, err := fileHeader.Open()
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			JSONErrorLegacy(w, err.Error(), http.StatusInternalServerError, http.StatusInternalServerError)
 			return
 		}
 
@@ -1406,7 +1191,7 @@ func (feeds *MyFeeds) HandleIac(w http.ResponseWriter, r *http.Request) {
 		_, err = file.Read(buff)
 		if err != nil {
 			log.Println("Error file.Read buff ")
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			JSONErrorLegacy(w, err.Error(), http.StatusInternalServerError, http.StatusInternalServerError)
 			return
 		}
 
@@ -1417,7 +1202,7 @@ func (feeds *MyFeeds) HandleIac(w http.ResponseWriter, r *http.Request) {
 		_, err = file.Seek(0, io.SeekStart)
 		if err != nil {
 		log.Println("Seek error")
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			JSONErrorLegacy(w, err.Error(), http.StatusInternalServerError, http.StatusInternalServerError)
 			return
 		}
 
@@ -1425,7 +1210,7 @@ func (feeds *MyFeeds) HandleIac(w http.ResponseWriter, r *http.Request) {
 			fmt.Printf("* create spool dir: /var/spool/cbsd-mq-api/upload\n")
 			err = os.MkdirAll("/var/spool/cbsd-mq-api/upload", os.ModePerm)
 			if err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
+				JSONErrorLegacy(w, err.Error(), http.StatusInternalServerError, http.StatusInternalServerError)
 				return
 			}
 		}
@@ -1436,7 +1221,7 @@ func (feeds *MyFeeds) HandleIac(w http.ResponseWriter, r *http.Request) {
 	//	f, err := os.Create(fmt.Sprintf("/var/spool/cbsd-mq-api/upload/%d%s.yaml", time.Now().UnixNano(), filepath.Ext(fileHeader.Filename)))
 		f, err := os.Create(fmt.Sprintf("/var/spool/cbsd-mq-api/upload/%s", yaml))
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
+			JSONErrorLegacy(w, err.Error(), http.StatusBadRequest, http.StatusBadRequest)
 			return
 		}
 
@@ -1448,7 +1233,7 @@ func (feeds *MyFeeds) HandleIac(w http.ResponseWriter, r *http.Request) {
 
 		_, err = io.Copy(f, io.TeeReader(file, pr))
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
+			JSONErrorLegacy(w, err.Error(), http.StatusBadRequest, http.StatusBadRequest)
 			return
 		}
 	}
@@ -1461,7 +1246,7 @@ func (feeds *MyFeeds) HandleIac(w http.ResponseWriter, r *http.Request) {
 }
 
 
-func HandleCreateK8s(w http.ResponseWriter, cluster Cluster) {
+func HandleCreateK8s(w http.ResponseWriter, r *http.Request, cluster Cluster, cid string, quota Quota) {
 
 	var InstanceId string
 //	params := mux.Vars(r)
@@ -1475,7 +1260,7 @@ func HandleCreateK8s(w http.ResponseWriter, cluster Cluster) {
 		fd, err := os.Open(ClusterQueuePath)
 		if err != nil {
 			fmt.Printf("unable to read current queue len from %s\n", ClusterQueuePath)
-			JSONError(w, "limits exceeded, please try again later", http.StatusMethodNotAllowed)
+			JSONError(w, "limits exceeded, please try again later", http.StatusTooManyRequests)
 			return
 		}
 		defer fd.Close()
@@ -1485,7 +1270,7 @@ func HandleCreateK8s(w http.ResponseWriter, cluster Cluster) {
 			if err != io.EOF {
 				//log.Fatal(err)
 				fmt.Printf("unable to read jname from %s\n", ClusterQueuePath)
-				JSONError(w, "limits exceeded, please try again later", http.StatusMethodNotAllowed)
+				JSONError(w, "limits exceeded, please try again later", http.StatusTooManyRequests)
 				return
 			}
 		}
@@ -1493,68 +1278,32 @@ func HandleCreateK8s(w http.ResponseWriter, cluster Cluster) {
 		fmt.Printf("Current QUEUE: [%d]\n", CurrentQueue)
 		if CurrentQueue >= clusterLimitMax {
 			fmt.Printf("limits exceeded: (%d max)\n", clusterLimitMax)
-			JSONError(w, "limits exceeded, please try again later", http.StatusMethodNotAllowed)
+			JSONError(w, "limits exceeded, please try again later", http.StatusTooManyRequests)
 			return
 		}
 	}
 
 	if !validateInstanceId(InstanceId) {
-		JSONError(w, "The InstanceId should be valid form: ^[a-z_]([a-z0-9_])*$ (maxlen: 40)", http.StatusMethodNotAllowed)
+		JSONError(w, "The InstanceId should be valid form: ^[a-z_]([a-z0-9_])*$ (maxlen: 40)", http.StatusBadRequest)
 		return
 	}
 
-	var regexpSize = regexp.MustCompile(`^[1-9](([0-9]+)?)([m|g|t])$`)
-	var regexpEmail = regexp.MustCompile("^[a-zA-Z0-9.!#$%&'*+/=?^_`{|}~-]+@[a-zA-Z0-9](?:[a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?(?:\\.[a-zA-Z0-9](?:[a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?)*$")
-	var regexpCallback = regexp.MustCompile(`^(http|https)://`)
-	var regexpPubkey = regexp.MustCompile("^(ssh-rsa|ssh-dss|ssh-ed25519|ecdsa-[^ ]+) ([^ ]+) ?(.*)")
-	var regexpParamName = regexp.MustCompile(`^[a-z_]+$`)
-	var regexpParamVal = regexp.MustCompile(`^[aA-zZ0-9_\-. ]+$`)
-	var regexpHostName = regexp.MustCompile(`^[aA-zZ0-9_\-\.]+$`)
 
 	fmt.Println("create wakeup")
 
 	var suggest string
 
-	if len(cluster.Pubkey) < 30 {
-		fmt.Printf("Error: Pubkey data too small: [%s]\n", cluster.Pubkey)
-		JSONError(w, "Pubkey too small", http.StatusMethodNotAllowed)
-		return
-	}
-
-	if len(cluster.Pubkey) > 1000 {
-		fmt.Printf("Error: Pubkey too long\n")
-		JSONError(w, "Pubkey too long", http.StatusMethodNotAllowed)
-		return
-	}
-
-	if !regexpPubkey.MatchString(cluster.Pubkey) {
-		fmt.Printf("Error: pubkey should be valid form. valid key: ssh-rsa,ssh-ed25519,ecdsa-*,ssh-dsa XXXXX comment\n")
-		JSONError(w, "pubkey should be valid form. valid key: ssh-rsa,ssh-ed25519,ecdsa-*,ssh-dsa XXXXX comment", http.StatusMethodNotAllowed)
-		return
-	}
-
-	parsedKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(cluster.Pubkey))
-	if err != nil {
-		fmt.Printf("Error: ParseAuthorizedKey\n")
-		JSONError(w, "ParseAuthorizedKey", http.StatusMethodNotAllowed)
-		return
-	}
-
-	fmt.Printf("pubKey: [%x]\n", parsedKey)
-	uid := []byte(cluster.Pubkey)
-
-	//existance?
-	// check for existance
-	cid := md5.Sum(uid)
+	// payload is validated by createSchemas, pubkey is parsed by HandleClusterCreate,
+	// cid is the tenant of the pubkey
 
 //	if !isPubKeyAllowed(feeds, cluster.Pubkey) {
 //		fmt.Printf("Pubkey not in ACL: %s\n", cluster.Pubkey)
-//		JSONError(w, "not allowed", http.StatusMethodNotAllowed)
+//		JSONError(w, "not allowed", http.StatusForbidden)
 //		return
 //	}
 
-	// Count+Limits per CID should be implemented here (database req).
-	ClusterTimePath := fmt.Sprintf("%s/%x.time", *k8sDbDir, cid)
+	// Count+Limits per CID: see reserveQuota below
+	ClusterTimePath := fmt.Sprintf("%s/%s.time", *k8sDbDir, cid)
 
 	//!! FCP trial ONLY !!
 	//if fileExists(ClusterTimePath) {
@@ -1563,387 +1312,89 @@ func HandleCreateK8s(w http.ResponseWriter, cluster Cluster) {
 	//	return
 	//}
 
-	ClusterTime := time.Now().Unix()
-
-	tfile, fileErr := os.Create(ClusterTimePath)
-	if fileErr != nil {
-		fmt.Println(fileErr)
-		return
-	}
-	fmt.Fprintf(tfile, "%s\n%s\n", ClusterTime, InstanceId)
-
-	tfile.Close()
-
-	ClusterPathDir := fmt.Sprintf("%s/%x", *k8sDbDir, cid)
+	ClusterPathDir := fmt.Sprintf("%s/%s", *k8sDbDir, cid)
 
 	if !fileExists(ClusterPathDir) {
 		os.Mkdir(ClusterPathDir, 0775)
 	}
 
-	ClusterPath := fmt.Sprintf("%s/%x/cluster-%s", *k8sDbDir, cid, InstanceId)
-
-	if fileExists(ClusterPath) {
-		fmt.Printf("Error: cluster already exist: [%s]\n", ClusterPath)
-		JSONError(w, "cluster already exist", http.StatusMethodNotAllowed)
-		return
-	}
-
-	fmt.Printf("cluster file not exist, create empty: [%s]\n", ClusterPath)
-	// create empty file
-	f, err := os.Create(ClusterPath)
-
+	// released on any error below
+	res, err := reserveInstance(cid, InstanceId, KindK8s)
 	if err != nil {
-		log.Fatal(err)
+		fmt.Printf("Error: cluster already exist: [%s/%s]: %s\n", cid, InstanceId, err.Error())
+		JSONError(w, "cluster already exist", http.StatusConflict)
+		return
 	}
+	defer res.Release()
 
-	if len(cluster.Recomendation) > 1 {
-		if !regexpHostName.MatchString(cluster.Recomendation) {
-			fmt.Printf("Error: wrong hostname recomendation: [%s]\n", cluster.Recomendation)
-			JSONError(w, "recomendation should be valid form. valid form", http.StatusMethodNotAllowed)
-			return
+	if code, err := reserveQuota(res, k8sResources(cluster), quota); err != nil {
+		fmt.Printf("Error: cluster %s/%s: %s\n", cid, InstanceId, err.Error())
+		if errors.Is(err, ErrQuota) {
+			JSONErrorCode(w, err.Error(), code, errCodeQuota)
 		} else {
-			fmt.Printf("Found cluster recomendation: [%s]\n", cluster.Recomendation)
-			suggest = cluster.Recomendation
-		}
-	} else {
-		suggest = ""
-	}
-
-	if len(cluster.Email) > 2 {
-		if !regexpEmail.MatchString(cluster.Email) {
-			response := Response{"email should be valid form"}
-			js, err := json.Marshal(response)
-			if err != nil {
-				http.Error(w, err.Error(), http.StatusMethodNotAllowed)
-				return
-			}
-			http.Error(w, string(js), 400)
-			return
+			JSONError(w, err.Error(), code)
 		}
+		return
 	}
 
-	if len(cluster.Callback) > 2 {
-		if !regexpCallback.MatchString(cluster.Callback) {
-			response := Response{"callback should be valid form"}
-			js, err := json.Marshal(response)
-			if err != nil {
-				http.Error(w, err.Error(), http.StatusMethodNotAllowed)
-				return
-			}
-			http.Error(w, string(js), 400)
-			return
-		}
+	if len(cluster.Recomendation) > 1 {
+		fmt.Printf("Found cluster recomendation: [%s]\n", cluster.Recomendation)
+		suggest = cluster.Recomendation
 	}
 
-	Jname := getJname()
+	Jname := strings.TrimSpace(getJname())
 	if len(Jname) < 1 {
-		log.Fatal("unable to get jname")
+		fmt.Println("unable to get jname")
+		JSONError(w, "unable to get jname", http.StatusInternalServerError)
 		return
 	}
 
 	fmt.Printf("GET NEXT FREE JNAME: [%s]\n", Jname)
 
-	_, err2 := f.WriteString(Jname)
-
-	if err2 != nil {
-		log.Fatal(err2)
-	}
-
-	f.Close()
-
-	// master value validation
-	init_masters, err := strconv.Atoi(cluster.Init_masters)
+	comment, recomendation := k8sCreateComment(cluster, Jname)
+	body, err := commandBody(comment)
 	if err != nil {
-		response := Response{"Init_masters not a number"}
-		js, err := json.Marshal(response)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusMethodNotAllowed)
-			return
-		}
-		http.Error(w, string(js), 400)
-		return
-	}
-	if init_masters <= 0 || init_masters > 10 {
-		response := Response{"Init_masters valid range: 1-10"}
-		js, err := json.Marshal(response)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusMethodNotAllowed)
-			return
-		}
-		http.Error(w, string(js), 400)
-		return
-	}
-
-	if !regexpSize.MatchString(cluster.Master_vm_ram) {
-		response := Response{"The master_vm_ram should be valid form, 512m, 1g"}
-		js, err := json.Marshal(response)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusMethodNotAllowed)
-			return
-		}
-		http.Error(w, string(js), 400)
-		return
-	}
-	if !regexpSize.MatchString(cluster.Master_vm_imgsize) {
-		response := Response{"The master_vm_imgsize should be valid form, 2g, 30g"}
-		js, err := json.Marshal(response)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusMethodNotAllowed)
-			return
-		}
-		http.Error(w, string(js), 400)
-		return
-	}
-
-	var init_workers int
-
-	// worker value valudation
-	if len(cluster.Init_workers) > 1 {
-		init_workers, err = strconv.Atoi(cluster.Init_workers)
-		if err != nil {
-			response := Response{"Init_workers not a number"}
-			js, err := json.Marshal(response)
-			if err != nil {
-				http.Error(w, err.Error(), http.StatusMethodNotAllowed)
-				return
-			}
-			http.Error(w, string(js), 400)
-			return
-		}
-	} else {
-		init_workers = 0
-	}
-	if init_workers < 0 || init_workers > 10 {
-		response := Response{"Init_workers valid range: 0-10"}
-		js, err := json.Marshal(response)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusMethodNotAllowed)
-			return
-		}
-		http.Error(w, string(js), 400)
+		fmt.Printf("unable to encode command: %s\n", err.Error())
+		JSONError(w, "", http.StatusInternalServerError)
 		return
 	}
-	if init_workers > 0 {
-		if !regexpSize.MatchString(cluster.Worker_vm_ram) {
-			response := Response{"The workers_vm_ram should be valid form, 512m, 1g"}
-			js, err := json.Marshal(response)
-			if err != nil {
-				http.Error(w, err.Error(), http.StatusMethodNotAllowed)
-				return
-			}
-			http.Error(w, string(js), 400)
-			return
-		}
-		if !regexpSize.MatchString(cluster.Worker_vm_imgsize) {
-			response := Response{"The worker_vm_imgsize should be valid form, 2g, 30g"}
-			js, err := json.Marshal(response)
-			if err != nil {
-				http.Error(w, err.Error(), http.StatusMethodNotAllowed)
-				return
-			}
-			http.Error(w, string(js), 400)
-			return
-		}
-	}
-
-	var pv_enable int
 
-	// pv_enable value validation
-	if len(cluster.Pv_enable) > 1 {
-		pv_enable, err = strconv.Atoi(cluster.Pv_enable)
-		if err != nil {
-			response := Response{"Pv_enable not a number"}
-			js, err := json.Marshal(response)
-			if err != nil {
-				http.Error(w, err.Error(), http.StatusMethodNotAllowed)
-				return
-			}
-			http.Error(w, string(js), 400)
-			return
-		}
-	} else {
-		pv_enable = 1
-	}
-	if pv_enable < 0 || pv_enable > 1 {
-		response := Response{"Pv_enable valid values: 0 or 1"}
-		js, err := json.Marshal(response)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusMethodNotAllowed)
-			return
-		}
-		http.Error(w, string(js), 400)
-		return
-	}
-
-	var kubelet_master int
-
-	if len(cluster.Kubelet_master) > 1 {
-		// pv_enable value validation
-		kubelet_master, err = strconv.Atoi(cluster.Kubelet_master)
-		if err != nil {
-			response := Response{"Kubelet_master not a number"}
-			js, err := json.Marshal(response)
-			if err != nil {
-				http.Error(w, err.Error(), http.StatusMethodNotAllowed)
-				return
-			}
-			http.Error(w, string(js), 400)
-			return
-		}
-	} else {
-		kubelet_master = 1
-	}
-	if kubelet_master < 0 || kubelet_master > 1 {
-		response := Response{"Kubelet_master valid values: 0 or 1"}
-		js, err := json.Marshal(response)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusMethodNotAllowed)
-			return
-		}
-		http.Error(w, string(js), 400)
+	_, tube, reply, err := getNodeRecomendation(recomendation, suggest, res.inst)
+	if err != nil {
+		fmt.Printf("Error: placement of %s/%s: %s\n", cid, InstanceId, err.Error())
+		JSONError(w, err.Error(), http.StatusServiceUnavailable)
 		return
 	}
 
-	cluster.K8s_name = InstanceId
-	val := reflect.ValueOf(cluster)
-
-	var jconf_param string
-	var str strings.Builder
-	var recomendation strings.Builder
-
-	// of course we can use marshal here instead of string concatenation,
-	// but now this is too simple case/data without any processing
-	str.WriteString("{\"Command\":\"")
-	str.WriteString(*runScriptK8s)
-	str.WriteString("\",\"CommandArgs\":{\"mode\":\"init\",\"k8s_name\":\"")
-	//	str.WriteString(InstanceId)
-	str.WriteString(Jname)
-	str.WriteString("\"")
-
-	for i := 0; i < val.NumField(); i++ {
-		valueField := val.Field(i)
-
-		typeField := val.Type().Field(i)
-		tag := typeField.Tag
-
-		tmpval := fmt.Sprintf("%s", valueField.Interface())
-
-		if len(tmpval) == 0 {
-			continue
-		}
-		if len(tmpval) > 1000 {
-			fmt.Printf("Error: param val too long\n")
-			continue
-		}
-
-		fmt.Printf("[%s]", valueField)
-
-		if len(typeField.Name) > 30 {
-			fmt.Printf("Error: param name too long\n")
-			continue
-		}
-
-		jconf_param = strings.ToLower(typeField.Name)
-
-		if strings.Compare(jconf_param, "jname") == 0 {
-			continue
-		}
-
-		if !regexpParamName.MatchString(jconf_param) {
-			fmt.Printf("Error: wrong paramname: [%s]\n", jconf_param)
-			continue
-		} else {
-			fmt.Printf("paramname test passed: [%s]\n", jconf_param)
-		}
-
-		// validate unknown data values
-		switch jconf_param {
-			case "type":
-			case "imgsize":
-			case "ram":
-			case "cpus":
-			case "pkglist":
-			case "pubkey":
-			case "host_hostname":
-			case "init_masters":
-			case "init_workers":
-			case "master_vm_ram":
-			case "master_vm_cpus":
-			case "master_vm_imgsize":
-			case "worker_vm_ram":
-			case "worker_vm_cpus":
-			case "worker_vm_imgsize":
-			case "pv_enable":
-			case "kubelet_master":
-			case "email":
-			case "callback":
-			default:
-				if !regexpParamVal.MatchString(tmpval) {
-					fmt.Printf("Error: wrong paramval for %s: [%s]\n", jconf_param, tmpval)
-					continue
-				}
-		}
-
-		fmt.Printf("jconf: %s,\tField Name: %s,\t Field Value: %v,\t Tag Value: %s\n", jconf_param, typeField.Name, valueField.Interface(), tag.Get("tag_name"))
-
-		var buf string
-
-		if strings.Compare(jconf_param, "cpus") == 0 {
-			// https://stackoverflow.com/questions/18041334/convert-interface-to-int
-			cpus := valueField.Interface().(int)
-			buf = fmt.Sprintf(",\"%s\": \"%d\"", jconf_param, cpus)
-		} else {
-			buf = fmt.Sprintf(",\"%s\": \"%s\"", jconf_param, tmpval)
-		}
-
-		buf2 := fmt.Sprintf("%s ", tmpval)
-		str.WriteString(buf)
-		recomendation.WriteString(buf2)
-	}
-
-	str.WriteString("}}")
-	fmt.Printf("C: [%s]\n", str.String())
-	response := fmt.Sprintf("{ \"Message\": [\"curl -H cid:%x %s/api/v1/cluster\", \"curl -H cid:%x %s/api/v1/status/%s\", \"curl -H cid:%x %s/api/v1/kubeconfig/%s\",  \"curl -H cid:%x %s/api/v1/snapshot/%s\", \"curl -H cid:%x %s/api/v1/rollback/%s\", \"curl -H cid:%x %s/api/v1/destroy/%s\"] }", cid, server_url, cid, server_url, InstanceId, cid, server_url, InstanceId, cid, server_url, InstanceId, cid, server_url, InstanceId, cid, server_url, InstanceId)
-
-	getNodeRecomendation(recomendation.String(), suggest)
-
 	// mock status
-	SqliteDBPath := fmt.Sprintf("%s/%x/%s-vm.ssh", *k8sDbDir, cid, Jname)
-	fmt.Printf("Create empty/mock status file: [%s]\n", SqliteDBPath)
+	inst := res.inst
+	inst.Jname = Jname
+	inst.Status = []byte(fmt.Sprintf("{\n  \"id\": \"%s\",\n  \"is_power_on\": \"false\",\n  \"status\": \"pending\",\n  \"progress\": 0\n}\n", InstanceId))
 
-	tfile, fileErr = os.Create(SqliteDBPath)
-	if fileErr != nil {
-		fmt.Println(fileErr)
+	if err := store.PutInstance(inst); err != nil {
+		fmt.Printf("Error: unable to store cluster %s/%s: %s\n", inst.Cid, InstanceId, err.Error())
+		JSONError(w, "", http.StatusInternalServerError)
 		return
 	}
+	addTenant(inst.Cid, cluster.Pubkey)
 
-	fmt.Fprintf(tfile, "{\n  \"id\": \"%s\",\n  \"is_power_on\": \"false\",\n  \"status\": \"pending\",\n  \"progress\": 0\n}\n", InstanceId)
-
-	tfile.Close()
-
-	go realInstanceCreate(str.String())
-
-	// !!! MKDIR
-	ClusterMapDir := fmt.Sprintf("%s/var/db/k8s/map", workdir)
-
-	if !fileExists(ClusterMapDir) {
-		os.Mkdir(ClusterMapDir, 0775)
-	}
-
-	mapfile := fmt.Sprintf("%s/%x-%s", ClusterMapDir, cid, InstanceId)
-	m, err := os.Create(mapfile)
-
+	jobId, err := realInstanceCreate(r.Context(), Dispatch{Tube: tube, ReplyTubePrefix: reply, Body: body}, Job{Command: "create", Instance: InstanceId, Cid: inst.Cid})
 	if err != nil {
-		log.Fatal(err)
+		JSONError(w, "broker unavailable", brokerStatus(err))
+		return
 	}
+	res.Commit()
 
-	_, err3 := m.WriteString(Jname)
-
-	if err3 != nil {
-		log.Fatal(err3)
+	// time of the last created cluster, written once the create is accepted
+	ClusterTime := time.Now().Unix()
+	if tfile, err := os.Create(ClusterTimePath); err != nil {
+		fmt.Println(err)
+	} else {
+		fmt.Fprintf(tfile, "%d\n%s\n", ClusterTime, InstanceId)
+		tfile.Close()
 	}
 
-	m.Close()
+	response := fmt.Sprintf("{ \"Message\": [%s, %s, %s,  %s, %s, %s], \"job\": %d }", curlHint(cid, "/api/v1/cluster"), curlHint(cid, "/api/v1/status/"+InstanceId), curlHint(cid, "/api/v1/kubeconfig/"+InstanceId), curlHint(cid, "/api/v1/snapshot/"+InstanceId), curlHint(cid, "/api/v1/rollback/"+InstanceId), curlHint(cid, "/api/v1/destroy/"+InstanceId), jobId)
 
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
 	w.Header().Set("X-Content-Type-Options", "nosniff")
@@ -1957,174 +1408,76 @@ func HandleCreateK8s(w http.ResponseWriter, cluster Cluster) {
 func (feeds *MyFeeds) HandleClusterDestroy(w http.ResponseWriter, r *http.Request) {
 	var InstanceId string
 	params := mux.Vars(r)
-	// enum { 0 - vm, 1 - k8s }
-	var vmType int
 
 	InstanceId = params["InstanceId"]
-
 	if !validateInstanceId(InstanceId) {
-		JSONError(w, "The InstanceId should be valid form: ^[a-z_]([a-z0-9_])*$ (maxlen: 40)", http.StatusMethodNotAllowed)
+		JSONError(w, "The InstanceId should be valid form: ^[a-z_]([a-z0-9_])*$ (maxlen: 40)", http.StatusBadRequest)
 		return
 	}
 
 	Cid := r.Header.Get("cid")
 	if !validateCid(Cid) {
-		JSONError(w, "The cid should be valid form: ^[a-f0-9]{32}$", http.StatusMethodNotAllowed)
+		JSONError(w, "The cid should be valid form: ^[a-f0-9]{32}$", http.StatusUnauthorized)
 		return
 	}
 
 	if !isCidAllowed(feeds, Cid) {
 		fmt.Printf("CID not in ACL: %s\n", Cid)
-		JSONError(w, "not allowed", http.StatusMethodNotAllowed)
+		JSONError(w, "not allowed", http.StatusForbidden)
 		return
 	}
 
-	var mapfile string
-
-	checkMapfile := fmt.Sprintf("%s/var/db/api/map/%s-%s", workdir, Cid, InstanceId)
-	if _, err := os.Stat(checkMapfile); os.IsNotExist(err) {
-		fmt.Printf("status: no such %s/%s/vms - check K8S...\n", *dbDir, Cid)
-		// check K8S dir
-		checkMapfile = fmt.Sprintf("%s/var/db/k8s/map/%s-%s", workdir, Cid, InstanceId)
-		if _, err := os.Stat(checkMapfile); os.IsNotExist(err) {
-			JSONError(w, "not found", http.StatusOK)
-			return
-		} else {
-			fmt.Printf("%s found - its K8S\n", checkMapfile)
-			// K8S instance
-			vmType = 1
-			mapfile = checkMapfile
-		}
-	} else {
-		//VM/jail instance
-		fmt.Printf("%s/%s/vms found - its not K8S\n", *dbDir, Cid)
-		vmType = 0
-		mapfile = checkMapfile
+	if !isPermitted(feeds, Cid, permDestroy) {
+		JSONError(w, ErrPermission.Error(), http.StatusForbidden)
+		return
 	}
 
-	b, err := ioutil.ReadFile(mapfile) // just pass the file name
+	inst, err := store.GetInstance(Cid, InstanceId)
 	if err != nil {
-		fmt.Printf("unable to read jname from map file: [%s]\n", mapfile)
-		JSONError(w, "not found", http.StatusOK)
+		fmt.Printf("destroy: no such instance %s/%s\n", Cid, InstanceId)
+		JSONError(w, "not found", http.StatusNotFound)
 		return
 	}
 
-	fmt.Printf("Destroy %s via map file: %s\n", string(b), mapfile)
+	destroyInstance(w, r, inst)
+}
+
+// destroyInstance sends destroy of inst to its node and removes it from store
+func destroyInstance(w http.ResponseWriter, r *http.Request, inst *Instance) {
+	fmt.Printf("Destroy %s (%s)\n", inst.Jname, inst.Kind)
 
-	// of course we can use marshal here instead of string concatenation,
-	// but now this is too simple case/data without any processing
-	var str strings.Builder
-	var SqliteDBPath string
+	var runscript string
 
 	// destroy via
-	if ( vmType == 1 ) {
-		// K8s
-		SqliteDBPath = fmt.Sprintf("%s/%s/%s.node", *k8sDbDir, Cid, string(b))
+	if inst.Kind == KindK8s {
 		runscript = *destroyK8sScript
 	} else {
-		SqliteDBPath = fmt.Sprintf("%s/%s/%s.node", *dbDir, Cid, string(b))
 		runscript = *destroyScript
 	}
-	str.WriteString("{\"Command\":\"")
-	str.WriteString(runscript)
-
-	if ( vmType == 1 ) {
-		// K8s
-		str.WriteString("\",\"CommandArgs\":{\"mode\":\"destroy\",\"k8s_name\":\"")
-	} else {
-		str.WriteString("\",\"CommandArgs\":{\"mode\":\"destroy\",\"jname\":\"")
+	body, err := commandBody(instanceComment(runscript, "destroy", inst))
+	if err != nil {
+		fmt.Printf("unable to encode command: %s\n", err.Error())
+		JSONError(w, "", http.StatusInternalServerError)
+		return
 	}
 
-	str.WriteString(string(b))
-	str.WriteString("\"")
-	str.WriteString("}}")
-
 	//get guest nodes & tubes
-	if fileExists(SqliteDBPath) {
-		b, err := ioutil.ReadFile(SqliteDBPath) // just pass the file name
-		if err != nil {
-			fmt.Printf("unable to read node map: %s\n", SqliteDBPath)
-			JSONError(w, "unable to read node map", http.StatusOK)
-			return
-		} else {
-			result := strings.Replace(string(b), ".", "_", -1)
-			result = strings.Replace(result, "-", "_", -1)
-			result = strings.TrimSuffix(result, "\n")
-			tube := fmt.Sprintf("cbsd_%s", result)
-			reply := fmt.Sprintf("cbsd_%s_result_id", result)
-			// result: srv-03.olevole.ru
-			config.BeanstalkConfig.Tube = tube
-			config.BeanstalkConfig.ReplyTubePrefix = reply
-		}
-	} else {
-		fmt.Printf("unable to read node map: %s\n", SqliteDBPath)
-		JSONError(w, "unable to read node map", http.StatusOK)
+	node, err := instanceNode(inst)
+	if err != nil {
+		fmt.Printf("unable to read node map: %s\n", err.Error())
+		JSONErrorLegacy(w, "unable to read node map", http.StatusInternalServerError, http.StatusOK)
 		return
 	}
+	// node: srv-03.olevole.ru
+	tube, reply := nodeTubes(node)
 
-	fmt.Printf("C: [%s]\n", str.String())
-	go realInstanceCreate(str.String())
-
-	e := os.Remove(mapfile)
-	if e != nil {
-		log.Fatal(e)
-	}
-
-	// remove from FS
-	var VmPath string
-	if ( vmType == 1 ) {
-		// K8S
-		VmPath = fmt.Sprintf("%s/%s/cluster-%s", *k8sDbDir, Cid, InstanceId)
-		if fileExists(VmPath) {
-			b, err := ioutil.ReadFile(VmPath) // just pass the file name
-			if err != nil {
-				fmt.Printf("Error read UID from  [%s]\n", string(b))
-			} else {
-
-				fmt.Printf("   REMOVE: %s\n", VmPath)
-				e = os.Remove(VmPath)
-
-				VmPath = fmt.Sprintf("%s/%s/%s.node", *k8sDbDir, Cid, string(b))
-				fmt.Printf("   REMOVE: %s\n", VmPath)
-				e = os.Remove(VmPath)
-
-				VmPath = fmt.Sprintf("%s/%s/%s-vm.ssh", *k8sDbDir, Cid, string(b))
-				fmt.Printf("   REMOVE: %s\n", VmPath)
-				e = os.Remove(VmPath)
-
-				VmPath = fmt.Sprintf("%s/%s/vms/%s", *k8sDbDir, Cid, string(b))
-				fmt.Printf("   REMOVE: %s\n", VmPath)
-				e = os.Remove(VmPath)
-			}
-		}
-	} else {
-		// VM
-		VmPath = fmt.Sprintf("%s/%s/vm-%s", *dbDir, Cid, InstanceId)
-		if fileExists(VmPath) {
-			b, err := ioutil.ReadFile(VmPath) // just pass the file name
-			if err != nil {
-				fmt.Printf("Error read UID from  [%s]\n", string(b))
-			} else {
-
-				fmt.Printf("   REMOVE: %s\n", VmPath)
-				e = os.Remove(VmPath)
-
-				VmPath = fmt.Sprintf("%s/%s/%s.node", *dbDir, Cid, string(b))
-				fmt.Printf("   REMOVE: %s\n", VmPath)
-				e = os.Remove(VmPath)
-
-				VmPath = fmt.Sprintf("%s/%s/%s-vm.ssh", *dbDir, Cid, string(b))
-				fmt.Printf("   REMOVE: %s\n", VmPath)
-				e = os.Remove(VmPath)
-
-				VmPath = fmt.Sprintf("%s/%s/vms/%s", *dbDir, Cid, string(b))
-				fmt.Printf("   REMOVE: %s\n", VmPath)
-				e = os.Remove(VmPath)
-			}
-		}
+	jobId, err := realInstanceCreate(r.Context(), Dispatch{Tube: tube, ReplyTubePrefix: reply, Body: body}, Job{Command: "destroy", Instance: inst.Id, Cid: inst.Cid})
+	if err != nil {
+		JSONError(w, "broker unavailable", brokerStatus(err))
+		return
 	}
 
-	JSONError(w, "destroy", 200)
+	writeJSON(w, JobResponse{"destroy", jobId})
 	return
 }
 
@@ -2134,97 +1487,68 @@ func (feeds *MyFeeds) HandleClusterStop(w http.ResponseWriter, r *http.Request)
 
 	InstanceId = params["InstanceId"]
 	if !validateInstanceId(InstanceId) {
-		JSONError(w, "The InstanceId should be valid form: ^[a-z_]([a-z0-9_])*$ (maxlen: 40)", http.StatusMethodNotAllowed)
+		JSONError(w, "The InstanceId should be valid form: ^[a-z_]([a-z0-9_])*$ (maxlen: 40)", http.StatusBadRequest)
 		return
 	}
 
 	Cid := r.Header.Get("cid")
 	if !validateCid(Cid) {
-		JSONError(w, "The cid should be valid form: ^[a-f0-9]{32}$", http.StatusMethodNotAllowed)
+		JSONError(w, "The cid should be valid form: ^[a-f0-9]{32}$", http.StatusUnauthorized)
 		return
 	}
 
 	if !isCidAllowed(feeds, Cid) {
 		fmt.Printf("CID not in ACL: %s\n", Cid)
-		JSONError(w, "not allowed", http.StatusMethodNotAllowed)
+		JSONError(w, "not allowed", http.StatusForbidden)
 		return
 	}
 
-	HomePath := fmt.Sprintf("%s/%s/vms", *dbDir, Cid)
-	if _, err := os.Stat(HomePath); os.IsNotExist(err) {
+	if !isPermitted(feeds, Cid, permStartStop) {
+		JSONError(w, ErrPermission.Error(), http.StatusForbidden)
 		return
 	}
 
-	mapfile := fmt.Sprintf("%s/var/db/api/map/%s-%s", workdir, Cid, InstanceId)
-
-	if !fileExists(config.Recomendation) {
-		fmt.Printf("no such map file %s/var/db/api/map/%s-%s\n", workdir, Cid, InstanceId)
-		JSONError(w, "not found", http.StatusOK)
+	inst, err := store.GetInstance(Cid, InstanceId)
+	if err != nil || inst.Kind != KindVm {
+		fmt.Printf("stop: no such instance %s/%s\n", Cid, InstanceId)
+		JSONError(w, "not found", http.StatusNotFound)
 		return
 	}
 
-	b, err := ioutil.ReadFile(mapfile) // just pass the file name
+	stopInstance(w, r, inst)
+}
+
+// stopInstance sends stop of VM inst to its node
+func stopInstance(w http.ResponseWriter, r *http.Request, inst *Instance) {
+	fmt.Printf("stop %s\n", inst.Jname)
+
+	runscript := *stopScript
+	body, err := commandBody(instanceComment(runscript, "stop", inst))
 	if err != nil {
-		fmt.Printf("unable to read jname from %s/var/db/api/map/%s-%s\n", workdir, Cid, InstanceId)
-		JSONError(w, "not found", http.StatusOK)
+		fmt.Printf("unable to encode command: %s\n", err.Error())
+		JSONError(w, "", http.StatusInternalServerError)
 		return
 	}
 
-	fmt.Printf("stop %s via %s/var/db/api/map/%s-%s\n", string(b), workdir, Cid, InstanceId)
-
-	// of course we can use marshal here instead of string concatenation,
-	// but now this is too simple case/data without any processing
-	var str strings.Builder
-
-	runscript = *stopScript
-	str.WriteString("{\"Command\":\"")
-	str.WriteString(runscript)
-	str.WriteString("\",\"CommandArgs\":{\"mode\":\"stop\",\"jname\":\"")
-	str.WriteString(string(b))
-	str.WriteString("\"")
-	str.WriteString("}}")
-
 	//get guest nodes & tubes
-	SqliteDBPath := fmt.Sprintf("%s/%s/%s.node", *dbDir, Cid, string(b))
-	if fileExists(SqliteDBPath) {
-		b, err := ioutil.ReadFile(SqliteDBPath) // just pass the file name
-		if err != nil {
-			JSONError(w, "{}", 400)
-			return
-		} else {
-			result := strings.Replace(string(b), ".", "_", -1)
-			result = strings.Replace(result, "-", "_", -1)
-			result = strings.TrimSuffix(result, "\n")
-			//	result = strings.Replace(result, "\r\n", "", -1)
-
-			tube := fmt.Sprintf("cbsd_%s", result)
-			reply := fmt.Sprintf("cbsd_%s_result_id", result)
-
-			fmt.Printf("Tube selected: [%s]\n", tube)
-			fmt.Printf("ReplyTube selected: [%s]\n", reply)
-
-			// result: srv-03.olevole.ru
-			config.BeanstalkConfig.Tube = tube
-			config.BeanstalkConfig.ReplyTubePrefix = reply
-		}
-	} else {
-		JSONError(w, "nodes not found", http.StatusOK)
+	node, err := instanceNode(inst)
+	if err != nil {
+		JSONErrorLegacy(w, "nodes not found", http.StatusInternalServerError, http.StatusOK)
 		return
 	}
+	// node: srv-03.olevole.ru
+	tube, reply := nodeTubes(node)
 
-	fmt.Printf("C: [%s]\n", str.String())
-	go realInstanceCreate(str.String())
+	fmt.Printf("Tube selected: [%s]\n", tube)
+	fmt.Printf("ReplyTube selected: [%s]\n", reply)
 
-	// remove from FS
-	VmPath := fmt.Sprintf("%s/%s/vm-%s", *dbDir, Cid, InstanceId)
-	if fileExists(VmPath) {
-		b, err := ioutil.ReadFile(VmPath) // just pass the file name
-		if err != nil {
-			fmt.Printf("Error read UID from  [%s]\n", string(b))
-		}
+	jobId, err := realInstanceCreate(r.Context(), Dispatch{Tube: tube, ReplyTubePrefix: reply, Body: body}, Job{Command: "stop", Instance: inst.Id, Cid: inst.Cid})
+	if err != nil {
+		JSONError(w, "broker unavailable", brokerStatus(err))
+		return
 	}
 
-	JSONError(w, "stopped", 200)
+	writeJSON(w, JobResponse{"stopped", jobId})
 	return
 }
 
@@ -2234,98 +1558,63 @@ func (feeds *MyFeeds) HandleClusterStart(w http.ResponseWriter, r *http.Request)
 
 	InstanceId = params["InstanceId"]
 	if !validateInstanceId(InstanceId) {
-		JSONError(w, "The InstanceId should be valid form: ^[a-z_]([a-z0-9_])*$ (maxlen: 40)", http.StatusMethodNotAllowed)
+		JSONError(w, "The InstanceId should be valid form: ^[a-z_]([a-z0-9_])*$ (maxlen: 40)", http.StatusBadRequest)
 		return
 	}
 
 	Cid := r.Header.Get("cid")
 	if !validateCid(Cid) {
-		JSONError(w, "The cid should be valid form: ^[a-f0-9]{32}$", http.StatusMethodNotAllowed)
+		JSONError(w, "The cid should be valid form: ^[a-f0-9]{32}$", http.StatusUnauthorized)
 		return
 	}
 
 	if !isCidAllowed(feeds, Cid) {
 		fmt.Printf("CID not in ACL: %s\n", Cid)
-		JSONError(w, "not allowed", http.StatusMethodNotAllowed)
+		JSONError(w, "not allowed", http.StatusForbidden)
 		return
 	}
 
-	HomePath := fmt.Sprintf("%s/%s/vms", *dbDir, Cid)
-	if _, err := os.Stat(HomePath); os.IsNotExist(err) {
+	if !isPermitted(feeds, Cid, permStartStop) {
+		JSONError(w, ErrPermission.Error(), http.StatusForbidden)
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	mapfile := fmt.Sprintf("%s/var/db/api/map/%s-%s", workdir, Cid, InstanceId)
-
-	if !fileExists(config.Recomendation) {
-		fmt.Printf("no such map file %s/var/db/api/map/%s-%s\n", workdir, Cid, InstanceId)
-		JSONError(w, "not found", http.StatusOK)
+	inst, err := store.GetInstance(Cid, InstanceId)
+	if err != nil || inst.Kind != KindVm {
+		fmt.Printf("start: no such instance %s/%s\n", Cid, InstanceId)
+		JSONError(w, "not found", http.StatusNotFound)
 		return
 	}
 
-	b, err := ioutil.ReadFile(mapfile) // just pass the file name
+	fmt.Printf("start %s\n", inst.Jname)
+
+	runscript := *startScript
+	body, err := commandBody(instanceComment(runscript, "start", inst))
 	if err != nil {
-		fmt.Printf("unable to read jname from %s/var/db/api/map/%s-%s\n", workdir, Cid, InstanceId)
-		JSONError(w, "not found", http.StatusOK)
+		fmt.Printf("unable to encode command: %s\n", err.Error())
+		JSONError(w, "", http.StatusInternalServerError)
 		return
 	}
 
-	fmt.Printf("start %s via %s/var/db/api/map/%s-%s\n", string(b), workdir, Cid, InstanceId)
-
-	// of course we can use marshal here instead of string concatenation,
-	// but now this is too simple case/data without any processing
-	var str strings.Builder
-
-	runscript = *startScript
-	str.WriteString("{\"Command\":\"")
-	str.WriteString(runscript)
-	str.WriteString("\",\"CommandArgs\":{\"mode\":\"start\",\"jname\":\"")
-	str.WriteString(string(b))
-	str.WriteString("\"")
-	str.WriteString("}}")
-
 	//get guest nodes & tubes
-	SqliteDBPath := fmt.Sprintf("%s/%s/%s.node", *dbDir, Cid, string(b))
-	if fileExists(SqliteDBPath) {
-		b, err := ioutil.ReadFile(SqliteDBPath) // just pass the file name
-		if err != nil {
-			http.Error(w, "{}", 400)
-			return
-		} else {
-			result := strings.Replace(string(b), ".", "_", -1)
-			result = strings.Replace(result, "-", "_", -1)
-			result = strings.TrimSuffix(result, "\n")
-			//	result = strings.Replace(result, "\r\n", "", -1)
-
-			tube := fmt.Sprintf("cbsd_%s", result)
-			reply := fmt.Sprintf("cbsd_%s_result_id", result)
-
-			fmt.Printf("Tube selected: [%s]\n", tube)
-			fmt.Printf("ReplyTube selected: [%s]\n", reply)
-
-			// result: srv-03.olevole.ru
-			config.BeanstalkConfig.Tube = tube
-			config.BeanstalkConfig.ReplyTubePrefix = reply
-		}
-	} else {
-		JSONError(w, "nodes not found", http.StatusOK)
+	node, err := instanceNode(inst)
+	if err != nil {
+		JSONErrorLegacy(w, "nodes not found", http.StatusInternalServerError, http.StatusOK)
 		return
 	}
+	// node: srv-03.olevole.ru
+	tube, reply := nodeTubes(node)
 
-	fmt.Printf("C: [%s]\n", str.String())
-	go realInstanceCreate(str.String())
+	fmt.Printf("Tube selected: [%s]\n", tube)
+	fmt.Printf("ReplyTube selected: [%s]\n", reply)
 
-	// remove from FS
-	VmPath := fmt.Sprintf("%s/%s/vm-%s", *dbDir, Cid, InstanceId)
-	if fileExists(VmPath) {
-		b, err := ioutil.ReadFile(VmPath) // just pass the file name
-		if err != nil {
-			fmt.Printf("Error read UID from  [%s]\n", string(b))
-		}
+	jobId, err := realInstanceCreate(r.Context(), Dispatch{Tube: tube, ReplyTubePrefix: reply, Body: body}, Job{Command: "start", Instance: InstanceId, Cid: Cid})
+	if err != nil {
+		JSONError(w, "broker unavailable", brokerStatus(err))
+		return
 	}
 
-	JSONError(w, "started", 200)
+	writeJSON(w, JobResponse{"started", jobId})
 	return
 }
 
@@ -2337,7 +1626,7 @@ func (feeds *MyFeeds) HandleIacRequestStatus(w http.ResponseWriter, r *http.Requ
 
 	InstanceId = params["InstanceId"]
 	if !validateInstanceId(InstanceId) {
-		JSONError(w, "The InstanceId should be valid form: ^[a-z_]([a-z0-9_])*$ (maxlen: 40)", http.StatusMethodNotAllowed)
+		JSONError(w, "The InstanceId should be valid form: ^[a-z_]([a-z0-9_])*$ (maxlen: 40)", http.StatusBadRequest)
 		return
 	}
 
@@ -2351,21 +1640,21 @@ func (feeds *MyFeeds) HandleIacRequestStatus(w http.ResponseWriter, r *http.Requ
 
 	if !fileExists(progressFile) {
 		fmt.Printf("Error: projectId not exist: [%s]\n", progressFile)
-		JSONError(w, "projectId not exist", http.StatusNotFound)
+		JSONErrorLegacy(w, "projectId not exist", http.StatusNotFound, http.StatusNotFound)
 		return
 	}
 
 	b, err := ioutil.ReadFile(progressFile) // just pass the file name
 	if err != nil {
 		fmt.Printf("unable to read progress file from: [%s]\n", progressFile)
-		JSONError(w, "", 400)
+		JSONErrorLegacy(w, "", http.StatusInternalServerError, 400)
 		return
 	}
 
 	// already in json - send as-is
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
 	w.Header().Set("X-Content-Type-Options", "nosniff")
-	http.Error(w, string(b), 200)
+	w.Write(b)
 	return
 }
 
@@ -2377,8 +1666,8 @@ func (feeds *MyFeeds) HandleOneTimeConf(w http.ResponseWriter, r *http.Request)
 
 	CfgFile = params["CfgFile"]
 	if !validateCfgFile(CfgFile) {
-		fmt.Printf("The CfgFile should be valid form: ^[a-z_]([a-z0-9_])*$ (maxlen: 10)", CfgFile)
-		JSONError(w, "", 400)
+		fmt.Printf("The CfgFile should be valid form: ^[a-z_]([a-z0-9_])*$ (maxlen: 10): [%s]\n", CfgFile)
+		JSONErrorLegacy(w, "", http.StatusBadRequest, 400)
 		return
 	}
 
@@ -2386,14 +1675,14 @@ func (feeds *MyFeeds) HandleOneTimeConf(w http.ResponseWriter, r *http.Request)
 
 	if !fileExists(configFile) {
 		fmt.Printf("Error: no such CfgFile: [%s]\n", configFile)
-		JSONError(w, "", 400)
+		JSONErrorLegacy(w, "", http.StatusNotFound, 400)
 		return
 	}
 
 	b, err := ioutil.ReadFile(configFile) // just pass the file name
 	if err != nil {
 		fmt.Printf("unable to read CfgFile: [%s]\n", configFile)
-		JSONError(w, "", 400)
+		JSONErrorLegacy(w, "", http.StatusInternalServerError, 400)
 		return
 	}
 
@@ -2405,7 +1694,7 @@ func (feeds *MyFeeds) HandleOneTimeConf(w http.ResponseWriter, r *http.Request)
 	// already in json - send as-is
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
 	w.Header().Set("X-Content-Type-Options", "nosniff")
-	http.Error(w, string(b), 200)
+	w.Write(b)
 
 
 	return
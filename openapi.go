@@ -0,0 +1,320 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// route access in OpenAPI document
+const (
+	accessTenant = "tenant" // cid header or CBSD-SSH signature
+	accessAdmin  = "admin"  // CBSD-SSH signature by admin key
+	accessPublic = "public"
+)
+
+// apiRoute documents one endpoint of newRouter, otcRoutes or adminRoutes
+type apiRoute struct {
+	Method  string
+	Path    string
+	Summary string
+	Access  string
+	Query   []string
+	// components/schemas name of request body, oneOf when several
+	Body []string
+	// components/schemas name of 200 reply, empty for free-form JSON object
+	Reply string
+	List  bool // reply is an array of Reply
+	SSE   bool // reply is text/event-stream
+}
+
+var apiRoutes = []apiRoute{
+	{Method: "POST", Path: "/api/v1/create/{InstanceId}", Summary: "Create VM, jail or K8S cluster", Access: accessTenant, Body: []string{"VmCreate", "JailCreate", "K8sCreate"}},
+	{Method: "GET", Path: "/api/v1/status/{InstanceId}", Summary: "Instance status", Access: accessTenant, Reply: "InstanceStatus"},
+	{Method: "GET", Path: "/api/v1/status/{InstanceId}/events", Summary: "Job updates of instance", Access: accessTenant, Reply: "Job", SSE: true},
+	{Method: "GET", Path: "/api/v1/kubeconfig/{InstanceId}", Summary: "Kubeconfig of K8S cluster", Access: accessTenant},
+	{Method: "GET", Path: "/api/v1/start/{InstanceId}", Summary: "Start VM", Access: accessTenant, Reply: "JobResponse"},
+	{Method: "GET", Path: "/api/v1/stop/{InstanceId}", Summary: "Stop VM", Access: accessTenant, Reply: "JobResponse"},
+	{Method: "GET", Path: "/api/v1/destroy/{InstanceId}", Summary: "Destroy VM, jail or K8S cluster", Access: accessTenant, Reply: "JobResponse"},
+	{Method: "GET", Path: "/api/v1/cluster", Summary: "VM and jail instances of tenant", Access: accessTenant},
+	{Method: "GET", Path: "/api/v1/k8scluster", Summary: "K8S clusters of tenant", Access: accessTenant},
+	{Method: "GET", Path: "/api/v1/quota", Summary: "Quota limits and usage", Access: accessTenant, Reply: "QuotaResponse"},
+	{Method: "GET", Path: "/api/v1/nodes", Summary: "Nodes with their usage", Access: accessTenant, Reply: "NodeStatus", List: true},
+	{Method: "GET", Path: "/api/v1/schema/{Image}", Summary: "JSON Schema of create payload", Access: accessPublic},
+	{Method: "GET", Path: "/api/v1/jobs", Summary: "Jobs of tenant, newest first", Access: accessTenant, Query: []string{"instance"}, Reply: "Job", List: true},
+	{Method: "GET", Path: "/api/v1/jobs/{JobId}", Summary: "Job state", Access: accessTenant, Reply: "Job"},
+	{Method: "GET", Path: "/api/v1/jobs/{JobId}/events", Summary: "Job updates", Access: accessTenant, Reply: "Job", SSE: true},
+	{Method: "GET", Path: "/api/v1/openapi.json", Summary: "This document", Access: accessPublic},
+	{Method: "GET", Path: "/api/v1/otc/{CfgFile}", Summary: "One-time config, removed once read", Access: accessPublic},
+	{Method: "GET", Path: "/images", Summary: "Available cloud images", Access: accessPublic},
+	{Method: "GET", Path: "/flavors", Summary: "Available flavors", Access: accessPublic},
+
+	{Method: "GET", Path: "/api/v1/admin/tenants", Summary: "Tenants with instance counts", Access: accessAdmin, Reply: "AdminTenant", List: true},
+	{Method: "GET", Path: "/api/v1/admin/instances", Summary: "VM and jail instances of all tenants", Access: accessAdmin, Query: []string{"cid"}, Reply: "Instance", List: true},
+	{Method: "GET", Path: "/api/v1/admin/clusters", Summary: "K8S clusters of all tenants", Access: accessAdmin, Query: []string{"cid"}, Reply: "Instance", List: true},
+	{Method: "GET", Path: "/api/v1/admin/nodes", Summary: "Nodes with placed instances", Access: accessAdmin, Reply: "AdminNode", List: true},
+	{Method: "GET", Path: "/api/v1/admin/jobs", Summary: "Unfinished jobs of all tenants, ?all=1 for all", Access: accessAdmin, Query: []string{"all"}, Reply: "Job", List: true},
+	{Method: "POST", Path: "/api/v1/admin/destroy/{Cid}/{InstanceId}", Summary: "Forced destroy", Access: accessAdmin, Reply: "JobResponse"},
+	{Method: "POST", Path: "/api/v1/admin/stop/{Cid}/{InstanceId}", Summary: "Forced stop", Access: accessAdmin, Reply: "JobResponse"},
+	{Method: "POST", Path: "/api/v1/admin/suspend/{Cid}", Summary: "Suspend tenant", Access: accessAdmin, Reply: "Tenant"},
+	{Method: "POST", Path: "/api/v1/admin/unsuspend/{Cid}", Summary: "Unsuspend tenant", Access: accessAdmin, Reply: "Tenant"},
+}
+
+// path parameters of apiRoutes
+var apiPathParams = map[string]map[string]interface{}{
+	"InstanceId": {"type": "string", "pattern": "^[a-z_]([a-z0-9_])*$", "maxLength": 40},
+	"JobId":      {"type": "integer", "minimum": 1},
+	"Cid":        {"type": "string", "pattern": "^[a-f0-9]{32}$"},
+	"Image":      {"type": "string", "enum": []string{"jail", "k8s", "vm"}},
+	"CfgFile":    {"type": "string", "pattern": "^[aA0-zZ9_]([aA0-zZ9_])*$", "maxLength": 10},
+}
+
+// schemas of replies, derived from Go types
+var apiReplyTypes = map[string]interface{}{
+	"Error":           ErrorEnvelope{},
+	"LegacyError":     Response{},
+	"FieldError":      FieldError{},
+	"ValidationError": ValidationResponse{},
+	"Job":             Job{},
+	"JobResponse":     JobResponse{},
+	"QuotaResponse":   QuotaResponse{},
+	"NodeStatus":      NodeStatus{},
+	"OutboxStatus":    OutboxStatus{},
+	"Instance":        Instance{},
+	"Tenant":          Tenant{},
+	"AdminTenant":     AdminTenant{},
+	"AdminNode":       AdminNode{},
+}
+
+// Go types of create payloads, their fields are validated by createSchemas
+var apiBodyTypes = map[string]struct {
+	Kind string
+	Type interface{}
+}{
+	"VmCreate":   {"vm", Vm{}},
+	"JailCreate": {"jail", Vm{}},
+	"K8sCreate":  {"k8s", Cluster{}},
+}
+
+var regexpPathParam = regexp.MustCompile(`\{([A-Za-z]+)\}`)
+
+// goSchema renders JSON schema of t by its json tags
+func goSchema(t reflect.Type) map[string]interface{} {
+	switch t {
+	case reflect.TypeOf(time.Time{}):
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	case reflect.TypeOf(json.RawMessage{}):
+		return map[string]interface{}{"type": "object"}
+	}
+
+	switch t.Kind() {
+	case reflect.Ptr:
+		return goSchema(t.Elem())
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int32, reflect.Int64, reflect.Uint, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{"type": "array", "items": goSchema(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": goSchema(t.Elem())}
+	case reflect.Interface:
+		return map[string]interface{}{}
+	case reflect.Struct:
+		properties := make(map[string]interface{})
+		goProperties(t, properties)
+		return map[string]interface{}{"type": "object", "properties": properties}
+	}
+	return map[string]interface{}{"type": "string"}
+}
+
+// goProperties adds exported fields of struct t, embedded structs are
+// flattened as encoding/json does
+func goProperties(t reflect.Type, properties map[string]interface{}) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			continue
+		}
+		name := strings.Split(f.Tag.Get("json"), ",")[0]
+		if name == "-" {
+			continue
+		}
+		if f.Anonymous && len(name) == 0 && f.Type.Kind() == reflect.Struct {
+			goProperties(f.Type, properties)
+			continue
+		}
+		if len(name) == 0 {
+			name = f.Name
+		}
+		properties[name] = goSchema(f.Type)
+	}
+}
+
+// bodySchema is createSchemas of kind limited to json fields of Go type t
+func bodySchema(kind string, t reflect.Type) map[string]interface{} {
+	schema := createSchemas[kind].JSONSchema()
+	delete(schema, "$schema")
+
+	tags := make(map[string]bool)
+	for name := range goSchema(t)["properties"].(map[string]interface{}) {
+		tags[name] = true
+	}
+	properties := schema["properties"].(map[string]interface{})
+	for name := range properties {
+		if !tags[name] {
+			delete(properties, name)
+		}
+	}
+	return schema
+}
+
+func schemaRef(name string) map[string]interface{} {
+	return map[string]interface{}{"$ref": "#/components/schemas/" + name}
+}
+
+func jsonContent(schema interface{}) map[string]interface{} {
+	return map[string]interface{}{"application/json": map[string]interface{}{"schema": schema}}
+}
+
+// operation renders r as OpenAPI operation object
+func (r apiRoute) operation() map[string]interface{} {
+	params := []interface{}{}
+	for _, m := range regexpPathParam.FindAllStringSubmatch(r.Path, -1) {
+		params = append(params, map[string]interface{}{"name": m[1], "in": "path", "required": true, "schema": apiPathParams[m[1]]})
+	}
+	for _, name := range r.Query {
+		params = append(params, map[string]interface{}{"name": name, "in": "query", "schema": map[string]interface{}{"type": "string"}})
+	}
+
+	var reply interface{} = map[string]interface{}{"type": "object"}
+	if len(r.Reply) > 0 {
+		reply = schemaRef(r.Reply)
+	}
+	if r.List {
+		reply = map[string]interface{}{"type": "array", "items": reply}
+	}
+	content := jsonContent(reply)
+	if r.SSE {
+		content = map[string]interface{}{"text/event-stream": map[string]interface{}{
+			"schema": map[string]interface{}{"type": "string", "description": "\"progress\" and \"done\" events, data is Job"},
+		}}
+	}
+
+	responses := map[string]interface{}{
+		"200": map[string]interface{}{"description": "OK", "content": content},
+		"4XX": map[string]interface{}{"$ref": "#/components/responses/Error"},
+		"5XX": map[string]interface{}{"$ref": "#/components/responses/Error"},
+	}
+
+	op := map[string]interface{}{
+		"summary":     r.Summary,
+		"operationId": strings.ToLower(r.Method) + regexpPathParam.ReplaceAllString(strings.NewReplacer("/api/v1", "", "/", "_", ".", "_").Replace(r.Path), "$1"),
+		"tags":        []string{r.Access},
+		"parameters":  params,
+		"responses":   responses,
+	}
+
+	switch r.Access {
+	case accessTenant:
+		op["parameters"] = append(params, map[string]interface{}{"$ref": "#/components/parameters/cid"})
+		op["security"] = []interface{}{map[string]interface{}{}, map[string]interface{}{"signature": []string{}}}
+	case accessAdmin:
+		op["security"] = []interface{}{map[string]interface{}{"signature": []string{}}}
+	default:
+		op["security"] = []interface{}{}
+	}
+
+	if len(r.Body) > 0 {
+		bodies := []interface{}{}
+		for _, name := range r.Body {
+			bodies = append(bodies, schemaRef(name))
+		}
+		var body interface{} = bodies[0]
+		if len(bodies) > 1 {
+			body = map[string]interface{}{"oneOf": bodies}
+		}
+		op["requestBody"] = map[string]interface{}{"required": true, "content": jsonContent(body)}
+		responses["422"] = map[string]interface{}{"$ref": "#/components/responses/ValidationError"}
+	}
+	return op
+}
+
+// openAPISpec renders OpenAPI 3.1 document of apiRoutes
+func openAPISpec() map[string]interface{} {
+	paths := make(map[string]interface{})
+	for _, r := range apiRoutes {
+		item, ok := paths[r.Path].(map[string]interface{})
+		if !ok {
+			item = make(map[string]interface{})
+			paths[r.Path] = item
+		}
+		item[strings.ToLower(r.Method)] = r.operation()
+	}
+
+	schemas := make(map[string]interface{})
+	for name, v := range apiReplyTypes {
+		schemas[name] = goSchema(reflect.TypeOf(v))
+	}
+	for name, b := range apiBodyTypes {
+		schemas[name] = bodySchema(b.Kind, reflect.TypeOf(b.Type))
+	}
+	schemas["InstanceStatus"] = map[string]interface{}{
+		"description": "written by the API from node replies and by CBSD scripts, OutboxStatus while the command is queued",
+		"type":        "object",
+		"properties": map[string]interface{}{
+			"id":          map[string]interface{}{"type": "string"},
+			"status":      map[string]interface{}{"type": "string", "enum": []string{"queued", StatusPending, StatusRunning, StatusStopped, StatusFailed, StatusTimedOut}},
+			"is_power_on": map[string]interface{}{"type": "string", "enum": []string{"true", "false"}},
+			"progress":    map[string]interface{}{"type": "integer"},
+			"errcode":     map[string]interface{}{"type": "integer"},
+			"message":     map[string]interface{}{"type": "string"},
+			"job":         map[string]interface{}{"type": "integer"},
+		},
+	}
+
+	return map[string]interface{}{
+		"openapi": "3.1.0",
+		"info": map[string]interface{}{
+			"title":       "cbsd-mq-api",
+			"description": "CBSD MQ API: VM, jail and K8S cluster provisioning",
+			"version":     apiVersionLatest,
+		},
+		"servers": []interface{}{map[string]interface{}{"url": server_url}},
+		"paths":   paths,
+		"components": map[string]interface{}{
+			"schemas": schemas,
+			"parameters": map[string]interface{}{
+				"cid": map[string]interface{}{
+					"name": "cid", "in": "header",
+					"description": "tenant id: md5 or SHA256 fingerprint of the public key, set by signature when signed",
+					"schema":      map[string]interface{}{"type": "string"},
+				},
+			},
+			"securitySchemes": map[string]interface{}{
+				"signature": map[string]interface{}{
+					"type": "apiKey", "in": "header", "name": "Authorization",
+					"description": authScheme + ` keyid="<cid>",nonce="<nonce>",signature="<base64>" with Date header, see README`,
+				},
+			},
+			"responses": map[string]interface{}{
+				"Error": map[string]interface{}{
+					"description": "error envelope, {\"Message\": ..} with X-Api-Version: 1",
+					"content":     jsonContent(map[string]interface{}{"oneOf": []interface{}{schemaRef("Error"), schemaRef("LegacyError")}}),
+				},
+				"ValidationError": map[string]interface{}{
+					"description": "every invalid field of payload in details",
+					"content":     jsonContent(map[string]interface{}{"oneOf": []interface{}{schemaRef("Error"), schemaRef("ValidationError")}}),
+				},
+			},
+		},
+	}
+}
+
+// GET /api/v1/openapi.json
+func HandleOpenAPI(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, openAPISpec())
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+// every routed endpoint is described by the spec and vice versa
+func TestOpenAPIRoutes(t *testing.T) {
+	router := newRouter(&MyFeeds{f: &Feed{}})
+	otcRoutes(router, &MyFeeds{f: &Feed{}})
+	adminRoutes(router, &MyFeeds{f: &Feed{}})
+
+	paths := openAPISpec()["paths"].(map[string]interface{})
+	routed := make(map[string]bool)
+
+	err := router.Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+		methods, err := route.GetMethods()
+		if err != nil {
+			// admin subrouter prefix
+			return nil
+		}
+		path, err := route.GetPathTemplate()
+		if err != nil {
+			return err
+		}
+		for _, method := range methods {
+			routed[method+" "+path] = true
+			item, _ := paths[path].(map[string]interface{})
+			if _, ok := item[strings.ToLower(method)]; !ok {
+				t.Errorf("%s %s is not in openapi.go apiRoutes", method, path)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, r := range apiRoutes {
+		if !routed[r.Method+" "+r.Path] {
+			t.Errorf("%s %s is documented but not routed", r.Method, r.Path)
+		}
+		for _, m := range regexpPathParam.FindAllStringSubmatch(r.Path, -1) {
+			if apiPathParams[m[1]] == nil {
+				t.Errorf("%s: no schema of %s", r.Path, m[1])
+			}
+		}
+	}
+}
+
+// request schemas are json fields of Vm and Cluster, every field is
+// accepted by at least one image kind
+func TestOpenAPIBodies(t *testing.T) {
+	schemas := openAPISpec()["components"].(map[string]interface{})["schemas"].(map[string]interface{})
+
+	covered := make(map[reflect.Type]map[string]bool)
+	for name, b := range apiBodyTypes {
+		typ := reflect.TypeOf(b.Type)
+		fields := goSchema(typ)["properties"].(map[string]interface{})
+		if covered[typ] == nil {
+			covered[typ] = make(map[string]bool)
+		}
+		for field := range schemas[name].(map[string]interface{})["properties"].(map[string]interface{}) {
+			if fields[field] == nil {
+				t.Errorf("%s: %s is not a field of %s", name, field, typ.Name())
+			}
+			covered[typ][field] = true
+		}
+	}
+
+	for typ, got := range covered {
+		var missing []string
+		for field := range goSchema(typ)["properties"].(map[string]interface{}) {
+			if !got[field] {
+				missing = append(missing, field)
+			}
+		}
+		sort.Strings(missing)
+		if len(missing) > 0 {
+			t.Errorf("%s: %v are not in request schemas", typ.Name(), missing)
+		}
+	}
+}
+
+func TestOpenAPIEndpoint(t *testing.T) {
+	router := newRouter(&MyFeeds{f: &Feed{}})
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest("GET", "/api/v1/openapi.json", nil))
+	if rec.Code != 200 {
+		t.Fatalf("%d %s", rec.Code, rec.Body.String())
+	}
+
+	var spec struct {
+		OpenAPI string                 `json:"openapi"`
+		Paths   map[string]interface{} `json:"paths"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &spec); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(spec.OpenAPI, "3.") || spec.Paths["/api/v1/create/{InstanceId}"] == nil {
+		t.Errorf("spec: %s %v", spec.OpenAPI, spec.Paths)
+	}
+}
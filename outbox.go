@@ -0,0 +1,265 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+var outboxRetry = flag.Int("outbox_retry", 10, "Interval between publish attempts of queued commands, seconds")
+
+// ErrInFlight returned by Outbox.Dispatch of entry being published by another goroutine
+var ErrInFlight = errors.New("outbox: command is being published")
+
+// outbox is created in main: <spooldir>/outbox
+var outbox *Outbox
+
+// OutboxEntry is a command not yet accepted by the broker
+type OutboxEntry struct {
+	Id        string    `json:"id"`
+	Dispatch  Dispatch  `json:"dispatch"`
+	Job       Job       `json:"job"`
+	Attempts  int       `json:"attempts"`
+	LastError string    `json:"last_error"`
+	Created   time.Time `json:"created"`
+	Updated   time.Time `json:"updated"`
+
+	// first attempt belongs to the caller of Add, Flush skips the entry
+	owned bool
+}
+
+// OutboxStatus is the instance status while its command is queued
+type OutboxStatus struct {
+	Id        string    `json:"id"`
+	Status    string    `json:"status"`
+	Command   string    `json:"command"`
+	Progress  int       `json:"progress"`
+	Attempts  int       `json:"attempts"`
+	LastError string    `json:"last_error"`
+	Queued    time.Time `json:"queued"`
+}
+
+// Outbox keeps commands in dir, one <id>.json file each, from the HTTP
+// request until the broker accepts them. Entries left by the previous run
+// are loaded by newOutbox and published by Run.
+type Outbox struct {
+	dir      string
+	mu       sync.Mutex
+	entries  map[string]*OutboxEntry
+	inflight map[string]bool
+}
+
+func newOutbox(dir string) (*Outbox, error) {
+	if err := os.MkdirAll(dir, 0770); err != nil {
+		return nil, err
+	}
+
+	o := &Outbox{dir: dir, entries: make(map[string]*OutboxEntry), inflight: make(map[string]bool)}
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		e := &OutboxEntry{}
+		if err := json.Unmarshal(data, e); err != nil {
+			fmt.Printf("outbox: skip broken %s: %s\n", file, err.Error())
+			continue
+		}
+		o.entries[e.Id] = e
+	}
+	if len(o.entries) > 0 {
+		fmt.Printf("* Outbox: %d queued commands\n", len(o.entries))
+	}
+	return o, nil
+}
+
+func (o *Outbox) path(id string) string {
+	return filepath.Join(o.dir, id+".json")
+}
+
+// save writes e via temporary file, the entry is either old or new on crash
+func (o *Outbox) save(e *OutboxEntry) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(o.dir, "."+e.Id)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), o.path(e.Id))
+}
+
+// Add persists command d of job, the caller makes the first attempt by
+// Dispatch and gets the job id. Flush retries it after a failed attempt.
+func (o *Outbox) Add(d Dispatch, job Job) (*OutboxEntry, error) {
+	now := time.Now()
+	e := &OutboxEntry{
+		Id:       fmt.Sprintf("%d-%s", now.UnixNano(), newRequestId()),
+		Dispatch: d,
+		Job:      job,
+		Created:  now,
+		Updated:  now,
+		owned:    true,
+	}
+	if err := o.save(e); err != nil {
+		return nil, err
+	}
+
+	o.mu.Lock()
+	o.entries[e.Id] = e
+	o.mu.Unlock()
+	return e, nil
+}
+
+// List returns queued entries, oldest first
+func (o *Outbox) List() []OutboxEntry {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	list := make([]OutboxEntry, 0, len(o.entries))
+	for _, e := range o.entries {
+		list = append(list, *e)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Created.Before(list[j].Created) })
+	return list
+}
+
+// Pending returns the latest queued command of instance
+func (o *Outbox) Pending(cid string, instance string) *OutboxEntry {
+	if o == nil {
+		return nil
+	}
+
+	var pending *OutboxEntry
+	for _, e := range o.List() {
+		if e.Job.Cid == cid && e.Job.Instance == instance {
+			e := e
+			pending = &e
+		}
+	}
+	return pending
+}
+
+// Dispatch publishes e, on success it is removed from the outbox and
+// followed as job. Failed attempt is recorded in the entry.
+func (o *Outbox) Dispatch(ctx context.Context, e *OutboxEntry) (uint64, error) {
+	o.mu.Lock()
+	if o.inflight[e.Id] {
+		o.mu.Unlock()
+		return 0, ErrInFlight
+	}
+	o.inflight[e.Id] = true
+	o.mu.Unlock()
+
+	defer func() {
+		o.mu.Lock()
+		delete(o.inflight, e.Id)
+		o.mu.Unlock()
+	}()
+
+	id, err := broker.Publish(ctx, e.Dispatch.Tube, []byte(e.Dispatch.Body))
+
+	o.mu.Lock()
+	if err != nil {
+		e.Attempts++
+		e.LastError = err.Error()
+		e.Updated = time.Now()
+		e.owned = false
+		o.mu.Unlock()
+
+		if err := o.save(e); err != nil {
+			fmt.Printf("outbox: unable to save %s: %s\n", e.Id, err.Error())
+		}
+		return 0, err
+	}
+	delete(o.entries, e.Id)
+	o.mu.Unlock()
+
+	if err := os.Remove(o.path(e.Id)); err != nil {
+		fmt.Printf("outbox: unable to remove %s: %s\n", e.Id, err.Error())
+	}
+
+	return startJob(e.Dispatch, e.Job, id), nil
+}
+
+// Flush makes one publish attempt of every queued command
+func (o *Outbox) Flush(ctx context.Context) {
+	for _, e := range o.List() {
+		if ctx.Err() != nil {
+			return
+		}
+
+		o.mu.Lock()
+		entry, ok := o.entries[e.Id]
+		owned := ok && entry.owned
+		o.mu.Unlock()
+		if !ok || owned {
+			continue
+		}
+
+		if id, err := o.Dispatch(ctx, entry); err == nil {
+			fmt.Printf("outbox: %s %s/%s published as job %d after %d attempts\n",
+				e.Job.Command, e.Job.Cid, e.Job.Instance, id, e.Attempts+1)
+		} else if err != ErrInFlight {
+			fmt.Printf("outbox: %s %s/%s: attempt %d: %s\n", e.Job.Command, e.Job.Cid, e.Job.Instance, e.Attempts+1, err.Error())
+		}
+	}
+}
+
+// Run flushes the outbox every interval until ctx is done
+func (o *Outbox) Run(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		o.Flush(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// status of queued instance command
+func (e *OutboxEntry) status() OutboxStatus {
+	return OutboxStatus{
+		Id:        e.Job.Instance,
+		Status:    "queued",
+		Command:   e.Job.Command,
+		Attempts:  e.Attempts,
+		LastError: e.LastError,
+		Queued:    e.Created,
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// downBroker refuses every command
+type downBroker struct{}
+
+func (downBroker) Publish(ctx context.Context, tube string, body []byte) (uint64, error) {
+	return 0, errors.New("connection refused")
+}
+
+func (downBroker) Await(ctx context.Context, tube string, timeout time.Duration) ([]byte, error) {
+	return nil, ErrBrokerTimeout
+}
+
+func setupOutbox(t *testing.T) string {
+	t.Helper()
+
+	dir := filepath.Join(t.TempDir(), "outbox")
+	var err error
+	outbox, err = newOutbox(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { outbox = nil })
+	return dir
+}
+
+// command accepted while the broker is down is kept in the outbox,
+// shown by status and published once the broker is back
+func TestOutboxQueued(t *testing.T) {
+	setupInstances(t, 1)
+	dir := setupOutbox(t)
+	broker = downBroker{}
+
+	router := newRouter(&MyFeeds{f: &Feed{}})
+	do := func(path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		req.Header.Set("cid", testCid)
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s: %d %s", path, rec.Code, rec.Body.String())
+		}
+		return rec
+	}
+
+	var reply JobResponse
+	json.Unmarshal(do("/api/v1/stop/vm0").Body.Bytes(), &reply)
+	if reply.Job != 0 {
+		t.Errorf("job of queued command: %d", reply.Job)
+	}
+
+	var status OutboxStatus
+	json.Unmarshal(do("/api/v1/status/vm0").Body.Bytes(), &status)
+	if status.Status != "queued" || status.Command != "stop" || status.Attempts != 1 || status.LastError != "connection refused" {
+		t.Errorf("status: %+v", status)
+	}
+
+	// survives restart
+	reloaded, err := newOutbox(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if list := reloaded.List(); len(list) != 1 || list[0].Job.Instance != "vm0" {
+		t.Fatalf("reloaded: %+v", list)
+	}
+
+	broker = newMemoryBroker(MemoryConfig{})
+	outbox.Flush(context.Background())
+
+	if len(outbox.List()) != 0 {
+		t.Errorf("not published: %+v", outbox.List())
+	}
+	if files, _ := filepath.Glob(filepath.Join(dir, "*")); len(files) != 0 {
+		t.Errorf("left in spool: %v", files)
+	}
+	jobs, err := store.ListJobs(testCid, "vm0")
+	if err != nil || len(jobs) != 1 || jobs[0].Command != "stop" {
+		t.Errorf("jobs: %v %v", jobs, err)
+	}
+	if outbox.Pending(testCid, "vm0") != nil {
+		t.Error("still pending")
+	}
+}
+
+// queued destroy keeps the instance until the node gets the command
+func TestOutboxDestroy(t *testing.T) {
+	setupInstances(t, 1)
+	setupOutbox(t)
+	broker = downBroker{}
+
+	router := newRouter(&MyFeeds{f: &Feed{}})
+	req := httptest.NewRequest("GET", "/api/v1/destroy/vm0", nil)
+	req.Header.Set("cid", testCid)
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("%d %s", rec.Code, rec.Body.String())
+	}
+
+	if _, err := store.GetInstance(testCid, "vm0"); err != nil {
+		t.Fatalf("removed before publish: %v", err)
+	}
+
+	broker = newMemoryBroker(MemoryConfig{})
+	outbox.Flush(context.Background())
+
+	if _, err := store.GetInstance(testCid, "vm0"); err == nil {
+		t.Error("kept after publish")
+	}
+}
+
+// flush between Add and the first Dispatch leaves the entry to the
+// request, the request gets the job id
+func TestOutboxFirstAttempt(t *testing.T) {
+	setupInstances(t, 1)
+	setupOutbox(t)
+	broker = newMemoryBroker(MemoryConfig{})
+
+	d := Dispatch{Tube: "cbsd_node0_example_org", ReplyTubePrefix: "cbsd_node0_example_org_result_id", Body: "{}"}
+	e, err := outbox.Add(d, Job{Command: "stop", Instance: "vm0", Cid: testCid})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	outbox.Flush(context.Background())
+	if list := outbox.List(); len(list) != 1 || list[0].Attempts != 0 {
+		t.Fatalf("flushed before the first attempt: %+v", list)
+	}
+
+	id, err := outbox.Dispatch(context.Background(), e)
+	if err != nil || id == 0 {
+		t.Fatalf("dispatch: %d %v", id, err)
+	}
+	if job, err := store.GetJob(id); err != nil || job.Command != "stop" {
+		t.Errorf("job %d: %+v %v", id, job, err)
+	}
+
+	// failed first attempt is retried by flush
+	broker = downBroker{}
+	e, _ = outbox.Add(d, Job{Command: "start", Instance: "vm0", Cid: testCid})
+	if _, err := outbox.Dispatch(context.Background(), e); err == nil {
+		t.Fatal("published by down broker")
+	}
+	broker = newMemoryBroker(MemoryConfig{})
+	outbox.Flush(context.Background())
+	if list := outbox.List(); len(list) != 0 {
+		t.Errorf("not retried: %+v", list)
+	}
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// placement strategies, "placement" config key
+const (
+	placementSpread  = "spread"  // least loaded node which fits, default with nodes
+	placementBinpack = "binpack" // most loaded node which fits
+	placementScript  = "script"  // external recomendation script, default without nodes
+)
+
+var ErrNoNode = errors.New("placement: no node available")
+
+// placementMu serializes spread/binpack placement with the store update of
+// the placed instance, see getNodeRecomendation
+var placementMu sync.Mutex
+
+// recomendation field of create payload: node name, or comma separated label
+// rules: key=value ( affinity ), key!=value ( anti-affinity )
+var regexpPlacement = regexp.MustCompile(`^[a-zA-Z0-9_\-\.]+(!?=[a-zA-Z0-9_\-\.]+)?(,[a-zA-Z0-9_\-\.]+!?=[a-zA-Z0-9_\-\.]+)*$`)
+
+// hostname printed by recomendation script
+var regexpNodeName = regexp.MustCompile(`^[a-zA-Z0-9]([a-zA-Z0-9_\-\.]{0,252})$`)
+
+// Node of the inventory ( "nodes" config key ), zero capacity is unlimited
+type Node struct {
+	Name    string            `json:"name"`
+	Cpus    int               `json:"cpus"`
+	Ram     string            `json:"ram"`
+	Imgsize string            `json:"imgsize"`
+	Labels  map[string]string `json:"labels,omitempty"`
+}
+
+func (n *Node) capacity() Resources {
+	return Resources{Cpus: n.Cpus, RamMb: sizeMb(n.Ram), ImgsizeMb: sizeMb(n.Imgsize)}
+}
+
+// placementRule is parsed recomendation field
+type placementRule struct {
+	node     string
+	affinity map[string]string
+	anti     map[string]string
+}
+
+func parsePlacement(recomendation string) (placementRule, error) {
+	rule := placementRule{affinity: map[string]string{}, anti: map[string]string{}}
+	if len(recomendation) == 0 {
+		return rule, nil
+	}
+	if !regexpPlacement.MatchString(recomendation) {
+		return rule, fmt.Errorf("placement: bad recomendation: [%s]", recomendation)
+	}
+
+	for _, term := range strings.Split(recomendation, ",") {
+		if key, value, ok := strings.Cut(term, "!="); ok {
+			rule.anti[key] = value
+		} else if key, value, ok := strings.Cut(term, "="); ok {
+			rule.affinity[key] = value
+		} else {
+			rule.node = term
+		}
+	}
+	return rule, nil
+}
+
+func (rule placementRule) match(n *Node) bool {
+	if len(rule.node) > 0 && rule.node != n.Name {
+		return false
+	}
+	for key, value := range rule.affinity {
+		if n.Labels[key] != value {
+			return false
+		}
+	}
+	for key, value := range rule.anti {
+		if n.Labels[key] == value {
+			return false
+		}
+	}
+	return true
+}
+
+// placementStrategy of config, script when no nodes are configured nor
+// learned from heartbeats
+func placementStrategy() string {
+	if len(config.Placement) > 0 {
+		return config.Placement
+	}
+	if len(config.Nodes) == 0 && !heartbeatEnabled() {
+		return placementScript
+	}
+	return placementSpread
+}
+
+// inventoryNodes returns nodes available for placement: nodes of registry
+// with fresh heartbeat
+func inventoryNodes() []*Node {
+	return registry.Schedulable()
+}
+
+// nodeUsage sums resources and instances of every node
+func nodeUsage() (map[string]Resources, map[string]int, error) {
+	usage := make(map[string]Resources)
+	count := make(map[string]int)
+
+	list, err := store.ListInstances("")
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, inst := range list {
+		if len(inst.Node) == 0 {
+			continue
+		}
+		u := usage[inst.Node]
+		u.Cpus += inst.Resources.Cpus
+		u.RamMb += inst.Resources.RamMb
+		u.ImgsizeMb += inst.Resources.ImgsizeMb
+		usage[inst.Node] = u
+		count[inst.Node]++
+	}
+	return usage, count, nil
+}
+
+// load of node after placing r on it: the most used limited resource
+// ( 0..1 when fits ), instance count when capacity is unlimited.
+func load(capacity Resources, used Resources, instances int, r Resources) (float64, bool) {
+	score := 0.0
+	limited := false
+	for _, dim := range [][2]int64{
+		{int64(capacity.Cpus), int64(used.Cpus + r.Cpus)},
+		{capacity.RamMb, used.RamMb + r.RamMb},
+		{capacity.ImgsizeMb, used.ImgsizeMb + r.ImgsizeMb},
+	} {
+		if dim[0] == 0 {
+			continue
+		}
+		limited = true
+		if dim[1] > dim[0] {
+			return 0, false
+		}
+		if s := float64(dim[1]) / float64(dim[0]); s > score {
+			score = s
+		}
+	}
+	if !limited {
+		score = float64(instances + 1)
+	}
+	return score, true
+}
+
+// placeNode selects node for r by strategy from the inventory
+func placeNode(rule placementRule, r Resources, strategy string) (string, error) {
+	usage, count, err := nodeUsage()
+	if err != nil {
+		return "", err
+	}
+
+	type candidate struct {
+		name  string
+		score float64
+	}
+	var candidates []candidate
+
+	for _, n := range inventoryNodes() {
+		if !rule.match(n) {
+			continue
+		}
+		score, fits := load(n.capacity(), usage[n.Name], count[n.Name], r)
+		if !fits {
+			fmt.Printf("placement: %s has no capacity\n", n.Name)
+			continue
+		}
+		candidates = append(candidates, candidate{n.Name, score})
+	}
+
+	if len(candidates) == 0 {
+		return "", ErrNoNode
+	}
+
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].score != candidates[j].score {
+			if strategy == placementBinpack {
+				return candidates[i].score > candidates[j].score
+			}
+			return candidates[i].score < candidates[j].score
+		}
+		return candidates[i].name < candidates[j].name
+	})
+
+	fmt.Printf("placement %s: %v\n", strategy, candidates)
+	return candidates[0].name, nil
+}
+
+// scriptNode asks config.Recomendation script, args are the payload values
+func scriptNode(args string) (string, error) {
+	cmdArgs := strings.Fields(fmt.Sprintf("%s %s", config.Recomendation, args))
+	out, err := exec.Command(cmdArgs[0], cmdArgs[1:]...).Output()
+	if err != nil {
+		fmt.Printf("get recomendation script failed: %s\n", err.Error())
+		return "", fmt.Errorf("%w: recomendation script failed", ErrNoNode)
+	}
+
+	node := strings.TrimSpace(string(out))
+	if !regexpNodeName.MatchString(node) {
+		fmt.Printf("recomendation script: bad node name: [%s]\n", node)
+		return "", fmt.Errorf("%w: bad recomendation script output", ErrNoNode)
+	}
+	if err := checkSchedulable(node); err != nil {
+		return "", err
+	}
+	return node, nil
+}
+
+// checkSchedulable refuses node not known by registry or without fresh
+// heartbeat, when heartbeats are enabled: the command would wait in the
+// tube nobody reads until timeout
+func checkSchedulable(node string) error {
+	if !heartbeatEnabled() {
+		return nil
+	}
+	for _, n := range registry.Schedulable() {
+		if n.Name == node {
+			return nil
+		}
+	}
+	fmt.Printf("placement: %s is not alive\n", node)
+	return fmt.Errorf("%w: %s is not alive", ErrNoNode, node)
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func setupNodes(t *testing.T, placement string, nodes ...Node) {
+	t.Helper()
+	config.Nodes = nodes
+	config.Placement = placement
+	config.PlacementFallback = false
+	registry = newNodeRegistry()
+	registry.Load(nodes)
+	t.Cleanup(func() {
+		registry = newNodeRegistry()
+		config.Nodes = nil
+		config.Placement = ""
+		config.PlacementFallback = false
+	})
+}
+
+func TestPlaceNode(t *testing.T) {
+	setupInstances(t, 0)
+	setupNodes(t, "",
+		Node{Name: "n1", Cpus: 8, Ram: "16g", Labels: map[string]string{"zone": "a"}},
+		Node{Name: "n2", Cpus: 8, Ram: "16g", Labels: map[string]string{"zone": "b", "gpu": "yes"}},
+		Node{Name: "n3", Cpus: 4, Ram: "8g", Labels: map[string]string{"zone": "b"}},
+	)
+	// n1 is half full, n3 is 3/4 full
+	for _, inst := range []*Instance{
+		{Cid: testCid, Id: "a", Kind: KindVm, Node: "n1", Resources: Resources{Cpus: 4, RamMb: 4096}},
+		{Cid: testCid, Id: "b", Kind: KindVm, Node: "n3", Resources: Resources{Cpus: 3, RamMb: 1024}},
+	} {
+		if err := store.PutInstance(inst); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	vm := Resources{Cpus: 1, RamMb: 1024}
+	for _, tt := range []struct {
+		name     string
+		strategy string
+		offer    string
+		r        Resources
+		node     string
+	}{
+		{"spread", placementSpread, "", vm, "n2"},
+		{"binpack", placementBinpack, "", vm, "n3"},
+		{"binpack, n3 is full", placementBinpack, "", Resources{Cpus: 2}, "n1"},
+		{"affinity", placementSpread, "zone=a", vm, "n1"},
+		{"anti-affinity", placementSpread, "zone=b,gpu!=yes", vm, "n3"},
+		{"forced", placementSpread, "n3", vm, "n3"},
+		{"forced, no capacity", placementSpread, "n3", Resources{Cpus: 2}, ""},
+		{"unknown node", placementSpread, "n9", vm, ""},
+		{"too big", placementSpread, "", Resources{Cpus: 9}, ""},
+	} {
+		rule, err := parsePlacement(tt.offer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		node, err := placeNode(rule, tt.r, tt.strategy)
+		if node != tt.node {
+			t.Errorf("%s: %s %v, want %s", tt.name, node, err, tt.node)
+		}
+		if len(tt.node) == 0 && !errors.Is(err, ErrNoNode) {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+	}
+
+	if _, err := parsePlacement("zone=a,n1"); err == nil {
+		t.Errorf("node after rules is accepted")
+	}
+}
+
+func TestScriptPlacement(t *testing.T) {
+	setupInstances(t, 0)
+
+	script := func(body string) {
+		if err := os.WriteFile(config.Recomendation, []byte("#!/bin/sh\n"+body+"\n"), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// reservation of the create
+	placed := func(r Resources) *Instance {
+		return &Instance{Cid: testCid, Id: "placed", Kind: KindVm, Resources: r}
+	}
+
+	// no nodes: recomendation script
+	setupNodes(t, "")
+	script(`echo " node1.example.org "`)
+	node, tube, _, err := getNodeRecomendation("debian12 1 1g", "", placed(Resources{}))
+	if err != nil || node != "node1.example.org" || tube != "cbsd_node1_example_org" {
+		t.Errorf("script: %s %s %v", node, tube, err)
+	}
+
+	node, _, _, err = getNodeRecomendation("debian12 1 1g", "forced.example.org", placed(Resources{}))
+	if err != nil || node != "forced.example.org" {
+		t.Errorf("forced: %s %v", node, err)
+	}
+
+	for _, body := range []string{"exit 1", `echo "node1; rm -rf /"`, "true"} {
+		script(body)
+		if node, _, _, err := getNodeRecomendation("", "", placed(Resources{})); !errors.Is(err, ErrNoNode) {
+			t.Errorf("[%s]: %s %v", body, node, err)
+		}
+	}
+
+	// fallback when no node fits
+	setupNodes(t, placementSpread, Node{Name: "small", Cpus: 1})
+	script(`echo big.example.org`)
+	if _, _, _, err := getNodeRecomendation("", "", placed(Resources{Cpus: 2})); !errors.Is(err, ErrNoNode) {
+		t.Errorf("without fallback: %v", err)
+	}
+	config.PlacementFallback = true
+	if node, _, _, err := getNodeRecomendation("", "", placed(Resources{Cpus: 2})); err != nil || node != "big.example.org" {
+		t.Errorf("fallback: %s %v", node, err)
+	}
+	if node, _, _, err := getNodeRecomendation("", "", placed(Resources{Cpus: 1})); err != nil || node != "small" {
+		t.Errorf("fits: %s %v", node, err)
+	}
+}
+
+// concurrent creates do not overcommit the node: each placed reservation
+// counts against its capacity
+func TestConcurrentPlacement(t *testing.T) {
+	const n = 8
+
+	setupInstances(t, 0)
+	setupNodes(t, placementSpread, Node{Name: "n1", Cpus: 4})
+
+	var wg sync.WaitGroup
+	var placed int64
+	for i := 0; i < n; i++ {
+		inst := &Instance{Cid: testCid, Id: fmt.Sprintf("racer%d", i), Kind: KindVm, Resources: Resources{Cpus: 1}}
+		if err := store.PutInstance(inst); err != nil {
+			t.Fatal(err)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, _, _, err := getNodeRecomendation("", "", inst); err == nil {
+				atomic.AddInt64(&placed, 1)
+			} else if !errors.Is(err, ErrNoNode) {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if placed != 4 {
+		t.Errorf("%d instances placed on 4 cpus", placed)
+	}
+}
+
+// with heartbeats the script may not place on a stale node, even as fallback
+func TestScriptPlacementStale(t *testing.T) {
+	setupInstances(t, 0)
+	nodes := []Node{{Name: "n1", Cpus: 4}, {Name: "n2", Cpus: 4}}
+	setupNodes(t, placementSpread, nodes...)
+	setupRegistry(t, "cbsd_heartbeat", nodes...)
+	if err := os.WriteFile(config.Recomendation, []byte("#!/bin/sh\necho n1\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	placed := &Instance{Cid: testCid, Id: "placed", Kind: KindVm, Resources: Resources{Cpus: 1}}
+
+	// every node is stale: n1 missed heartbeat_ttl, n2 never sent one
+	if err := registry.Heartbeat(Heartbeat{Node: "n1"}, time.Now().Add(-2*time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	config.PlacementFallback = true
+	if node, _, _, err := getNodeRecomendation("", "", placed); !errors.Is(err, ErrNoNode) {
+		t.Errorf("fallback to stale node: %s %v", node, err)
+	}
+
+	config.Placement = placementScript
+	if node, _, _, err := getNodeRecomendation("", "", placed); !errors.Is(err, ErrNoNode) {
+		t.Errorf("script: stale node: %s %v", node, err)
+	}
+
+	if err := registry.Heartbeat(Heartbeat{Node: "n1"}, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if node, _, _, err := getNodeRecomendation("", "", placed); err != nil || node != "n1" {
+		t.Errorf("script: alive node: %s %v", node, err)
+	}
+	if node, _, _, err := getNodeRecomendation("", "n2", placed); !errors.Is(err, ErrNoNode) {
+		t.Errorf("forced stale node: %s %v", node, err)
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strings"
+	"time"
+)
+
+var regexpParamName = regexp.MustCompile(`^[a-z_]+$`)
+
+// jsonProtocol is CommentProtocol of CBSD tubes: Comment as JSON object
+type jsonProtocol struct{}
+
+var protocol CommentProtocol = jsonProtocol{}
+
+func (jsonProtocol) Encode(comment *Comment) ([]byte, error) {
+	if len(comment.Command) == 0 {
+		return nil, errors.New("protocol: empty Command")
+	}
+	return json.Marshal(comment)
+}
+
+func (jsonProtocol) Decode(encodedComment []byte) (*Comment, error) {
+	comment := &Comment{}
+
+	dec := json.NewDecoder(bytes.NewReader(encodedComment))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(comment); err != nil {
+		return nil, err
+	}
+	if len(comment.Command) == 0 {
+		return nil, errors.New("protocol: empty Command")
+	}
+	return comment, nil
+}
+
+// newComment returns command to the node with the CommandArgs mode set
+func newComment(command string, mode string) *Comment {
+	return &Comment{
+		Command:     command,
+		Date:        time.Now(),
+		CommandArgs: map[string]string{"mode": mode},
+	}
+}
+
+// instanceComment returns mode command ( start, stop, destroy ) of inst
+func instanceComment(command string, mode string, inst *Instance) *Comment {
+	comment := newComment(command, mode)
+	if inst.Kind == KindK8s {
+		comment.CommandArgs["k8s_name"] = inst.Jname
+	} else {
+		comment.CommandArgs["jname"] = inst.Jname
+	}
+	return comment
+}
+
+// commandBody encodes comment as broker payload
+func commandBody(comment *Comment) (string, error) {
+	b, err := protocol.Encode(comment)
+	if err != nil {
+		return "", err
+	}
+	fmt.Printf("CMD: [%s]\n", b)
+	return string(b), nil
+}
+
+// jconfArgs adds non-empty fields of payload struct v to args as lowercase
+// jconf params, values of fields not listed in trusted must match
+// regexpParamVal. Returns the values as recomendation script args.
+func jconfArgs(v interface{}, args map[string]string, trusted ...string) string {
+	var recomendation strings.Builder
+
+	val := reflect.ValueOf(v)
+	for i := 0; i < val.NumField(); i++ {
+		valueField := val.Field(i)
+		typeField := val.Type().Field(i)
+
+		tmpval := jconfValue(valueField)
+		if len(tmpval) == 0 {
+			continue
+		}
+		if len(tmpval) > schemaMaxLength {
+			fmt.Printf("Error: param val too long\n")
+			continue
+		}
+
+		jconf_param := strings.ToLower(typeField.Name)
+		if !regexpParamName.MatchString(jconf_param) {
+			fmt.Printf("Error: wrong paramname: [%s]\n", jconf_param)
+			continue
+		}
+
+		isTrusted := false
+		for _, name := range trusted {
+			if name == jconf_param {
+				isTrusted = true
+			}
+		}
+		if !isTrusted && !regexpParamVal.MatchString(tmpval) {
+			fmt.Printf("Error: wrong paramval for %s: [%s]\n", jconf_param, tmpval)
+			continue
+		}
+
+		fmt.Printf("jconf: %s,\tField Name: %s,\t Field Value: %s\n", jconf_param, typeField.Name, tmpval)
+
+		args[jconf_param] = tmpval
+		recomendation.WriteString(tmpval)
+		recomendation.WriteString(" ")
+	}
+
+	return recomendation.String()
+}
+
+// vmCreateComment returns create command of VM/jail jname and the
+// recomendation script args. vm.Jname is the InstanceId.
+func vmCreateComment(vm Vm, runscript string, jname string) (*Comment, string) {
+	comment := newComment(runscript, "create")
+
+	Jname := vm.Jname
+	vm.Jname = ""
+	recomendation := jconfArgs(vm, comment.CommandArgs,
+		"vm_os_type", "vm_os_profile", "type", "imgsize", "ram", "cpus", "pkglist", "pubkey", "host_hostname")
+
+	// fixed params can not be overridden by payload
+	comment.CommandArgs["mode"] = "create"
+	comment.CommandArgs["jname"] = jname
+	comment.CommandArgs["emulator"] = vm_Engine
+	if len(vm.Host_hostname) > 1 {
+		comment.CommandArgs["host_hostname"] = vm.Host_hostname
+	} else {
+		comment.CommandArgs["host_hostname"] = Jname
+	}
+
+	return comment, recomendation
+}
+
+// k8sCreateComment returns init command of K8S cluster jname and the
+// recomendation script args
+func k8sCreateComment(cluster Cluster, jname string) (*Comment, string) {
+	comment := newComment(*runScriptK8s, "init")
+
+	cluster.K8s_name = ""
+	recomendation := jconfArgs(cluster, comment.CommandArgs,
+		"init_masters", "init_workers", "master_vm_ram", "master_vm_cpus", "master_vm_imgsize",
+		"worker_vm_ram", "worker_vm_cpus", "worker_vm_imgsize", "pv_enable", "kubelet_master",
+		"pubkey", "email", "callback")
+
+	comment.CommandArgs["mode"] = "init"
+	comment.CommandArgs["k8s_name"] = jname
+
+	return comment, recomendation
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"testing"
+	"unicode/utf8"
+)
+
+// CommandArgs keys create command may carry: payload fields and fixed params
+var vmCreateArgs = map[string]bool{
+	"mode": true, "jname": true, "emulator": true, "host_hostname": true,
+	"image": true, "type": true, "vm_os_type": true, "vm_os_profile": true, "ram": true, "cpus": true,
+	"imgsize": true, "pubkey": true, "pkglist": true, "extras": true, "recomendation": true,
+	"email": true, "callback": true,
+}
+
+var k8sCreateArgs = map[string]bool{
+	"mode": true, "k8s_name": true,
+	"image": true, "init_masters": true, "init_workers": true, "master_vm_ram": true, "master_vm_cpus": true,
+	"master_vm_imgsize": true, "worker_vm_ram": true, "worker_vm_cpus": true, "worker_vm_imgsize": true,
+	"pv_enable": true, "pv_size": true, "kubelet_master": true, "email": true, "callback": true,
+	"pubkey": true, "recomendation": true,
+}
+
+// roundTrip encodes and decodes comment as the node does
+func roundTrip(t *testing.T, comment *Comment) *Comment {
+	b, err := protocol.Encode(comment)
+	if err != nil {
+		t.Fatalf("encode: %s", err)
+	}
+	decoded, err := protocol.Decode(b)
+	if err != nil {
+		t.Fatalf("decode: %s: %s", err, b)
+	}
+	return decoded
+}
+
+func checkArgs(t *testing.T, comment *Comment, allowed map[string]bool) {
+	for key := range comment.CommandArgs {
+		if !allowed[key] {
+			t.Errorf("unexpected CommandArgs key %q", key)
+		}
+	}
+}
+
+func FuzzVmCreateComment(f *testing.F) {
+	f.Add("ssh-ed25519 AAAA test@localhost", "nginx", "host1", "debian12", "1g", 2)
+	f.Add(`ssh-ed25519 AAAA x", "Command": "rm", "x": "`, `","CommandArgs":{"mode":"destroy"}}`, `host\"`, `debian12\u0022`, "\\", -1)
+	f.Add("\x00\xff", "\n", "\"}}", "jail", "", 0)
+
+	f.Fuzz(func(t *testing.T, pubkey string, pkglist string, hostname string, image string, ram string, cpus int) {
+		vm := Vm{Jname: "vm1", Pubkey: pubkey, PkgList: pkglist, Host_hostname: hostname, Image: image, Ram: ram, Cpus: cpus, Extras: pubkey}
+
+		comment, _ := vmCreateComment(vm, "vm-api", "env1")
+		decoded := roundTrip(t, comment)
+
+		if decoded.Command != "vm-api" {
+			t.Errorf("Command: %q", decoded.Command)
+		}
+		if decoded.CommandArgs["mode"] != "create" || decoded.CommandArgs["jname"] != "env1" {
+			t.Errorf("fixed args altered: %v", decoded.CommandArgs)
+		}
+		checkArgs(t, decoded, vmCreateArgs)
+
+		// values are passed as is
+		if utf8.ValidString(pubkey) && len(pubkey) > 0 && len(pubkey) <= schemaMaxLength && decoded.CommandArgs["pubkey"] != pubkey {
+			t.Errorf("pubkey: %q, want %q", decoded.CommandArgs["pubkey"], pubkey)
+		}
+	})
+}
+
+func FuzzK8sCreateComment(f *testing.F) {
+	f.Add("ssh-ed25519 AAAA test@localhost", "2g", "a@b.c", 1)
+	f.Add(`x","Command":"rm`, `"},"Command":"rm","CommandArgs":{"k8s_name":"x`, "\"", -5)
+
+	f.Fuzz(func(t *testing.T, pubkey string, ram string, email string, masters int) {
+		cluster := Cluster{K8s_name: "k1", Pubkey: pubkey, Master_vm_ram: ram, Worker_vm_ram: ram, Email: email, Callback: email, Init_masters: masters, Master_vm_cpus: &masters}
+
+		comment, _ := k8sCreateComment(cluster, "env1")
+		decoded := roundTrip(t, comment)
+
+		if decoded.Command != *runScriptK8s {
+			t.Errorf("Command: %q", decoded.Command)
+		}
+		if decoded.CommandArgs["mode"] != "init" || decoded.CommandArgs["k8s_name"] != "env1" {
+			t.Errorf("fixed args altered: %v", decoded.CommandArgs)
+		}
+		checkArgs(t, decoded, k8sCreateArgs)
+	})
+}
+
+func FuzzCommentProtocol(f *testing.F) {
+	f.Add("control-api", "jname", "env1")
+	f.Add(`a"b`, `"}`, "\\u0000\"")
+
+	f.Fuzz(func(t *testing.T, command string, key string, value string) {
+		if len(command) == 0 || !utf8.ValidString(command) || !utf8.ValidString(key) || !utf8.ValidString(value) {
+			t.Skip()
+		}
+
+		comment := newComment(command, "start")
+		comment.CommandArgs[key] = value
+		decoded := roundTrip(t, comment)
+
+		if decoded.Command != command {
+			t.Errorf("Command: %q, want %q", decoded.Command, command)
+		}
+		if len(decoded.CommandArgs) != len(comment.CommandArgs) || decoded.CommandArgs[key] != value {
+			t.Errorf("CommandArgs: %v, want %v", decoded.CommandArgs, comment.CommandArgs)
+		}
+	})
+}
+
+func TestInstanceComment(t *testing.T) {
+	for kind, key := range map[string]string{KindVm: "jname", KindK8s: "k8s_name"} {
+		decoded := roundTrip(t, instanceComment("control-api", "stop", &Instance{Jname: `env"1`, Kind: kind}))
+		if decoded.CommandArgs[key] != `env"1` || len(decoded.CommandArgs) != 2 {
+			t.Errorf("%s: %v", kind, decoded.CommandArgs)
+		}
+	}
+}
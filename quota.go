@@ -0,0 +1,234 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var (
+	quotaInstances = flag.Int("quota_instances", 0, "Default max VM/jail instances per CID, 0 - unlimited")
+	quotaCpus      = flag.Int("quota_cpus", 0, "Default max total cpus per CID, 0 - unlimited")
+	quotaRam       = flag.String("quota_ram", "", "Default max total ram per CID, e.g: 64g, empty - unlimited")
+	quotaImgsize   = flag.String("quota_imgsize", "", "Default max total imgsize per CID, e.g: 500g, empty - unlimited")
+	quotaK8s       = flag.Int("quota_k8s", 0, "Default max K8S clusters per CID, 0 - unlimited")
+)
+
+var ErrQuota = errors.New("quota exceeded")
+
+// error code of ErrQuota, 429 is limit_exceeded of the queue otherwise
+const errCodeQuota = "quota_exceeded"
+
+// Resources of instance, sizes in megabytes
+type Resources struct {
+	Cpus      int   `json:"cpus"`
+	RamMb     int64 `json:"ram_mb"`
+	ImgsizeMb int64 `json:"imgsize_mb"`
+}
+
+// Quota of CID, 0 is unlimited. Usage of CID is Quota too.
+type Quota struct {
+	Instances int `json:"instances"`
+	K8s       int `json:"k8s"`
+	Resources
+}
+
+// QuotaResponse is reply of /api/v1/quota
+type QuotaResponse struct {
+	Limit Quota `json:"limit"`
+	Usage Quota `json:"usage"`
+}
+
+// sizeMb converts 512m, 2g, 1t ( regexpSize ) to megabytes, 0 when empty or invalid
+func sizeMb(size string) int64 {
+	if !regexpSize.MatchString(size) {
+		return 0
+	}
+	n, err := strconv.ParseInt(size[:len(size)-1], 10, 64)
+	if err != nil {
+		return 0
+	}
+	switch size[len(size)-1] {
+	case 'g':
+		n *= 1024
+	case 't':
+		n *= 1024 * 1024
+	}
+	return n
+}
+
+func vmResources(vm Vm) Resources {
+	return Resources{Cpus: vm.Cpus, RamMb: sizeMb(vm.Ram), ImgsizeMb: sizeMb(vm.Imgsize)}
+}
+
+// k8sResources sums master and worker VMs and PV of the cluster
+func k8sResources(cluster Cluster) Resources {
+	masters := cluster.Init_masters
+	if masters == 0 {
+		masters = 1
+	}
+	workers := cluster.Init_workers
+
+	var r Resources
+	if cluster.Master_vm_cpus != nil {
+		r.Cpus += masters * *cluster.Master_vm_cpus
+	}
+	if cluster.Worker_vm_cpus != nil {
+		r.Cpus += workers * *cluster.Worker_vm_cpus
+	}
+	r.RamMb = int64(masters)*sizeMb(cluster.Master_vm_ram) + int64(workers)*sizeMb(cluster.Worker_vm_ram)
+	r.ImgsizeMb = int64(masters)*sizeMb(cluster.Master_vm_imgsize) + int64(workers)*sizeMb(cluster.Worker_vm_imgsize)
+	if cluster.Pv_enable == 1 {
+		r.ImgsizeMb += sizeMb(cluster.Pv_size)
+	}
+	return r
+}
+
+// defaultQuota is set by -quota_* flags
+func defaultQuota() Quota {
+	return Quota{
+		Instances: *quotaInstances,
+		K8s:       *quotaK8s,
+		Resources: Resources{Cpus: *quotaCpus, RamMb: sizeMb(*quotaRam), ImgsizeMb: sizeMb(*quotaImgsize)},
+	}
+}
+
+// merge returns q with the limits set in key, key limits win
+func (q Quota) merge(key Quota) Quota {
+	if key.Instances > 0 {
+		q.Instances = key.Instances
+	}
+	if key.K8s > 0 {
+		q.K8s = key.K8s
+	}
+	if key.Cpus > 0 {
+		q.Cpus = key.Cpus
+	}
+	if key.RamMb > 0 {
+		q.RamMb = key.RamMb
+	}
+	if key.ImgsizeMb > 0 {
+		q.ImgsizeMb = key.ImgsizeMb
+	}
+	return q
+}
+
+// keyQuota returns quota of allowlist key, p may be nil
+func keyQuota(p *AllowList) Quota {
+	if p == nil {
+		return defaultQuota()
+	}
+	return defaultQuota().merge(p.quota)
+}
+
+// quotaLocks serializes reserveQuota of cid: *sync.Mutex by cid
+var quotaLocks sync.Map
+
+// tenantUsage sums instances of cid, legacy instances have no resources
+// recorded. Reservations not passed reserveQuota yet are not counted.
+func tenantUsage(cid string) (Quota, error) {
+	var usage Quota
+
+	list, err := store.ListInstances(cid)
+	if err != nil {
+		return usage, err
+	}
+	for _, inst := range list {
+		if len(inst.Jname) == 0 && inst.Resources == (Resources{}) {
+			continue
+		}
+		if inst.Kind == KindK8s {
+			usage.K8s++
+		} else {
+			usage.Instances++
+		}
+		usage.Cpus += inst.Resources.Cpus
+		usage.RamMb += inst.Resources.RamMb
+		usage.ImgsizeMb += inst.Resources.ImgsizeMb
+	}
+	return usage, nil
+}
+
+// exceeded returns limits of q below usage
+func (q Quota) exceeded(usage Quota) []string {
+	var over []string
+	check := func(name string, used int64, limit int64) {
+		if limit > 0 && used > limit {
+			over = append(over, fmt.Sprintf("%s %d/%d", name, used, limit))
+		}
+	}
+	check("instances", int64(usage.Instances), int64(q.Instances))
+	check("k8s", int64(usage.K8s), int64(q.K8s))
+	check("cpus", int64(usage.Cpus), int64(q.Cpus))
+	check("ram_mb", usage.RamMb, q.RamMb)
+	check("imgsize_mb", usage.ImgsizeMb, q.ImgsizeMb)
+	return over
+}
+
+// reserveQuota checks quota of the tenant with r of reserved instance and
+// records r on it. Check and put are serialized per cid: of concurrent
+// creates near the limit the ones that fit pass. Returns HTTP status and error.
+func reserveQuota(res *reservation, r Resources, quota Quota) (int, error) {
+	mu, _ := quotaLocks.LoadOrStore(res.inst.Cid, &sync.Mutex{})
+	mu.(*sync.Mutex).Lock()
+	defer mu.(*sync.Mutex).Unlock()
+
+	usage, err := tenantUsage(res.inst.Cid)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	if res.inst.Kind == KindK8s {
+		usage.K8s++
+	} else {
+		usage.Instances++
+	}
+	usage.Cpus += r.Cpus
+	usage.RamMb += r.RamMb
+	usage.ImgsizeMb += r.ImgsizeMb
+	if over := quota.exceeded(usage); len(over) > 0 {
+		return http.StatusTooManyRequests, fmt.Errorf("%w: %s", ErrQuota, strings.Join(over, ", "))
+	}
+
+	res.inst.Resources = r
+	if err := store.PutInstance(res.inst); err != nil {
+		return http.StatusInternalServerError, err
+	}
+	return http.StatusOK, nil
+}
+
+// HandleQuota replies quota and usage of cid
+func (feeds *MyFeeds) HandleQuota(w http.ResponseWriter, r *http.Request) {
+	Cid := r.Header.Get("cid")
+	if !validateCid(Cid) {
+		JSONError(w, "The cid should be valid form: ^[a-f0-9]{32}$", http.StatusUnauthorized)
+		return
+	}
+
+	if !isCidAllowed(feeds, Cid) {
+		fmt.Printf("CID not in ACL: %s\n", Cid)
+		JSONError(w, "not allowed", http.StatusForbidden)
+		return
+	}
+
+	if !isPermitted(feeds, Cid, permRead) {
+		JSONError(w, ErrPermission.Error(), http.StatusForbidden)
+		return
+	}
+
+	usage, err := tenantUsage(Cid)
+	if err != nil {
+		fmt.Printf("quota: %s: %s\n", Cid, err.Error())
+		JSONError(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	var p *AllowList
+	if acl_enable {
+		p = feeds.allowEntry(Cid)
+	}
+	writeJSON(w, QuotaResponse{Limit: keyQuota(p), Usage: usage})
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSizeMb(t *testing.T) {
+	for size, mb := range map[string]int64{
+		"512m": 512,
+		"2g":   2048,
+		"1t":   1024 * 1024,
+		"0":    0,
+		"":     0,
+		"10x":  0,
+	} {
+		if got := sizeMb(size); got != mb {
+			t.Errorf("%s: %d, want %d", size, got, mb)
+		}
+	}
+}
+
+func TestK8sResources(t *testing.T) {
+	two, four := 2, 4
+	r := k8sResources(Cluster{
+		Init_masters: 3, Master_vm_cpus: &two, Master_vm_ram: "2g", Master_vm_imgsize: "10g",
+		Init_workers: 2, Worker_vm_cpus: &four, Worker_vm_ram: "4g", Worker_vm_imgsize: "20g",
+		Pv_enable: 1, Pv_size: "100g",
+	})
+	want := Resources{Cpus: 14, RamMb: 14 * 1024, ImgsizeMb: 170 * 1024}
+	if r != want {
+		t.Errorf("%+v, want %+v", r, want)
+	}
+}
+
+func TestReserveQuota(t *testing.T) {
+	setupInstances(t, 0)
+
+	quota := Quota{Instances: 2, Resources: Resources{Cpus: 4}}
+	vm := Resources{Cpus: 1, RamMb: 1024, ImgsizeMb: 10240}
+
+	for i, tt := range []struct {
+		id   string
+		r    Resources
+		code int
+	}{
+		{"vm1", vm, http.StatusOK},
+		{"vm2", Resources{Cpus: 4}, http.StatusTooManyRequests},
+		{"vm3", vm, http.StatusOK},
+		{"vm4", vm, http.StatusTooManyRequests},
+	} {
+		res, err := reserveInstance(testCid, tt.id, KindVm)
+		if err != nil {
+			t.Fatal(err)
+		}
+		code, err := reserveQuota(res, tt.r, quota)
+		if code != tt.code {
+			t.Errorf("%d %s: %d %v", i, tt.id, code, err)
+		}
+		if code == http.StatusOK {
+			res.Commit()
+		} else if !errors.Is(err, ErrQuota) {
+			t.Errorf("%s: %v", tt.id, err)
+		}
+		res.Release()
+	}
+
+	usage, err := tenantUsage(testCid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usage.Instances != 2 || usage.Cpus != 2 || usage.RamMb != 2048 {
+		t.Errorf("usage: %+v", usage)
+	}
+}
+
+func TestQuotaEndpoint(t *testing.T) {
+	setupInstances(t, 1)
+	acl_enable = true
+	t.Cleanup(func() { acl_enable = false })
+	*quotaCpus = 8
+	t.Cleanup(func() { *quotaCpus = 0 })
+
+	line := testKeyLine("dev@example.org")
+	path := filepath.Join(t.TempDir(), "cbsd-mq-api.allow")
+	writeAllowList(t, path, `max_instances=5,max_ram="64g" `+line+"\n", time.Now())
+	f, err := loadAllowList(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cid := allowCid(t, line)
+	if err := store.PutInstance(&Instance{Cid: cid, Id: "vm1", Kind: KindVm, Resources: Resources{Cpus: 2, RamMb: 4096}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.PutInstance(&Instance{Cid: cid, Id: "k1", Kind: KindK8s, Resources: Resources{Cpus: 4}}); err != nil {
+		t.Fatal(err)
+	}
+
+	router := newRouter(&MyFeeds{f: f})
+	for _, tt := range []struct {
+		cid  string
+		code int
+		want QuotaResponse
+	}{
+		{cid, http.StatusOK, QuotaResponse{
+			Limit: Quota{Instances: 5, Resources: Resources{Cpus: 8, RamMb: 64 * 1024}},
+			Usage: Quota{Instances: 1, K8s: 1, Resources: Resources{Cpus: 6, RamMb: 4096}},
+		}},
+		// not in the allowlist
+		{testCid, http.StatusForbidden, QuotaResponse{}},
+	} {
+		req := httptest.NewRequest("GET", "/api/v1/quota", nil)
+		req.Header.Set("cid", tt.cid)
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		if rec.Code != tt.code {
+			t.Errorf("%s: %d %s", tt.cid, rec.Code, rec.Body.String())
+			continue
+		}
+		if rec.Code != http.StatusOK {
+			continue
+		}
+		var got QuotaResponse
+		if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("%s: %+v, want %+v", tt.cid, got, tt.want)
+		}
+	}
+}
+
+// concurrent creates at limit-1: exactly one fits
+func TestReserveQuotaConcurrent(t *testing.T) {
+	const n = 8
+
+	setupInstances(t, 0)
+	quota := Quota{Instances: 3, Resources: Resources{Cpus: 4}}
+	vm := Resources{Cpus: 1, RamMb: 1024}
+
+	for _, id := range []string{"vm1", "vm2"} {
+		if err := store.PutInstance(&Instance{Cid: testCid, Id: id, Jname: id, Kind: KindVm, Resources: vm}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// all reserved before any quota check
+	var reserved []*reservation
+	for i := 0; i < n; i++ {
+		res, err := reserveInstance(testCid, fmt.Sprintf("racer%d", i), KindVm)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Release()
+		reserved = append(reserved, res)
+	}
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	codes := map[int]int{}
+	for _, res := range reserved {
+		wg.Add(1)
+		go func(res *reservation) {
+			defer wg.Done()
+			code, _ := reserveQuota(res, vm, quota)
+			if code == http.StatusOK {
+				res.Commit()
+			}
+			mu.Lock()
+			codes[code]++
+			mu.Unlock()
+		}(res)
+	}
+	wg.Wait()
+
+	if codes[http.StatusOK] != 1 || codes[http.StatusTooManyRequests] != n-1 {
+		t.Errorf("codes: %v", codes)
+	}
+}
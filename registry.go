@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// default heartbeat_ttl, seconds
+const defaultHeartbeatTtl = 60
+
+// Heartbeat is the periodic message of cbsd-mq-router node in heartbeat_tube,
+// capacity and labels override the "nodes" config when set
+type Heartbeat struct {
+	Node    string            `json:"node"`
+	Cpus    int               `json:"cpus,omitempty"`
+	Ram     string            `json:"ram,omitempty"`
+	Imgsize string            `json:"imgsize,omitempty"`
+	Labels  map[string]string `json:"labels,omitempty"`
+	Load    float64           `json:"load"`
+	Version string            `json:"version,omitempty"`
+}
+
+// NodeStatus is the node of registry, reply of /api/v1/nodes
+type NodeStatus struct {
+	Node
+	Load      float64   `json:"load"`
+	Version   string    `json:"version,omitempty"`
+	LastSeen  time.Time `json:"last_seen,omitempty"`
+	Alive     bool      `json:"alive"`
+	Instances int       `json:"instances"`
+	Used      Resources `json:"used"`
+}
+
+// nodeRegistry keeps nodes of config and the ones learned from heartbeats
+type nodeRegistry struct {
+	mu    sync.RWMutex
+	nodes map[string]*NodeStatus
+}
+
+var registry = newNodeRegistry()
+
+func newNodeRegistry() *nodeRegistry {
+	return &nodeRegistry{nodes: make(map[string]*NodeStatus)}
+}
+
+// heartbeatEnabled: nodes must send heartbeats to be scheduled
+func heartbeatEnabled() bool {
+	return len(config.HeartbeatTube) > 0
+}
+
+func heartbeatTtl() time.Duration {
+	if config.HeartbeatTtl > 0 {
+		return time.Duration(config.HeartbeatTtl) * time.Second
+	}
+	return defaultHeartbeatTtl * time.Second
+}
+
+// Load replaces config nodes, heartbeat state of known nodes is kept
+func (reg *nodeRegistry) Load(nodes []Node) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+
+	for _, n := range nodes {
+		st, ok := reg.nodes[n.Name]
+		if !ok {
+			st = &NodeStatus{}
+			reg.nodes[n.Name] = st
+		}
+		st.Node = n
+	}
+}
+
+// Heartbeat updates node of hb, unknown node is added
+func (reg *nodeRegistry) Heartbeat(hb Heartbeat, now time.Time) error {
+	if !regexpNodeName.MatchString(hb.Node) {
+		return fmt.Errorf("heartbeat: bad node name: [%s]", hb.Node)
+	}
+	for _, size := range []string{hb.Ram, hb.Imgsize} {
+		if len(size) > 0 && !regexpSize.MatchString(size) {
+			return fmt.Errorf("heartbeat: %s: bad size: [%s]", hb.Node, size)
+		}
+	}
+
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+
+	st, ok := reg.nodes[hb.Node]
+	if !ok {
+		fmt.Printf("* node registered: %s %s\n", hb.Node, hb.Version)
+		st = &NodeStatus{Node: Node{Name: hb.Node}}
+		reg.nodes[hb.Node] = st
+	}
+	if hb.Cpus > 0 {
+		st.Cpus = hb.Cpus
+	}
+	if len(hb.Ram) > 0 {
+		st.Ram = hb.Ram
+	}
+	if len(hb.Imgsize) > 0 {
+		st.Imgsize = hb.Imgsize
+	}
+	if hb.Labels != nil {
+		st.Labels = hb.Labels
+	}
+	st.Load = hb.Load
+	st.Version = hb.Version
+	st.LastSeen = now
+	return nil
+}
+
+func (reg *nodeRegistry) alive(st *NodeStatus, now time.Time) bool {
+	if !heartbeatEnabled() {
+		return true
+	}
+	return !st.LastSeen.IsZero() && now.Sub(st.LastSeen) <= heartbeatTtl()
+}
+
+// Schedulable returns nodes with fresh heartbeat ( all nodes without heartbeats )
+func (reg *nodeRegistry) Schedulable() []*Node {
+	reg.mu.RLock()
+	defer reg.mu.RUnlock()
+
+	now := time.Now()
+	list := []*Node{}
+	for _, st := range reg.nodes {
+		if !reg.alive(st, now) {
+			continue
+		}
+		n := st.Node
+		list = append(list, &n)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// List returns copy of all nodes with alive state, sorted by name
+func (reg *nodeRegistry) List() []NodeStatus {
+	reg.mu.RLock()
+	defer reg.mu.RUnlock()
+
+	now := time.Now()
+	list := []NodeStatus{}
+	for _, st := range reg.nodes {
+		n := *st
+		n.Alive = reg.alive(st, now)
+		list = append(list, n)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// consume reads heartbeats from tube until stop is closed
+func (reg *nodeRegistry) consume(b Broker, tube string, stop <-chan struct{}) {
+	fmt.Printf("* heartbeat tube: %s, ttl: %s\n", tube, heartbeatTtl())
+
+	for {
+		select {
+		case <-stop:
+			return
+		default:
+		}
+
+		body, err := b.Await(context.Background(), tube, time.Second)
+		if errors.Is(err, ErrBrokerTimeout) {
+			continue
+		}
+		if err != nil {
+			fmt.Printf("heartbeat: %s: %s\n", tube, err.Error())
+			select {
+			case <-stop:
+				return
+			case <-time.After(time.Duration(config.BeanstalkConfig.ReconnectTimeout+1) * time.Second):
+			}
+			continue
+		}
+
+		hb := Heartbeat{}
+		if err := json.Unmarshal(body, &hb); err != nil {
+			fmt.Printf("heartbeat: decode error: %s\n", err.Error())
+			continue
+		}
+		if err := reg.Heartbeat(hb, time.Now()); err != nil {
+			fmt.Println(err.Error())
+		}
+	}
+}
+
+// HandleNodes replies nodes of registry with their usage
+func (feeds *MyFeeds) HandleNodes(w http.ResponseWriter, r *http.Request) {
+	Cid := r.Header.Get("cid")
+	if !validateCid(Cid) {
+		JSONError(w, "The cid should be valid form: ^[a-f0-9]{32}$", http.StatusUnauthorized)
+		return
+	}
+
+	if !isCidAllowed(feeds, Cid) {
+		fmt.Printf("CID not in ACL: %s\n", Cid)
+		JSONError(w, "not allowed", http.StatusForbidden)
+		return
+	}
+
+	if !isPermitted(feeds, Cid, permRead) {
+		JSONError(w, ErrPermission.Error(), http.StatusForbidden)
+		return
+	}
+
+	usage, count, err := nodeUsage()
+	if err != nil {
+		JSONError(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	list := registry.List()
+	for i := range list {
+		list[i].Used = usage[list[i].Name]
+		list[i].Instances = count[list[i].Name]
+	}
+	writeJSON(w, list)
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func setupRegistry(t *testing.T, tube string, nodes ...Node) {
+	t.Helper()
+	config.HeartbeatTube = tube
+	config.HeartbeatTtl = 60
+	registry = newNodeRegistry()
+	registry.Load(nodes)
+	t.Cleanup(func() {
+		config.HeartbeatTube = ""
+		config.HeartbeatTtl = 0
+		registry = newNodeRegistry()
+	})
+}
+
+func TestNodeRegistry(t *testing.T) {
+	setupRegistry(t, "cbsd_heartbeat",
+		Node{Name: "n1", Cpus: 8},
+		Node{Name: "n2", Cpus: 8},
+		Node{Name: "n3", Cpus: 8},
+	)
+
+	now := time.Now()
+	for _, hb := range []struct {
+		hb   Heartbeat
+		seen time.Time
+	}{
+		{Heartbeat{Node: "n1", Cpus: 16, Load: 0.5, Version: "1.0"}, now},
+		{Heartbeat{Node: "n2"}, now.Add(-2 * time.Minute)},
+		{Heartbeat{Node: "n4", Ram: "64g", Labels: map[string]string{"zone": "a"}}, now},
+	} {
+		if err := registry.Heartbeat(hb.hb, hb.seen); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, hb := range []Heartbeat{{Node: "bad node"}, {Node: "-x"}, {Node: "n5", Ram: "lots"}} {
+		if err := registry.Heartbeat(hb, now); err == nil {
+			t.Errorf("%+v is accepted", hb)
+		}
+	}
+
+	// n2 is stale, n3 never sent heartbeat
+	nodes := registry.Schedulable()
+	if len(nodes) != 2 || nodes[0].Name != "n1" || nodes[1].Name != "n4" {
+		t.Fatalf("schedulable: %+v", nodes)
+	}
+	if nodes[0].Cpus != 16 || nodes[1].Ram != "64g" || nodes[1].Labels["zone"] != "a" {
+		t.Errorf("heartbeat capacity: %+v %+v", nodes[0], nodes[1])
+	}
+
+	// without heartbeat tube all config nodes are used
+	config.HeartbeatTube = ""
+	if nodes := registry.Schedulable(); len(nodes) != 4 {
+		t.Errorf("without heartbeats: %+v", nodes)
+	}
+}
+
+func TestHeartbeatConsume(t *testing.T) {
+	setupRegistry(t, "cbsd_heartbeat")
+	b := newMemoryBroker(MemoryConfig{})
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		registry.consume(b, config.HeartbeatTube, stop)
+		close(done)
+	}()
+
+	for _, body := range []string{`not json`, `{"node":"srv-01.example.org","cpus":32,"load":1.5,"version":"2.0"}`} {
+		if _, err := b.Publish(context.Background(), config.HeartbeatTube, []byte(body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(registry.Schedulable()) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("heartbeat is not consumed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	close(stop)
+	<-done
+
+	list := registry.List()
+	if len(list) != 1 || list[0].Name != "srv-01.example.org" || list[0].Cpus != 32 || list[0].Version != "2.0" || !list[0].Alive {
+		t.Errorf("registry: %+v", list)
+	}
+}
+
+func TestNodesEndpoint(t *testing.T) {
+	setupInstances(t, 0)
+	setupRegistry(t, "cbsd_heartbeat", Node{Name: "n1", Cpus: 8}, Node{Name: "n2", Cpus: 8})
+	registry.Heartbeat(Heartbeat{Node: "n1", Load: 0.25}, time.Now())
+	if err := store.PutInstance(&Instance{Cid: testCid, Id: "vm1", Kind: KindVm, Node: "n1", Resources: Resources{Cpus: 2}}); err != nil {
+		t.Fatal(err)
+	}
+
+	router := newRouter(&MyFeeds{f: &Feed{}})
+	req := httptest.NewRequest("GET", "/api/v1/nodes", nil)
+	req.Header.Set("cid", testCid)
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("%d %s", rec.Code, rec.Body.String())
+	}
+
+	var list []NodeStatus
+	if err := json.Unmarshal(rec.Body.Bytes(), &list); err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 2 || !list[0].Alive || list[1].Alive || list[0].Instances != 1 || list[0].Used.Cpus != 2 || list[0].Load != 0.25 {
+		t.Errorf("nodes: %+v", list)
+	}
+
+	req = httptest.NewRequest("GET", "/api/v1/nodes", nil)
+	rec = httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("without cid: %d", rec.Code)
+	}
+}
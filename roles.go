@@ -0,0 +1,162 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// roles of allowlist keys, set by authorized_keys option: role="readonly"
+const (
+	roleReadonly = "readonly" // status, cluster lists, jobs, events, quota, nodes
+	roleOperator = "operator" // + create, start, stop, kubeconfig
+	roleAdmin    = "admin"    // + destroy, default
+)
+
+// permissions checked by handlers
+const (
+	permRead       = "read"
+	permCreate     = "create"
+	permStartStop  = "startstop"
+	permKubeconfig = "kubeconfig"
+	permDestroy    = "destroy"
+)
+
+var rolePermissions = map[string][]string{
+	roleReadonly: {permRead},
+	roleOperator: {permRead, permCreate, permStartStop, permKubeconfig},
+	roleAdmin:    {permRead, permCreate, permStartStop, permKubeconfig, permDestroy},
+}
+
+var (
+	ErrPermission = errors.New("not permitted for the key role")
+	ErrImage      = errors.New("image is not permitted for the key")
+)
+
+// parseAllowOptions sets role, images and max_instances of p from
+// authorized_keys options, e.g:
+//
+//	role="operator",images="debian*,jail",max_instances=3,max_ram="64g" ssh-ed25519 AAAA...
+//
+// max_* are quota of the key, see Quota. Other options ( from=, no-pty, .. ) are kept but not used
+func parseAllowOptions(p *AllowList) error {
+	p.role = roleAdmin
+
+	for _, option := range p.options {
+		name, value, _ := strings.Cut(option, "=")
+		value = strings.Trim(value, "\"")
+
+		switch name {
+		case "role":
+			if _, ok := rolePermissions[value]; !ok {
+				return fmt.Errorf("unknown role: %s, valid: readonly, operator, admin", value)
+			}
+			p.role = value
+		case "images":
+			p.images = nil
+			for _, pattern := range strings.Split(value, ",") {
+				if _, err := path.Match(pattern, ""); err != nil || len(pattern) == 0 {
+					return fmt.Errorf("bad images pattern: [%s]", pattern)
+				}
+				p.images = append(p.images, pattern)
+			}
+		case "max_instances", "max_cpus", "max_k8s":
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 0 {
+				return fmt.Errorf("bad %s: [%s]", name, value)
+			}
+			switch name {
+			case "max_instances":
+				p.quota.Instances = n
+			case "max_cpus":
+				p.quota.Cpus = n
+			case "max_k8s":
+				p.quota.K8s = n
+			}
+		case "max_ram", "max_imgsize":
+			if !regexpSize.MatchString(value) {
+				return fmt.Errorf("bad %s: [%s], e.g: 64g", name, value)
+			}
+			if name == "max_ram" {
+				p.quota.RamMb = sizeMb(value)
+			} else {
+				p.quota.ImgsizeMb = sizeMb(value)
+			}
+		}
+	}
+	return nil
+}
+
+func (p *AllowList) can(perm string) bool {
+	for _, granted := range rolePermissions[p.role] {
+		if granted == perm {
+			return true
+		}
+	}
+	return false
+}
+
+// imageAllowed matches image against images patterns, empty list allows all
+func (p *AllowList) imageAllowed(image string) bool {
+	if len(p.images) == 0 {
+		return true
+	}
+	for _, pattern := range p.images {
+		if ok, _ := path.Match(pattern, image); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// allowEntry returns allowlist key of cid: by cid or by the tenant key
+// with another comment
+func (feeds *MyFeeds) allowEntry(Cid string) *AllowList {
+	f := feeds.feed()
+	if p, ok := f.byCid[Cid]; ok {
+		return p
+	}
+	if tenant, err := store.GetTenant(Cid); err == nil && len(tenant.Fingerprint) > 0 {
+		if p, ok := f.byFingerprint[tenant.Fingerprint]; ok {
+			return p
+		}
+	}
+	return nil
+}
+
+// isPermitted checks role of cid allowlist key, all is permitted with ACL disabled
+func isPermitted(feeds *MyFeeds, Cid string, perm string) bool {
+	if !acl_enable {
+		return true
+	}
+	p := feeds.allowEntry(Cid)
+	if p == nil || !p.can(perm) {
+		fmt.Printf("CID %s: %s is not permitted\n", Cid, perm)
+		return false
+	}
+	return true
+}
+
+// checkCreate applies role and images of key fingerprint to create of image,
+// quota is checked on reservation. Returns HTTP status and error.
+func checkCreate(feeds *MyFeeds, fingerprint string, image string) (int, error) {
+	if !acl_enable {
+		return http.StatusOK, nil
+	}
+
+	p, ok := feeds.feed().byFingerprint[fingerprint]
+	if !ok {
+		return http.StatusForbidden, errors.New("not allowed")
+	}
+	if !p.can(permCreate) {
+		return http.StatusForbidden, ErrPermission
+	}
+	if !p.imageAllowed(image) {
+		return http.StatusForbidden, ErrImage
+	}
+
+	return http.StatusOK, nil
+}
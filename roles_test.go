@@ -0,0 +1,169 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestAllowOptions(t *testing.T) {
+	for _, tt := range []struct {
+		options string
+		role    string
+		images  int
+		max     int
+		ok      bool
+	}{
+		{"", roleAdmin, 0, 0, true},
+		{`role="readonly" `, roleReadonly, 0, 0, true},
+		{`no-pty,role="operator",images="debian*,jail",max_instances=3 `, roleOperator, 2, 3, true},
+		{`role="root" `, "", 0, 0, false},
+		{`max_instances="-1" `, "", 0, 0, false},
+		{`images="[" `, "", 0, 0, false},
+	} {
+		p, err := newAllow(tt.options + testKeyLine("ci@example.org"))
+		if (err == nil) != tt.ok {
+			t.Errorf("[%s]: %v", tt.options, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if p.role != tt.role || len(p.images) != tt.images || p.quota.Instances != tt.max {
+			t.Errorf("[%s]: %+v", tt.options, p)
+		}
+	}
+}
+
+func TestRolePermissions(t *testing.T) {
+	setupInstances(t, 1)
+	broker = newMemoryBroker(MemoryConfig{})
+	acl_enable = true
+	t.Cleanup(func() { acl_enable = false })
+
+	path := filepath.Join(t.TempDir(), "cbsd-mq-api.allow")
+	feeds := &MyFeeds{f: &Feed{}}
+	router := newRouter(feeds)
+
+	for _, tt := range []struct {
+		role  string
+		codes map[string]int
+	}{
+		{roleReadonly, map[string]int{"status": http.StatusOK, "kubeconfig": http.StatusForbidden, "stop": http.StatusForbidden, "destroy": http.StatusForbidden}},
+		{roleOperator, map[string]int{"status": http.StatusOK, "stop": http.StatusOK, "start": http.StatusOK, "destroy": http.StatusForbidden}},
+		{roleAdmin, map[string]int{"status": http.StatusOK, "stop": http.StatusOK, "destroy": http.StatusOK}},
+	} {
+		// instance of testCid is owned by the key
+		line := testKeyLine(tt.role + "@example.org")
+		key, _, _, _, _ := ssh.ParseAuthorizedKey([]byte(line))
+		if err := store.PutTenant(&Tenant{Cid: testCid, Pubkey: line, Fingerprint: ssh.FingerprintSHA256(key), Created: time.Now()}); err != nil {
+			t.Fatal(err)
+		}
+		writeAllowList(t, path, "role=\""+tt.role+"\" "+line+"\n", time.Now())
+		if err := feeds.Reload(path); err != nil {
+			t.Fatal(err)
+		}
+
+		for _, action := range []string{"status", "kubeconfig", "stop", "start", "destroy"} {
+			code, ok := tt.codes[action]
+			if !ok {
+				continue
+			}
+			req := httptest.NewRequest("GET", "/api/v1/"+action+"/vm0", nil)
+			req.Header.Set("cid", testCid)
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, req)
+			if rec.Code != code {
+				t.Errorf("%s %s: %d %s", tt.role, action, rec.Code, rec.Body.String())
+			}
+		}
+	}
+}
+
+func TestCheckCreate(t *testing.T) {
+	acl_enable = true
+	t.Cleanup(func() { acl_enable = false })
+
+	path := filepath.Join(t.TempDir(), "cbsd-mq-api.allow")
+	readonly := testKeyLine("ci@example.org")
+	limited := testKeyLine("dev@example.org")
+	writeAllowList(t, path, `role="readonly" `+readonly+"\n"+`role="operator",images="debian*,jail" `+limited+"\n", time.Now())
+	f, err := loadAllowList(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	feeds := &MyFeeds{f: f}
+
+	fp := func(line string) string {
+		key, _, _, _, _ := ssh.ParseAuthorizedKey([]byte(line))
+		return ssh.FingerprintSHA256(key)
+	}
+
+	for _, tt := range []struct {
+		name  string
+		key   string
+		image string
+		code  int
+	}{
+		{"readonly", readonly, "debian12", http.StatusForbidden},
+		{"image", limited, "freebsd14", http.StatusForbidden},
+		{"jail", limited, "jail", http.StatusOK},
+		{"not listed", testKeyLine(""), "debian12", http.StatusForbidden},
+	} {
+		code, err := checkCreate(feeds, fp(tt.key), tt.image)
+		if code != tt.code {
+			t.Errorf("%s: %d %v", tt.name, code, err)
+		}
+	}
+}
+
+// read endpoints are refused to a key whose role grants no read
+func TestReadPermission(t *testing.T) {
+	setupInstances(t, 1)
+	acl_enable = true
+	rolePermissions["none"] = nil
+	t.Cleanup(func() {
+		acl_enable = false
+		delete(rolePermissions, "none")
+	})
+
+	path := filepath.Join(t.TempDir(), "cbsd-mq-api.allow")
+	feeds := &MyFeeds{f: &Feed{}}
+	router := newRouter(feeds)
+
+	line := testKeyLine("none@example.org")
+	key, _, _, _, _ := ssh.ParseAuthorizedKey([]byte(line))
+	if err := store.PutTenant(&Tenant{Cid: testCid, Pubkey: line, Fingerprint: ssh.FingerprintSHA256(key), Created: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.PutJob(&Job{Id: 1, Command: "start", Instance: "vm0", Cid: testCid, State: JobSuccess}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		role string
+		code int
+	}{
+		{"none", http.StatusForbidden},
+		{roleReadonly, http.StatusOK},
+	} {
+		writeAllowList(t, path, "role=\""+tt.role+"\" "+line+"\n", time.Now())
+		if err := feeds.Reload(path); err != nil {
+			t.Fatal(err)
+		}
+
+		for _, endpoint := range []string{"status/vm0", "cluster", "k8scluster", "quota", "nodes", "jobs", "jobs/1", "jobs/1/events"} {
+			req := httptest.NewRequest("GET", "/api/v1/"+endpoint, nil)
+			req.Header.Set("cid", testCid)
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, req)
+			if rec.Code != tt.code {
+				t.Errorf("%s %s: %d %s", tt.role, endpoint, rec.Code, rec.Body.String())
+			}
+		}
+	}
+}
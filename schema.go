@@ -0,0 +1,360 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// max length of string value, longer ones was silently dropped from jconf
+const schemaMaxLength = 1000
+
+var (
+	regexpSize     = regexp.MustCompile(`^[1-9](([0-9]+)?)([m|g|t])$`)
+	regexpPkgList  = regexp.MustCompile(`^[aA-zZ_]([aA-zZ0-9_\-/ ])*$`)
+	regexpExtras   = regexp.MustCompile("^[a-zA-Z0-9:,]*$")
+	regexpHostName = regexp.MustCompile(`^[aA-zZ0-9_\-\.]+$`)
+	regexpVmOsType = regexp.MustCompile(`^[a-z_]+$`)
+	regexpParamVal = regexp.MustCompile(`^[aA-zZ0-9_\-. ]+$`)
+	regexpPubkey   = regexp.MustCompile("^(ssh-rsa|ssh-dss|ssh-ed25519|ecdsa-[^ ]+) ([^ ]+) ?(.*)")
+	regexpEmail    = regexp.MustCompile("^[a-zA-Z0-9.!#$%&'*+/=?^_`{|}~-]+@[a-zA-Z0-9](?:[a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?(?:\\.[a-zA-Z0-9](?:[a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?)*$")
+	regexpCallback = regexp.MustCompile(`^(http|https)://`)
+)
+
+// schemaField is one key of create payload
+type schemaField struct {
+	Name        string
+	Type        string // "string" or "integer"
+	Description string
+	Required    bool
+	// required when integer field RequiredIf is > 0
+	RequiredIf string
+	Pattern    *regexp.Regexp
+	MinLength  int
+	Minimum    int // integer only
+	Maximum    int // integer only
+}
+
+// payloadSchema of create payload for one image type
+type payloadSchema struct {
+	Title  string
+	Fields []schemaField
+	// at least one of AnyOf fields is required
+	AnyOf []string
+}
+
+// FieldError is the reason why payload field is invalid
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// reply with every invalid field of payload
+type ValidationResponse struct {
+	Message string
+	Errors  []FieldError
+}
+
+var pubkeyField = schemaField{Name: "pubkey", Type: "string", Required: true, Pattern: regexpPubkey, MinLength: 30,
+	Description: "SSH public key, md5 of the key is the cid"}
+var recomendationField = schemaField{Name: "recomendation", Type: "string", Pattern: regexpPlacement,
+	Description: "node, or label rules: key=value,key!=value"}
+var emailField = schemaField{Name: "email", Type: "string", Pattern: regexpEmail}
+var callbackField = schemaField{Name: "callback", Type: "string", Pattern: regexpCallback}
+
+// createSchemas by image type: vm, jail, k8s
+var createSchemas = map[string]payloadSchema{
+	"vm": {
+		Title: "VM create payload",
+		Fields: []schemaField{
+			{Name: "image", Type: "string", Pattern: regexpParamVal, Description: "cloud image, see /images"},
+			{Name: "type", Type: "string", Pattern: regexpParamVal},
+			{Name: "vm_os_type", Type: "string", Pattern: regexpVmOsType, Description: "ISO profile OS type, image is set to -vmengine"},
+			{Name: "vm_os_profile", Type: "string", Pattern: regexpParamVal, Description: "ISO profile, image is set to -vmengine"},
+			{Name: "ram", Type: "string", Pattern: regexpSize, Description: "512m, 1g"},
+			{Name: "cpus", Type: "integer", Required: true, Minimum: 1, Maximum: 16},
+			{Name: "imgsize", Type: "string", Required: true, Pattern: regexpSize, Description: "2g, 30g"},
+			pubkeyField,
+			{Name: "pkglist", Type: "string", Pattern: regexpPkgList, Description: "space separated packages"},
+			{Name: "extras", Type: "string", Pattern: regexpExtras},
+			recomendationField,
+			{Name: "host_hostname", Type: "string", Pattern: regexpHostName},
+			emailField,
+			callbackField,
+		},
+		AnyOf: []string{"image", "vm_os_type", "vm_os_profile"},
+	},
+	"jail": {
+		Title: "Jail create payload",
+		Fields: []schemaField{
+			{Name: "image", Type: "string", Required: true, Pattern: regexp.MustCompile("^jail$")},
+			{Name: "type", Type: "string", Pattern: regexpParamVal},
+			{Name: "ram", Type: "string", Pattern: regexpSize, Description: "512m, 1g, unlimited when not set"},
+			{Name: "cpus", Type: "integer", Required: true, Minimum: 1, Maximum: 16},
+			{Name: "imgsize", Type: "string", Pattern: regexpSize, Description: "2g, 30g"},
+			pubkeyField,
+			{Name: "pkglist", Type: "string", Pattern: regexpPkgList, Description: "space separated packages"},
+			{Name: "extras", Type: "string", Pattern: regexpExtras},
+			recomendationField,
+			{Name: "host_hostname", Type: "string", Pattern: regexpHostName},
+			emailField,
+			callbackField,
+		},
+	},
+	"k8s": {
+		Title: "K8S cluster create payload",
+		Fields: []schemaField{
+			{Name: "image", Type: "string", Required: true, Pattern: regexp.MustCompile("^k8s$")},
+			{Name: "init_masters", Type: "integer", Required: true, Minimum: 1, Maximum: 10},
+			{Name: "init_workers", Type: "integer", Minimum: 0, Maximum: 10},
+			{Name: "master_vm_ram", Type: "string", Required: true, Pattern: regexpSize, Description: "512m, 1g"},
+			{Name: "master_vm_cpus", Type: "integer", Minimum: 1, Maximum: 16},
+			{Name: "master_vm_imgsize", Type: "string", Required: true, Pattern: regexpSize, Description: "2g, 30g"},
+			{Name: "worker_vm_ram", Type: "string", RequiredIf: "init_workers", Pattern: regexpSize, Description: "512m, 1g"},
+			{Name: "worker_vm_cpus", Type: "integer", Minimum: 1, Maximum: 16},
+			{Name: "worker_vm_imgsize", Type: "string", RequiredIf: "init_workers", Pattern: regexpSize, Description: "2g, 30g"},
+			{Name: "pv_enable", Type: "integer", Minimum: 0, Maximum: 1, Description: "default: 1"},
+			{Name: "pv_size", Type: "string", Pattern: regexpSize},
+			{Name: "kubelet_master", Type: "integer", Minimum: 0, Maximum: 1, Description: "default: 1"},
+			emailField,
+			callbackField,
+			pubkeyField,
+			recomendationField,
+		},
+	},
+}
+
+// payloadKind returns image type of create payload: vm_os_type/vm_os_profile
+// is always VM, "jail" and "k8s" images, the rest are VM images
+func payloadKind(doc map[string]json.RawMessage) string {
+	if _, ok := doc["vm_os_type"]; ok {
+		return "vm"
+	}
+	if _, ok := doc["vm_os_profile"]; ok {
+		return "vm"
+	}
+
+	var image string
+	json.Unmarshal(doc["image"], &image)
+	switch image {
+	case "jail", "k8s":
+		return image
+	}
+	return "vm"
+}
+
+// validateCreate checks create payload against the schema of its image type,
+// returns the type and every invalid field. Error when body is not JSON object.
+func validateCreate(body []byte) (string, []FieldError, error) {
+	doc := map[string]json.RawMessage{}
+	if err := json.Unmarshal(body, &doc); err != nil {
+		return "", nil, err
+	}
+
+	kind := payloadKind(doc)
+	return kind, createSchemas[kind].validate(doc), nil
+}
+
+func (s payloadSchema) validate(doc map[string]json.RawMessage) []FieldError {
+	errs := []FieldError{}
+	known := make(map[string]bool)
+	ints := make(map[string]int64)
+
+	for _, f := range s.Fields {
+		known[f.Name] = true
+		raw, ok := doc[f.Name]
+		if !ok {
+			continue
+		}
+		if msg := f.check(raw); len(msg) > 0 {
+			errs = append(errs, FieldError{f.Name, msg})
+		} else if f.Type == "integer" {
+			ints[f.Name], _ = strconv.ParseInt(string(raw), 10, 64)
+		}
+	}
+
+	for _, f := range s.Fields {
+		if _, ok := doc[f.Name]; ok {
+			continue
+		}
+		switch {
+		case f.Required:
+			errs = append(errs, FieldError{f.Name, "required"})
+		case len(f.RequiredIf) > 0 && ints[f.RequiredIf] > 0:
+			errs = append(errs, FieldError{f.Name, fmt.Sprintf("required when %s > 0", f.RequiredIf)})
+		}
+	}
+
+	if len(s.AnyOf) > 0 {
+		found := false
+		for _, name := range s.AnyOf {
+			if _, ok := doc[name]; ok {
+				found = true
+			}
+		}
+		if !found {
+			errs = append(errs, FieldError{s.AnyOf[0], fmt.Sprintf("one of %s is required", strings.Join(s.AnyOf, ", "))})
+		}
+	}
+
+	unknown := []string{}
+	for name := range doc {
+		if !known[name] {
+			unknown = append(unknown, name)
+		}
+	}
+	sort.Strings(unknown)
+	for _, name := range unknown {
+		errs = append(errs, FieldError{name, "unknown field"})
+	}
+
+	return errs
+}
+
+// check returns why raw is not valid value of f, empty when valid
+func (f schemaField) check(raw json.RawMessage) string {
+	switch f.Type {
+	case "integer":
+		// as encoding/json: no quotes, no fraction
+		v, err := strconv.ParseInt(string(bytes.TrimSpace(raw)), 10, 64)
+		if err != nil {
+			return "must be an integer"
+		}
+		if v < int64(f.Minimum) || v > int64(f.Maximum) {
+			return fmt.Sprintf("valid range: %d-%d", f.Minimum, f.Maximum)
+		}
+	default:
+		var v string
+		if err := json.Unmarshal(raw, &v); err != nil {
+			return "must be a string"
+		}
+		if len(v) < f.MinLength {
+			return fmt.Sprintf("too short, min length: %d", f.MinLength)
+		}
+		if len(v) > schemaMaxLength {
+			return fmt.Sprintf("too long, max length: %d", schemaMaxLength)
+		}
+		if f.Pattern != nil && !f.Pattern.MatchString(v) {
+			return fmt.Sprintf("should be valid form: %s", f.Pattern.String())
+		}
+	}
+	return ""
+}
+
+// jconfValue returns payload field value as jconf param, empty when not set
+func jconfValue(v reflect.Value) string {
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() {
+			return ""
+		}
+		return jconfValue(v.Elem())
+	case reflect.Int:
+		return strconv.FormatInt(v.Int(), 10)
+	}
+	return v.String()
+}
+
+// decodeStrict unmarshal payload into v, unknown fields are error
+func decodeStrict(body []byte, v interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.DisallowUnknownFields()
+	return dec.Decode(v)
+}
+
+// JSONSchema renders s as JSON Schema (draft 2020-12)
+func (s payloadSchema) JSONSchema() map[string]interface{} {
+	properties := make(map[string]interface{})
+	required := []string{}
+	conditions := []interface{}{}
+
+	for _, f := range s.Fields {
+		p := map[string]interface{}{"type": f.Type}
+		if len(f.Description) > 0 {
+			p["description"] = f.Description
+		}
+		switch f.Type {
+		case "integer":
+			p["minimum"] = f.Minimum
+			p["maximum"] = f.Maximum
+		default:
+			if f.MinLength > 0 {
+				p["minLength"] = f.MinLength
+			}
+			p["maxLength"] = schemaMaxLength
+			if f.Pattern != nil {
+				p["pattern"] = f.Pattern.String()
+			}
+		}
+		properties[f.Name] = p
+
+		if f.Required {
+			required = append(required, f.Name)
+		}
+		if len(f.RequiredIf) > 0 {
+			conditions = append(conditions, map[string]interface{}{
+				"if": map[string]interface{}{
+					"properties": map[string]interface{}{f.RequiredIf: map[string]interface{}{"minimum": 1}},
+					"required":   []string{f.RequiredIf},
+				},
+				"then": map[string]interface{}{"required": []string{f.Name}},
+			})
+		}
+	}
+
+	schema := map[string]interface{}{
+		"$schema":              "https://json-schema.org/draft/2020-12/schema",
+		"title":                s.Title,
+		"type":                 "object",
+		"properties":           properties,
+		"required":             required,
+		"additionalProperties": false,
+	}
+	if len(conditions) > 0 {
+		schema["allOf"] = conditions
+	}
+	if len(s.AnyOf) > 0 {
+		anyOf := []interface{}{}
+		for _, name := range s.AnyOf {
+			anyOf = append(anyOf, map[string]interface{}{"required": []string{name}})
+		}
+		schema["anyOf"] = anyOf
+	}
+	return schema
+}
+
+// GET /api/v1/schema/{Image}: JSON Schema of create payload, Image: vm, jail, k8s
+func HandleCreateSchema(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+
+	schema, ok := createSchemas[params["Image"]]
+	if !ok {
+		JSONErrorLegacy(w, "image type: vm, jail, k8s", http.StatusNotFound, http.StatusNotFound)
+		return
+	}
+
+	writeJSON(w, schema.JSONSchema())
+}
+
+// ValidationError sends 422 with every invalid field
+func ValidationError(w http.ResponseWriter, errs []FieldError) {
+	if !isLegacy(w) {
+		APIError(w, http.StatusUnprocessableEntity, "invalid payload", errs)
+		return
+	}
+
+	js, err := json.Marshal(ValidationResponse{Message: "invalid payload", Errors: errs})
+	if err != nil {
+		JSONError(w, "Marshal error", http.StatusInternalServerError)
+		return
+	}
+	writeBody(w, legacyStatus(http.StatusUnprocessableEntity), js)
+}
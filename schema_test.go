@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func fieldErrors(errs []FieldError) map[string]string {
+	m := make(map[string]string)
+	for _, e := range errs {
+		m[e.Field] = e.Message
+	}
+	return m
+}
+
+func TestValidateCreate(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		kind    string
+		invalid []string
+	}{
+		{"vm", `{"image":"debian12","imgsize":"10g","ram":"1g","cpus":2,"pubkey":"ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAI test@localhost"}`, "vm", nil},
+		{"vm every invalid field", `{"image":"debian12","imgsize":"10","ram":"1x","cpus":"2","pubkey":"ssh","bogus":1}`, "vm", []string{"imgsize", "ram", "cpus", "pubkey", "bogus"}},
+		{"vm pkglist", `{"image":"debian12","imgsize":"10g","cpus":1,"pkglist":"nginx py311-pip","pubkey":"ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAI test@localhost"}`, "vm", nil},
+		{"vm bad pkglist", `{"image":"debian12","imgsize":"10g","cpus":1,"pkglist":"nginx;reboot","pubkey":"ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAI test@localhost"}`, "vm", []string{"pkglist"}},
+		{"vm_os_type without image", `{"vm_os_type":"freebsd","imgsize":"10g","cpus":1,"pubkey":"ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAI test@localhost"}`, "vm", nil},
+		{"vm without image", `{"imgsize":"10g","cpus":1,"pubkey":"ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAI test@localhost"}`, "vm", []string{"image"}},
+		{"jail", `{"image":"jail","cpus":1,"pkglist":"nginx","pubkey":"ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAI test@localhost"}`, "jail", nil},
+		{"jail vm field", `{"image":"jail","cpus":17,"vm_os_profile":"x","pubkey":"ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAI test@localhost"}`, "vm", []string{"cpus", "imgsize"}},
+		{"k8s", `{"image":"k8s","init_masters":1,"master_vm_ram":"2g","master_vm_imgsize":"20g","pv_enable":0,"pubkey":"ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAI test@localhost"}`, "k8s", nil},
+		{"k8s workers", `{"image":"k8s","init_masters":1.5,"init_workers":2,"master_vm_ram":"2g","master_vm_imgsize":"20g","pubkey":"ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAI test@localhost"}`, "k8s", []string{"init_masters", "worker_vm_ram", "worker_vm_imgsize"}},
+	}
+
+	for _, tt := range tests {
+		kind, errs, err := validateCreate([]byte(tt.body))
+		if err != nil {
+			t.Fatalf("%s: %s", tt.name, err)
+		}
+		if kind != tt.kind {
+			t.Errorf("%s: kind %s, want %s", tt.name, kind, tt.kind)
+		}
+		got := fieldErrors(errs)
+		if len(got) != len(tt.invalid) {
+			t.Errorf("%s: invalid fields %v, want %v", tt.name, errs, tt.invalid)
+			continue
+		}
+		for _, field := range tt.invalid {
+			if _, ok := got[field]; !ok {
+				t.Errorf("%s: %s is not reported: %v", tt.name, field, errs)
+			}
+		}
+	}
+
+	if _, _, err := validateCreate([]byte(`[1]`)); err == nil {
+		t.Errorf("non-object payload accepted")
+	}
+}
+
+// create replies 422 with every invalid field, nothing is reserved
+func TestCreateValidationError(t *testing.T) {
+	setupInstances(t, 0)
+	router := newRouter(&MyFeeds{f: &Feed{}})
+
+	body := `{"image":"debian12","imgsize":"10","cpus":0,"pubkey":"ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAI test@localhost","Cpus":1}`
+	req := httptest.NewRequest("POST", "/api/v1/create/vm1", strings.NewReader(body))
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("code %d: %s", rec.Code, rec.Body.String())
+	}
+
+	var reply struct {
+		Code    string
+		Details []FieldError
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply.Code != "invalid_payload" {
+		t.Errorf("code: %s", reply.Code)
+	}
+	got := fieldErrors(reply.Details)
+	for _, field := range []string{"imgsize", "cpus", "Cpus"} {
+		if _, ok := got[field]; !ok {
+			t.Errorf("%s is not reported: %s", field, rec.Body.String())
+		}
+	}
+
+	list, _ := store.ListInstances("")
+	if len(list) != 0 {
+		t.Errorf("%d instances after invalid create", len(list))
+	}
+}
+
+func TestCreateSchemaEndpoint(t *testing.T) {
+	router := newRouter(&MyFeeds{f: &Feed{}})
+
+	for image := range createSchemas {
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest("GET", "/api/v1/schema/"+image, nil))
+		if rec.Code != 200 {
+			t.Errorf("%s: code %d", image, rec.Code)
+			continue
+		}
+		var schema map[string]interface{}
+		if err := json.Unmarshal(rec.Body.Bytes(), &schema); err != nil {
+			t.Errorf("%s: %s", image, err)
+		}
+		if schema["additionalProperties"] != false {
+			t.Errorf("%s: additionalProperties allowed", image)
+		}
+	}
+}
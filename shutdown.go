@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+var shutdownTimeout = flag.Int("shutdown_timeout", 30, "Max time to drain in-flight requests and jobs on SIGTERM/SIGINT, seconds")
+
+// number of background watchJob goroutines, shutdown waits for them
+var jobsCount int64
+
+// runJob follows replies of job in background, see watchJob. The watcher
+// keeps b, s and jobContext of the moment it is started.
+func runJob(b Broker, s Store, reserveTimeout int, job Job) {
+	ctx := jobContext
+	atomic.AddInt64(&jobsCount, 1)
+
+	go func() {
+		defer atomic.AddInt64(&jobsCount, -1)
+		watchJob(ctx, b, s, reserveTimeout, job)
+	}()
+}
+
+// waitJobs returns true when all jobs are finished before done
+func waitJobs(done <-chan struct{}) bool {
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+
+	for atomic.LoadInt64(&jobsCount) > 0 {
+		select {
+		case <-done:
+			return false
+		case <-ticker.C:
+		}
+	}
+	return true
+}
+
+// serve runs srv until SIGTERM or SIGINT, then shuts it down gracefully.
+// The second signal kills the process as before.
+func serve(srv *http.Server) error {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGTERM, syscall.SIGINT)
+
+	errc := make(chan error, 1)
+	go func() {
+		errc <- srv.ListenAndServe()
+	}()
+
+	select {
+	case err := <-errc:
+		return err
+	case s := <-sig:
+		signal.Stop(sig)
+		fmt.Printf("* %s: shutdown, timeout: %ds\n", s, *shutdownTimeout)
+	}
+
+	shutdown(srv, time.Duration(*shutdownTimeout)*time.Second)
+	if err := <-errc; !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// shutdown stops accepting requests, waits up to timeout for in-flight
+// requests and jobs, then interrupts the rest. Interrupted jobs keep their
+// state in the store, unpublished commands stay in the outbox.
+func shutdown(srv *http.Server, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if err := srv.Shutdown(ctx); err != nil {
+		fmt.Printf("* shutdown: requests: %s\n", err.Error())
+	}
+
+	if n := atomic.LoadInt64(&jobsCount); n > 0 {
+		fmt.Printf("* shutdown: waiting for %d jobs\n", n)
+	}
+	if !waitJobs(ctx.Done()) {
+		fmt.Printf("* shutdown: %d jobs unfinished, resume on next start\n", atomic.LoadInt64(&jobsCount))
+	}
+
+	// stops outbox and job watchers, they return after the current reserve
+	cancelJobs()
+	grace := make(chan struct{})
+	time.AfterFunc(time.Duration(config.BeanstalkConfig.ReserveTimeout+1)*time.Second, func() { close(grace) })
+	waitJobs(grace)
+
+	fmt.Println("* shutdown: done")
+}
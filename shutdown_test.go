@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestShutdownDrain(t *testing.T) {
+	setupInstances(t, 0)
+	mb := newMemoryBroker(MemoryConfig{})
+	broker = mb
+
+	job := Job{Id: 1, Command: "create", Instance: "vm0", Cid: testCid, State: JobPending, ReplyTube: "cbsd_node0_result_id1"}
+	store.PutJob(&job)
+	runJob(broker, store, 0, job)
+
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		body, _ := json.Marshal(CbsdTask{Progress: 100, Message: "created"})
+		mb.Publish(context.Background(), "cbsd_node0_result_id1", body)
+	}()
+
+	shutdown(&http.Server{}, 2*time.Second)
+
+	got, err := store.GetJob(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.State != JobSuccess {
+		t.Errorf("state: %s", got.State)
+	}
+}
+
+// job without reply in shutdown timeout is interrupted, its state is kept
+func TestShutdownInterrupt(t *testing.T) {
+	setupInstances(t, 0)
+	broker = newMemoryBroker(MemoryConfig{})
+
+	job := Job{Id: 2, Command: "create", Instance: "vm0", Cid: testCid, State: JobRunning, Progress: 50, ReplyTube: "cbsd_node0_result_id2"}
+	store.PutJob(&job)
+	runJob(broker, store, 0, job)
+
+	start := time.Now()
+	shutdown(&http.Server{}, 200*time.Millisecond)
+
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("shutdown took %s", elapsed)
+	}
+	if n := atomic.LoadInt64(&jobsCount); n != 0 {
+		t.Errorf("jobs still running: %d", n)
+	}
+
+	got, err := store.GetJob(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.State != JobRunning || got.Progress != 50 {
+		t.Errorf("state: %s %d", got.State, got.Progress)
+	}
+}
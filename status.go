@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// instance status values written from job replies
+const (
+	StatusPending  = "pending"
+	StatusRunning  = "running"
+	StatusStopped  = "stopped"
+	StatusFailed   = "failed"
+	StatusTimedOut = "timed_out"
+)
+
+// instanceStatus returns status and power state of instance after job
+// update, empty when the job does not change them
+func instanceStatus(job *Job) (string, string) {
+	switch job.State {
+	case JobPending, JobRunning:
+		if job.Command == "create" {
+			return StatusPending, "false"
+		}
+	case JobSuccess:
+		switch job.Command {
+		case "create", "start":
+			return StatusRunning, "true"
+		case "stop":
+			return StatusStopped, "false"
+		}
+	case JobFailed:
+		// failed start/stop leaves the instance as it was
+		if job.Command == "create" {
+			return StatusFailed, "false"
+		}
+	case JobTimedOut:
+		if job.Command == "create" {
+			return StatusTimedOut, "false"
+		}
+	}
+	return "", ""
+}
+
+// apiStatusFields are set by updateInstanceStatus from job replies
+var apiStatusFields = map[string]bool{
+	"id":          true,
+	"progress":    true,
+	"errcode":     true,
+	"message":     true,
+	"job":         true,
+	"updated":     true,
+	"status":      true,
+	"is_power_on": true,
+}
+
+// updateInstanceStatus writes the last CbsdTask of job into the status
+// record of its instance in s ( and <jname>-vm.ssh with -legacy_compat ).
+// Fields set by CBSD scripts into <jname>-vm.ssh are kept. Read and write
+// are one store transaction: watchers of two jobs of the instance do not
+// lose each other's update.
+func updateInstanceStatus(s Store, job *Job) {
+	err := s.UpdateInstance(job.Cid, job.Instance, func(inst *Instance) error {
+		status := mergedStatus(inst)
+
+		status["id"] = inst.Id
+		status["progress"] = job.Progress
+		status["errcode"] = job.ErrCode
+		status["message"] = job.Message
+		status["job"] = job.Id
+		status["updated"] = job.Updated.Format(time.RFC3339)
+		if state, power := instanceStatus(job); len(state) > 0 {
+			status["status"] = state
+			status["is_power_on"] = power
+		}
+
+		data, err := json.MarshalIndent(status, "", "  ")
+		if err != nil {
+			return err
+		}
+		inst.Status = append(data, '\n')
+		return nil
+	})
+	// destroyed
+	if err == ErrNotFound {
+		return
+	}
+	if err != nil {
+		fmt.Printf("unable to save status of %s/%s: %s\n", job.Cid, job.Instance, err.Error())
+	}
+}
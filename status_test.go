@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+)
+
+// status endpoint reflects node replies without external scripts
+func TestReplyStatus(t *testing.T) {
+	setupInstances(t, 2)
+	mb := newMemoryBroker(MemoryConfig{})
+	broker = mb
+
+	// vm1 status file was extended by a CBSD script
+	inst, err := store.GetInstance(testCid, "vm1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(legacyStatusPath(inst), []byte(`{"id":"vm1","status":"pending","ssh_string":"ssh debian@10.0.0.2"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	router := newRouter(&MyFeeds{f: &Feed{}})
+	status := func(id string) map[string]interface{} {
+		t.Helper()
+		req := httptest.NewRequest("GET", "/api/v1/status/"+id, nil)
+		req.Header.Set("cid", testCid)
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s: %d %s", id, rec.Code, rec.Body.String())
+		}
+		m := map[string]interface{}{}
+		if err := json.Unmarshal(rec.Body.Bytes(), &m); err != nil {
+			t.Fatalf("%s: %v %s", id, err, rec.Body.String())
+		}
+		return m
+	}
+
+	tests := []struct {
+		id      string
+		replies []CbsdTask
+		status  string
+		power   string
+	}{
+		{"vm0", []CbsdTask{{Progress: 50, Message: "fetch image"}, {Progress: 100, Message: "created"}}, StatusRunning, "true"},
+		{"vm1", []CbsdTask{{Progress: 100, ErrCode: 1, Message: "no space left"}}, StatusFailed, "false"},
+	}
+
+	for i, tt := range tests {
+		tube := "cbsd_node_result_id" + tt.id
+		for _, task := range tt.replies {
+			body, _ := json.Marshal(task)
+			mb.Publish(context.Background(), tube, body)
+		}
+		watchJob(jobContext, mb, store, 0, Job{Id: uint64(i + 1), Command: "create", Instance: tt.id, Cid: testCid, State: JobPending, ReplyTube: tube})
+
+		got := status(tt.id)
+		last := tt.replies[len(tt.replies)-1]
+		if got["status"] != tt.status || got["is_power_on"] != tt.power {
+			t.Errorf("%s: %v", tt.id, got)
+		}
+		if got["progress"] != float64(100) || got["errcode"] != float64(last.ErrCode) || got["message"] != last.Message {
+			t.Errorf("%s: %v", tt.id, got)
+		}
+	}
+
+	if got := status("vm1"); got["ssh_string"] != "ssh debian@10.0.0.2" {
+		t.Errorf("script field lost: %v", got)
+	}
+
+	// stop of running instance
+	body, _ := json.Marshal(CbsdTask{Progress: 100, Message: "stopped"})
+	mb.Publish(context.Background(), "cbsd_node_result_id3", body)
+	watchJob(jobContext, mb, store, 0, Job{Id: 3, Command: "stop", Instance: "vm0", Cid: testCid, State: JobPending, ReplyTube: "cbsd_node_result_id3"})
+	if got := status("vm0"); got["status"] != StatusStopped || got["is_power_on"] != "false" {
+		t.Errorf("stopped: %v", got)
+	}
+}
+
+// without -legacy_compat nothing mirrors job progress into -vm.ssh: status
+// of the store is replied over the file last written by a script
+func TestReplyStatusWithoutCompat(t *testing.T) {
+	setupInstances(t, 1)
+	store = store.(*compatStore).Store
+
+	inst, err := store.GetInstance(testCid, "vm0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(legacyStatusPath(inst), []byte(`{"id":"vm0","status":"stopped","is_power_on":"false","ssh_string":"ssh debian@10.0.0.2"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	updateInstanceStatus(store, &Job{Id: 7, Command: "start", Instance: "vm0", Cid: testCid, State: JobSuccess, Progress: 100})
+
+	req := httptest.NewRequest("GET", "/api/v1/status/vm0", nil)
+	req.Header.Set("cid", testCid)
+	rec := httptest.NewRecorder()
+	newRouter(&MyFeeds{f: &Feed{}}).ServeHTTP(rec, req)
+
+	got := map[string]interface{}{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatalf("%v: %s", err, rec.Body.String())
+	}
+	if got["status"] != StatusRunning || got["job"] != float64(7) || got["progress"] != float64(100) || got["ssh_string"] != "ssh debian@10.0.0.2" {
+		t.Errorf("status: %v", got)
+	}
+}
+
+// concurrent read-modify-write of one instance loses no update
+func TestUpdateInstance(t *testing.T) {
+	const n = 16
+
+	setupInstances(t, 1)
+
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := store.UpdateInstance(testCid, "vm0", func(inst *Instance) error {
+				status := map[string]int{}
+				json.Unmarshal(inst.Status, &status)
+				status["updates"]++
+				inst.Status, _ = json.Marshal(status)
+				return nil
+			})
+			if err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	inst, err := store.GetInstance(testCid, "vm0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	status := map[string]int{}
+	json.Unmarshal(inst.Status, &status)
+	if status["updates"] != n {
+		t.Errorf("%d of %d updates", status["updates"], n)
+	}
+	if err := store.UpdateInstance(testCid, "nope", func(*Instance) error { return nil }); err != ErrNotFound {
+		t.Errorf("missing instance: %v", err)
+	}
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+var (
+	ErrNotFound = errors.New("store: not found")
+	ErrExists   = errors.New("store: already exists")
+)
+
+// instance kinds
+const (
+	KindVm  = "vm"  // bhyve/qemu/.. VM or jail: $dbdir, var/db/api/map
+	KindK8s = "k8s" // K8S cluster: $k8sdbdir, var/db/k8s/map
+)
+
+// Instance is the user environment: InstanceId of cid mapped to CBSD jname
+type Instance struct {
+	Cid     string          `json:"cid"`
+	Id      string          `json:"id"`
+	Jname   string          `json:"jname"`
+	Kind    string          `json:"kind"`
+	Node    string          `json:"node,omitempty"`
+	Status  json.RawMessage `json:"status,omitempty"`
+	Created time.Time       `json:"created"`
+	// Resources requested by create, counted by quota
+	Resources Resources `json:"resources"`
+}
+
+// Tenant is the owner of instances, one per public key. Fingerprint is
+// the SHA256 tenant id, known when Pubkey is. Suspended is set by admin API.
+type Tenant struct {
+	Cid         string    `json:"cid"`
+	Pubkey      string    `json:"pubkey,omitempty"`
+	Fingerprint string    `json:"fingerprint,omitempty"`
+	Suspended   bool      `json:"suspended,omitempty"`
+	Created     time.Time `json:"created"`
+}
+
+// Store keeps API state. VM/jail instances and K8S clusters share
+// the InstanceId namespace of cid, like the map files did.
+type Store interface {
+	// CreateInstance stores new instance, ErrExists when cid/id is taken
+	CreateInstance(inst *Instance) error
+	PutInstance(inst *Instance) error
+	GetInstance(cid string, id string) (*Instance, error)
+	// UpdateInstance applies update to cid/id and stores it in one
+	// transaction, concurrent updates of the instance do not lose each other
+	UpdateInstance(cid string, id string, update func(inst *Instance) error) error
+	DeleteInstance(cid string, id string) error
+	// ListInstances of cid, all tenants when cid is empty
+	ListInstances(cid string) ([]*Instance, error)
+
+	PutTenant(tenant *Tenant) error
+	GetTenant(cid string) (*Tenant, error)
+	// GetTenantByFingerprint returns tenant of SHA256 key fingerprint
+	GetTenantByFingerprint(fingerprint string) (*Tenant, error)
+	ListTenants() ([]*Tenant, error)
+
+	// CreateJob stores new job under the next free Id
+	CreateJob(job *Job) error
+	PutJob(job *Job) error
+	GetJob(id uint64) (*Job, error)
+	// ListJobs of cid ( and instance, when not empty ), newest first
+	ListJobs(cid string, instance string) ([]*Job, error)
+
+	Close() error
+}
+
+var store Store
+
+// openStore opens bolt database at path, on first open existing flat-file
+// state is imported. With compat the legacy files are still written
+// for CBSD scripts.
+func openStore(path string, compat bool) (Store, error) {
+	bs, created, err := openBoltStore(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if created {
+		fmt.Printf("* new store %s, import legacy state\n", path)
+		if err := importLegacy(bs); err != nil {
+			bs.Close()
+			return nil, err
+		}
+	}
+
+	if err := indexTenants(bs); err != nil {
+		bs.Close()
+		return nil, err
+	}
+
+	if compat {
+		fmt.Println("* legacy files compatibility enabled")
+		return &compatStore{Store: bs}, nil
+	}
+
+	return bs, nil
+}
+
+// reservation holds cid/id of instance being created
+type reservation struct {
+	inst      *Instance
+	committed bool
+}
+
+// reserveInstance atomically takes cid/id: concurrent requests for the same
+// name get ErrExists. Release drops reservation unless Commit was called.
+func reserveInstance(cid string, id string, kind string) (*reservation, error) {
+	inst := &Instance{Cid: cid, Id: id, Kind: kind, Created: time.Now()}
+	if err := store.CreateInstance(inst); err != nil {
+		return nil, err
+	}
+	return &reservation{inst: inst}, nil
+}
+
+func (r *reservation) Commit() {
+	r.committed = true
+}
+
+func (r *reservation) Release() {
+	if r.committed {
+		return
+	}
+	fmt.Printf("release reservation: %s/%s\n", r.inst.Cid, r.inst.Id)
+	if err := store.DeleteInstance(r.inst.Cid, r.inst.Id); err != nil {
+		fmt.Printf("unable to release %s/%s: %s\n", r.inst.Cid, r.inst.Id, err.Error())
+	}
+}
+
+// addTenant records cid with the public key on first instance, tenants
+// without key ( imported from legacy files ) get it now
+func addTenant(cid string, pubkey string) {
+	tenant, err := store.GetTenant(cid)
+	switch {
+	case err == ErrNotFound:
+		tenant = &Tenant{Cid: cid, Created: time.Now()}
+	case err != nil || len(tenant.Fingerprint) > 0:
+		return
+	}
+
+	key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(pubkey))
+	if err != nil {
+		fmt.Printf("unable to parse tenant %s key: %s\n", cid, err.Error())
+		return
+	}
+	tenant.Pubkey = pubkey
+	tenant.Fingerprint = ssh.FingerprintSHA256(key)
+
+	if err := store.PutTenant(tenant); err != nil {
+		fmt.Printf("unable to store tenant %s: %s\n", cid, err.Error())
+	}
+}
+
+// indexTenants sets Fingerprint of tenants stored with Pubkey only
+func indexTenants(s Store) error {
+	list, err := s.ListTenants()
+	if err != nil {
+		return err
+	}
+	for _, tenant := range list {
+		if len(tenant.Fingerprint) > 0 || len(tenant.Pubkey) == 0 {
+			continue
+		}
+		key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(tenant.Pubkey))
+		if err != nil {
+			fmt.Printf("* tenant %s: unable to parse key: %s\n", tenant.Cid, err.Error())
+			continue
+		}
+		tenant.Fingerprint = ssh.FingerprintSHA256(key)
+		if err := s.PutTenant(tenant); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// instanceDir returns db root dir of instance kind
+func instanceDir(kind string) string {
+	if kind == KindK8s {
+		return *k8sDbDir
+	}
+	return *dbDir
+}
+
+// instanceMapDir returns map dir of instance kind
+func instanceMapDir(kind string) string {
+	if kind == KindK8s {
+		return fmt.Sprintf("%s/var/db/k8s/map", workdir)
+	}
+	return fmt.Sprintf("%s/var/db/api/map", workdir)
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"os"
+	"sort"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	bucketInstances = []byte("instances")
+	bucketClusters  = []byte("clusters")
+	bucketTenants   = []byte("tenants")
+	bucketJobs      = []byte("jobs")
+	// SHA256 key fingerprint -> cid
+	bucketFingerprints = []byte("fingerprints")
+)
+
+// boltStore is the Store on top of bbolt: every call is a single transaction
+type boltStore struct {
+	db *bolt.DB
+}
+
+// openBoltStore returns store and whether the database file is new
+func openBoltStore(path string) (*boltStore, bool, error) {
+	created := !fileExists(path)
+
+	db, err := bolt.Open(path, 0660, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, false, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{bucketInstances, bucketClusters, bucketTenants, bucketJobs, bucketFingerprints} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		if created {
+			os.Remove(path)
+		}
+		return nil, false, err
+	}
+
+	return &boltStore{db: db}, created, nil
+}
+
+func (s *boltStore) Close() error {
+	return s.db.Close()
+}
+
+func boltInstanceKey(cid string, id string) []byte {
+	return []byte(cid + "/" + id)
+}
+
+func instanceBucket(kind string) []byte {
+	if kind == KindK8s {
+		return bucketClusters
+	}
+	return bucketInstances
+}
+
+func boltJobKey(id uint64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, id)
+	return key
+}
+
+func put(tx *bolt.Tx, bucket []byte, key []byte, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket(bucket).Put(key, b)
+}
+
+func get(tx *bolt.Tx, bucket []byte, key []byte, v interface{}) error {
+	b := tx.Bucket(bucket).Get(key)
+	if b == nil {
+		return ErrNotFound
+	}
+	return json.Unmarshal(b, v)
+}
+
+func (s *boltStore) CreateInstance(inst *Instance) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		key := boltInstanceKey(inst.Cid, inst.Id)
+		if tx.Bucket(bucketInstances).Get(key) != nil || tx.Bucket(bucketClusters).Get(key) != nil {
+			return ErrExists
+		}
+		return put(tx, instanceBucket(inst.Kind), key, inst)
+	})
+}
+
+func (s *boltStore) PutInstance(inst *Instance) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return put(tx, instanceBucket(inst.Kind), boltInstanceKey(inst.Cid, inst.Id), inst)
+	})
+}
+
+func (s *boltStore) GetInstance(cid string, id string) (*Instance, error) {
+	inst := &Instance{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		err := get(tx, bucketInstances, boltInstanceKey(cid, id), inst)
+		if err == ErrNotFound {
+			err = get(tx, bucketClusters, boltInstanceKey(cid, id), inst)
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return inst, nil
+}
+
+func (s *boltStore) UpdateInstance(cid string, id string, update func(inst *Instance) error) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		key := boltInstanceKey(cid, id)
+		inst := &Instance{}
+		err := get(tx, bucketInstances, key, inst)
+		if err == ErrNotFound {
+			err = get(tx, bucketClusters, key, inst)
+		}
+		if err != nil {
+			return err
+		}
+		if err := update(inst); err != nil {
+			return err
+		}
+		return put(tx, instanceBucket(inst.Kind), key, inst)
+	})
+}
+
+func (s *boltStore) DeleteInstance(cid string, id string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		key := boltInstanceKey(cid, id)
+		if tx.Bucket(bucketInstances).Get(key) == nil && tx.Bucket(bucketClusters).Get(key) == nil {
+			return ErrNotFound
+		}
+		if err := tx.Bucket(bucketInstances).Delete(key); err != nil {
+			return err
+		}
+		return tx.Bucket(bucketClusters).Delete(key)
+	})
+}
+
+func (s *boltStore) ListInstances(cid string) ([]*Instance, error) {
+	list := []*Instance{}
+	prefix := []byte{}
+	if len(cid) > 0 {
+		prefix = []byte(cid + "/")
+	}
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{bucketInstances, bucketClusters} {
+			c := tx.Bucket(name).Cursor()
+			for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+				inst := &Instance{}
+				if err := json.Unmarshal(v, inst); err != nil {
+					return err
+				}
+				list = append(list, inst)
+			}
+		}
+		return nil
+	})
+	return list, err
+}
+
+func (s *boltStore) PutTenant(tenant *Tenant) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		// the first tenant of the key keeps it
+		fp := tx.Bucket(bucketFingerprints)
+		if len(tenant.Fingerprint) > 0 && fp.Get([]byte(tenant.Fingerprint)) == nil {
+			if err := fp.Put([]byte(tenant.Fingerprint), []byte(tenant.Cid)); err != nil {
+				return err
+			}
+		}
+		return put(tx, bucketTenants, []byte(tenant.Cid), tenant)
+	})
+}
+
+func (s *boltStore) GetTenant(cid string) (*Tenant, error) {
+	tenant := &Tenant{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return get(tx, bucketTenants, []byte(cid), tenant)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return tenant, nil
+}
+
+func (s *boltStore) GetTenantByFingerprint(fingerprint string) (*Tenant, error) {
+	tenant := &Tenant{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		cid := tx.Bucket(bucketFingerprints).Get([]byte(fingerprint))
+		if cid == nil {
+			return ErrNotFound
+		}
+		return get(tx, bucketTenants, cid, tenant)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return tenant, nil
+}
+
+func (s *boltStore) ListTenants() ([]*Tenant, error) {
+	list := []*Tenant{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketTenants).ForEach(func(k, v []byte) error {
+			tenant := &Tenant{}
+			if err := json.Unmarshal(v, tenant); err != nil {
+				return err
+			}
+			list = append(list, tenant)
+			return nil
+		})
+	})
+	return list, err
+}
+
+// CreateJob keys job by the bucket sequence, not by the broker job id: the
+// memory broker and beanstalkd without binlog restart their ids from 1
+func (s *boltStore) CreateJob(job *Job) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketJobs)
+		id, err := b.NextSequence()
+		if err != nil {
+			return err
+		}
+		// jobs recorded before are keyed by their broker id
+		if last, _ := b.Cursor().Last(); last != nil {
+			if n := binary.BigEndian.Uint64(last); n >= id {
+				id = n + 1
+				if err := b.SetSequence(id); err != nil {
+					return err
+				}
+			}
+		}
+		job.Id = id
+		return put(tx, bucketJobs, boltJobKey(id), job)
+	})
+}
+
+func (s *boltStore) PutJob(job *Job) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return put(tx, bucketJobs, boltJobKey(job.Id), job)
+	})
+}
+
+func (s *boltStore) GetJob(id uint64) (*Job, error) {
+	job := &Job{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return get(tx, bucketJobs, boltJobKey(id), job)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return job, nil
+}
+
+func (s *boltStore) ListJobs(cid string, instance string) ([]*Job, error) {
+	list := []*Job{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketJobs).ForEach(func(k, v []byte) error {
+			job := &Job{}
+			if err := json.Unmarshal(v, job); err != nil {
+				return err
+			}
+			if len(cid) > 0 && job.Cid != cid {
+				return nil
+			}
+			if len(instance) > 0 && job.Instance != instance {
+				return nil
+			}
+			list = append(list, job)
+			return nil
+		})
+	})
+
+	sort.Slice(list, func(i, j int) bool { return list[i].Created.After(list[j].Created) })
+	return list, err
+}
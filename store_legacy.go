@@ -0,0 +1,337 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// compatStore keeps writing the legacy flat files for CBSD scripts which
+// still read them: map/<cid>-<id>, <cid>/vm-<id> ( cluster-<id> for K8S ),
+// <cid>/<jname>.node and <cid>/<jname>-vm.ssh. CBSD scripts write the last
+// two as well, so they are read with or without compatStore: -vm.ssh by
+// the status handlers and updateInstanceStatus ( fields added by scripts ),
+// .node by instanceNode for instances imported without node. They are
+// removed on destroy by destroyStored in both modes.
+type compatStore struct {
+	Store
+}
+
+func (s *compatStore) CreateInstance(inst *Instance) error {
+	if err := s.Store.CreateInstance(inst); err != nil {
+		return err
+	}
+	writeLegacy(inst)
+	return nil
+}
+
+func (s *compatStore) PutInstance(inst *Instance) error {
+	if err := s.Store.PutInstance(inst); err != nil {
+		return err
+	}
+	writeLegacy(inst)
+	return nil
+}
+
+// UpdateInstance writes legacy files within the update: files of
+// concurrent updates are written in the order of the transactions
+func (s *compatStore) UpdateInstance(cid string, id string, update func(inst *Instance) error) error {
+	return s.Store.UpdateInstance(cid, id, func(inst *Instance) error {
+		if err := update(inst); err != nil {
+			return err
+		}
+		writeLegacy(inst)
+		return nil
+	})
+}
+
+func (s *compatStore) DeleteInstance(cid string, id string) error {
+	inst, err := s.Store.GetInstance(cid, id)
+	if err != nil {
+		return err
+	}
+	if err := s.Store.DeleteInstance(cid, id); err != nil {
+		return err
+	}
+	removeLegacy(inst)
+	return nil
+}
+
+// legacy reservation file: <cid>/vm-<id> or <cid>/cluster-<id>
+func legacyInstancePath(inst *Instance) string {
+	if inst.Kind == KindK8s {
+		return fmt.Sprintf("%s/%s/cluster-%s", instanceDir(inst.Kind), inst.Cid, inst.Id)
+	}
+	return fmt.Sprintf("%s/%s/vm-%s", instanceDir(inst.Kind), inst.Cid, inst.Id)
+}
+
+func legacyMapPath(inst *Instance) string {
+	return fmt.Sprintf("%s/%s-%s", instanceMapDir(inst.Kind), inst.Cid, inst.Id)
+}
+
+func legacyNodePath(inst *Instance) string {
+	return fmt.Sprintf("%s/%s/%s.node", instanceDir(inst.Kind), inst.Cid, inst.Jname)
+}
+
+func legacyStatusPath(inst *Instance) string {
+	return fmt.Sprintf("%s/%s/%s-vm.ssh", instanceDir(inst.Kind), inst.Cid, inst.Jname)
+}
+
+func writeLegacy(inst *Instance) {
+	files := map[string][]byte{
+		legacyInstancePath(inst): []byte(inst.Jname),
+	}
+	// no map file for reservation: jname is not assigned yet
+	if len(inst.Jname) > 0 {
+		files[legacyMapPath(inst)] = []byte(inst.Jname)
+	}
+	if len(inst.Node) > 0 {
+		files[legacyNodePath(inst)] = []byte(inst.Node + "\n")
+	}
+	if len(inst.Status) > 0 {
+		files[legacyStatusPath(inst)] = inst.Status
+	}
+
+	for path, data := range files {
+		dir := path[:strings.LastIndex(path, "/")]
+		if !fileExists(dir) {
+			os.MkdirAll(dir, 0775)
+		}
+		if err := ioutil.WriteFile(path, data, 0664); err != nil {
+			fmt.Printf("legacy: unable to write %s: %s\n", path, err.Error())
+		}
+	}
+}
+
+// removeLegacy removes files written by compatStore only
+func removeLegacy(inst *Instance) {
+	removeFiles(legacyMapPath(inst), legacyInstancePath(inst))
+}
+
+// removeScriptFiles removes files CBSD scripts write for jname of inst
+func removeScriptFiles(inst *Instance) {
+	if len(inst.Jname) == 0 {
+		return
+	}
+	removeFiles(
+		legacyNodePath(inst),
+		legacyStatusPath(inst),
+		fmt.Sprintf("%s/%s/vms/%s", instanceDir(inst.Kind), inst.Cid, inst.Jname),
+	)
+}
+
+func removeFiles(paths ...string) {
+	for _, path := range paths {
+		fmt.Printf("   REMOVE: %s\n", path)
+		os.Remove(path)
+	}
+}
+
+// destroyStored removes destroyed instance cid/id from s and the files of
+// its jname written by CBSD scripts, with or without -legacy_compat: the
+// next instance of the same jname must not read their status and node
+func destroyStored(s Store, cid string, id string) error {
+	inst, err := s.GetInstance(cid, id)
+	if err != nil {
+		return err
+	}
+	if err := s.DeleteInstance(cid, id); err != nil {
+		return err
+	}
+	removeScriptFiles(inst)
+	return nil
+}
+
+// instanceNode returns hoster node of inst: from store or
+// from <jname>.node written by CBSD
+func instanceNode(inst *Instance) (string, error) {
+	if len(inst.Node) > 0 {
+		return inst.Node, nil
+	}
+
+	b, err := ioutil.ReadFile(legacyNodePath(inst))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+// importLegacy one-shot migration of the flat-file state into s: instances
+// from the map files ( with .node and -vm.ssh ), tenants from their
+// dirs and jobs from $dbdir/jobs
+func importLegacy(s Store) error {
+	var instances, tenants, jobsNum int
+
+	for _, kind := range []string{KindVm, KindK8s} {
+		files, err := ioutil.ReadDir(instanceMapDir(kind))
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return err
+		}
+
+		for _, file := range files {
+			// <cid>-<id>
+			name := file.Name()
+			if len(name) < 34 || name[32] != '-' {
+				continue
+			}
+			cid, id := name[:32], name[33:]
+			if !validateCid(cid) || !validateInstanceId(id) {
+				fmt.Printf("legacy import: skip %s/%s\n", instanceMapDir(kind), name)
+				continue
+			}
+
+			b, err := ioutil.ReadFile(fmt.Sprintf("%s/%s", instanceMapDir(kind), name))
+			if err != nil {
+				return err
+			}
+
+			inst := &Instance{Cid: cid, Id: id, Jname: strings.TrimSpace(string(b)), Kind: kind, Created: file.ModTime()}
+			if node, err := instanceNode(inst); err == nil {
+				inst.Node = node
+			}
+			if status, err := ioutil.ReadFile(legacyStatusPath(inst)); err == nil && json.Valid(status) {
+				inst.Status = status
+			}
+
+			if err := s.PutInstance(inst); err != nil {
+				return err
+			}
+			instances++
+
+			if _, err := s.GetTenant(cid); err == ErrNotFound {
+				if err := s.PutTenant(&Tenant{Cid: cid, Created: file.ModTime()}); err != nil {
+					return err
+				}
+				tenants++
+			}
+		}
+	}
+
+	jobsDir := fmt.Sprintf("%s/jobs", *dbDir)
+	files, err := ioutil.ReadDir(jobsDir)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, file := range files {
+		if !strings.HasSuffix(file.Name(), ".json") {
+			continue
+		}
+		b, err := ioutil.ReadFile(fmt.Sprintf("%s/%s", jobsDir, file.Name()))
+		if err != nil {
+			return err
+		}
+		job := &Job{}
+		if err := json.Unmarshal(b, job); err != nil {
+			fmt.Printf("legacy import: skip job %s: %s\n", file.Name(), err.Error())
+			continue
+		}
+		if err := s.PutJob(job); err != nil {
+			return err
+		}
+		jobsNum++
+	}
+
+	fmt.Printf("* legacy import: %d instances, %d tenants, %d jobs\n", instances, tenants, jobsNum)
+	return nil
+}
+
+// mergedStatus returns status of inst: fields written by CBSD scripts into
+// <jname>-vm.ssh with inst.Status of the store over them. Script fields
+// copied into the store earlier do not hide newer values of the file,
+// only apiStatusFields of the store always win.
+func mergedStatus(inst *Instance) map[string]interface{} {
+	status := map[string]interface{}{}
+	if len(inst.Jname) > 0 {
+		if data, err := ioutil.ReadFile(legacyStatusPath(inst)); err == nil && json.Valid(data) {
+			json.Unmarshal(data, &status)
+		}
+	}
+
+	stored := map[string]interface{}{}
+	if len(inst.Status) > 0 {
+		json.Unmarshal(inst.Status, &stored)
+	}
+	for k, v := range stored {
+		if _, ok := status[k]; !ok || apiStatusFields[k] {
+			status[k] = v
+		}
+	}
+	return status
+}
+
+// scriptList returns entries of <cid>/vm.list regenerated by CBSD scripts
+// by jname: list itself or lists in the top object
+func scriptList(cid string, kind string) map[string]map[string]interface{} {
+	byJname := make(map[string]map[string]interface{})
+
+	data, err := ioutil.ReadFile(fmt.Sprintf("%s/%s/vm.list", instanceDir(kind), cid))
+	if err != nil {
+		return byJname
+	}
+	var v interface{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return byJname
+	}
+
+	lists := []interface{}{v}
+	if m, ok := v.(map[string]interface{}); ok {
+		lists = lists[:0]
+		for _, l := range m {
+			lists = append(lists, l)
+		}
+	}
+	for _, l := range lists {
+		entries, ok := l.([]interface{})
+		if !ok {
+			continue
+		}
+		for _, e := range entries {
+			entry, ok := e.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			if jname, ok := entry["jname"].(string); ok {
+				byJname[jname] = entry
+			}
+		}
+	}
+	return byJname
+}
+
+// clusterList lists instances of kind of cid from s: status with id, jname,
+// node and created. Fields of vm.list the store does not have are added.
+func clusterList(s Store, cid string, kind string) ([]map[string]interface{}, error) {
+	instances, err := s.ListInstances(cid)
+	if err != nil {
+		return nil, err
+	}
+	scripts := scriptList(cid, kind)
+
+	list := []map[string]interface{}{}
+	for _, inst := range instances {
+		// reservation of create in progress
+		if inst.Kind != kind || len(inst.Jname) == 0 {
+			continue
+		}
+
+		entry := mergedStatus(inst)
+		for k, v := range scripts[inst.Jname] {
+			if _, ok := entry[k]; !ok {
+				entry[k] = v
+			}
+		}
+		entry["id"] = inst.Id
+		entry["jname"] = inst.Jname
+		entry["created"] = inst.Created
+		if node, err := instanceNode(inst); err == nil {
+			entry["node"] = node
+		}
+		list = append(list, entry)
+	}
+	return list, nil
+}
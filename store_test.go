@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// concurrent reservations of the same name: exactly one wins, released
+// name can be taken again and leaves no vm-<id> behind
+func TestReserveInstance(t *testing.T) {
+	const n = 16
+
+	setupInstances(t, 0)
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var won []*reservation
+
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			res, err := reserveInstance(testCid, "racer", KindVm)
+			if err != nil {
+				if err != ErrExists {
+					t.Errorf("reserve: %s", err)
+				}
+				return
+			}
+			mu.Lock()
+			won = append(won, res)
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	if len(won) != 1 {
+		t.Fatalf("%d reservations of the same name", len(won))
+	}
+
+	// K8S cluster shares the InstanceId namespace
+	if _, err := reserveInstance(testCid, "racer", KindK8s); err != ErrExists {
+		t.Errorf("cluster reserve: %v", err)
+	}
+
+	won[0].Release()
+
+	path := filepath.Join(*dbDir, testCid, "vm-racer")
+	if fileExists(path) {
+		t.Errorf("%s left after release", path)
+	}
+
+	res, err := reserveInstance(testCid, "racer", KindVm)
+	if err != nil {
+		t.Fatalf("reserve after release: %s", err)
+	}
+	res.Commit()
+	res.Release()
+
+	if _, err := store.GetInstance(testCid, "racer"); err != nil {
+		t.Errorf("committed reservation released: %s", err)
+	}
+}
+
+// <cid>.time of the last cluster is not touched by rejected create
+func TestK8sCreateTime(t *testing.T) {
+	setupInstances(t, 0)
+	setupNodes(t, placementSpread, Node{Name: "node9.example.org", Cpus: 32, Ram: "128g"})
+	setupFreejname(t, "k8s9")
+	broker = newMemoryBroker(MemoryConfig{})
+
+	saved := *k8sDbDir
+	*k8sDbDir = t.TempDir()
+	t.Cleanup(func() { *k8sDbDir = saved })
+
+	_, pubkey := testKey("k8s@localhost")
+	key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(pubkey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cid := tenantCid(key, pubkey)
+	timePath := filepath.Join(*k8sDbDir, cid+".time")
+
+	if err := store.PutInstance(&Instance{Cid: cid, Id: "taken", Jname: "vm1", Kind: KindVm}); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(timePath, []byte("1\nold\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	router := newRouter(&MyFeeds{f: &Feed{}})
+	create := func(id string) int {
+		body := fmt.Sprintf(`{"image":"k8s","init_masters":1,"master_vm_ram":"2g","master_vm_imgsize":"20g","pv_enable":0,"pubkey":"%s"}`, pubkey)
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest("POST", "/api/v1/create/"+id, strings.NewReader(body)))
+		return rec.Code
+	}
+
+	if code := create("taken"); code != http.StatusConflict {
+		t.Fatalf("create of taken name: %d", code)
+	}
+	if b, _ := os.ReadFile(timePath); string(b) != "1\nold\n" {
+		t.Errorf("rejected create wrote %q", b)
+	}
+
+	if code := create("fresh"); code != http.StatusOK {
+		t.Fatalf("create: %d", code)
+	}
+	if b, _ := os.ReadFile(timePath); !strings.HasSuffix(string(b), "\nfresh\n") {
+		t.Errorf("created: %q", b)
+	}
+}
+
+// without -legacy_compat destroy still removes files of CBSD scripts and
+// cluster list follows the store
+func TestDestroyWithoutCompat(t *testing.T) {
+	setupInstances(t, 2)
+	store = store.(*compatStore).Store
+	broker = newMemoryBroker(MemoryConfig{})
+
+	dir := filepath.Join(*dbDir, testCid)
+	scripts := []string{
+		filepath.Join(dir, "env0.node"),
+		filepath.Join(dir, "env0-vm.ssh"),
+		filepath.Join(dir, "vms", "env0"),
+	}
+	for _, path := range scripts[1:] {
+		if err := os.WriteFile(path, []byte(`{"status":"running","ssh_string":"ssh -p 22 debian@10.0.0.2"}`), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// stale list of scripts: fields of env1 are merged, env0 is gone
+	list := `{"servers":[{"jname":"env0","ip4_addr":"10.0.0.2"},{"jname":"env1","ip4_addr":"10.0.0.3"}]}`
+	if err := os.WriteFile(filepath.Join(dir, "vm.list"), []byte(list), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	router := newRouter(&MyFeeds{f: &Feed{}})
+	do := func(path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		req.Header.Set("cid", testCid)
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec
+	}
+
+	if rec := do("/api/v1/destroy/vm0"); rec.Code != http.StatusOK {
+		t.Fatalf("destroy: %d %s", rec.Code, rec.Body.String())
+	}
+	for _, path := range scripts {
+		if fileExists(path) {
+			t.Errorf("%s left after destroy", path)
+		}
+	}
+
+	rec := do("/api/v1/cluster")
+	var got []map[string]interface{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatalf("%v: %s", err, rec.Body.String())
+	}
+	if len(got) != 1 || got[0]["id"] != "vm1" || got[0]["jname"] != "env1" || got[0]["node"] != "node1.example.org" || got[0]["ip4_addr"] != "10.0.0.3" {
+		t.Errorf("cluster: %s", rec.Body.String())
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"crypto/md5"
+	"fmt"
+	"net/http"
+	"regexp"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// tenant id is the SHA256 fingerprint of the key, as `ssh-keygen -l` prints it.
+// Legacy cid is md5 of the first pubkey string of the tenant and stays the
+// storage key: $dbdir/<cid>, map/<cid>-<id>.
+var regexpFingerprint = regexp.MustCompile(`^SHA256:[A-Za-z0-9+/]{43}$`)
+
+func isFingerprint(id string) bool {
+	return regexpFingerprint.MatchString(id)
+}
+
+// tenantCid returns cid of key: cid of the tenant already known by the key
+// fingerprint, md5 of pubkey for the new one
+func tenantCid(key ssh.PublicKey, pubkey string) string {
+	if tenant, err := store.GetTenantByFingerprint(ssh.FingerprintSHA256(key)); err == nil {
+		return tenant.Cid
+	}
+	return fmt.Sprintf("%x", md5.Sum([]byte(pubkey)))
+}
+
+// resolveCid returns legacy cid of tenant id: fingerprint is looked up in
+// the store, then in the allowlist. md5 cid is returned as is.
+func (feeds *MyFeeds) resolveCid(id string) (string, bool) {
+	if !isFingerprint(id) {
+		return id, true
+	}
+	if tenant, err := store.GetTenantByFingerprint(id); err == nil {
+		return tenant.Cid, true
+	}
+	if p, ok := feeds.feed().byFingerprint[id]; ok {
+		return p.cid, true
+	}
+	return "", false
+}
+
+// tenantMiddleware replaces fingerprint in cid header by the legacy cid,
+// handlers work with md5 cid only
+func (feeds *MyFeeds) tenantMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("cid")
+		if isFingerprint(id) && !isAdminPath(r) {
+			cid, ok := feeds.resolveCid(id)
+			if !ok {
+				fmt.Printf("unknown tenant: %s\n", id)
+				JSONError(w, "no such tenant", http.StatusNotFound)
+				return
+			}
+			r.Header.Set("cid", cid)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"crypto/md5"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestTenantFingerprint(t *testing.T) {
+	setupInstances(t, 1)
+
+	line := testKeyLine("alice@example.org")
+	key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(line))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fp := ssh.FingerprintSHA256(key)
+
+	// legacy tenant is imported without key, it gets fingerprint on the next create
+	if _, err := store.GetTenantByFingerprint(fp); err != ErrNotFound {
+		t.Fatalf("fingerprint of imported tenant: %v", err)
+	}
+	addTenant(testCid, line)
+	tenant, err := store.GetTenantByFingerprint(fp)
+	if err != nil || tenant.Cid != testCid {
+		t.Fatalf("tenant by fingerprint: %+v %v", tenant, err)
+	}
+
+	// comment change is the same tenant, new key is the new one
+	if cid := tenantCid(key, strings.Replace(line, "alice@example.org", "alice@laptop", 1)); cid != testCid {
+		t.Errorf("same key with other comment: %s", cid)
+	}
+	other := testKeyLine("alice@example.org")
+	otherKey, _, _, _, _ := ssh.ParseAuthorizedKey([]byte(other))
+	if cid := tenantCid(otherKey, other); cid != fmt.Sprintf("%x", md5.Sum([]byte(other))) {
+		t.Errorf("new key: %s", cid)
+	}
+
+	router := newRouter(&MyFeeds{f: &Feed{}})
+	status := func(id string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/api/v1/status/vm0", nil)
+		req.Header.Set("cid", id)
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec
+	}
+
+	legacy := status(testCid)
+	byFp := status(fp)
+	if byFp.Code != legacy.Code || byFp.Body.String() != legacy.Body.String() {
+		t.Errorf("fingerprint: %d %s, md5 cid: %d %s", byFp.Code, byFp.Body.String(), legacy.Code, legacy.Body.String())
+	}
+
+	if rec := status(ssh.FingerprintSHA256(otherKey)); rec.Code != http.StatusNotFound {
+		t.Errorf("unknown fingerprint: %d %s", rec.Code, rec.Body.String())
+	}
+	if rec := status("SHA256:short"); rec.Code != http.StatusUnauthorized {
+		t.Errorf("malformed fingerprint: %d %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestIndexTenants(t *testing.T) {
+	setupInstances(t, 0)
+
+	line := testKeyLine("bob@example.org")
+	cid := fmt.Sprintf("%x", md5.Sum([]byte(line)))
+	if err := store.PutTenant(&Tenant{Cid: cid, Pubkey: line}); err != nil {
+		t.Fatal(err)
+	}
+	if err := indexTenants(store); err != nil {
+		t.Fatal(err)
+	}
+
+	key, _, _, _, _ := ssh.ParseAuthorizedKey([]byte(line))
+	tenant, err := store.GetTenantByFingerprint(ssh.FingerprintSHA256(key))
+	if err != nil || tenant.Cid != cid {
+		t.Errorf("tenant by fingerprint: %+v %v", tenant, err)
+	}
+}